@@ -0,0 +1,116 @@
+// Command accrual is a standalone accrual service implementing the API from
+// SPECIFICATION.md on top of the in-process accrual engine. It is meant for
+// local development and e2e tests of gophermart.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/gofermart/internal/accrual"
+	"github.com/shevchukeugeni/gofermart/internal/logging"
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	accrualstore "github.com/shevchukeugeni/gofermart/internal/store/accrual"
+	"github.com/shevchukeugeni/gofermart/internal/store/memory"
+	"github.com/shevchukeugeni/gofermart/internal/store/postgres"
+)
+
+type config struct {
+	RunAddress  string
+	DatabaseURI string
+	Delay       time.Duration
+	RateLimit   int
+	LogLevel    string
+}
+
+// envFlags maps the flags of loadConfig to the env variables setting them.
+var envFlags = []struct{ flag, env string }{
+	{"a", "RUN_ADDRESS"},
+	{"d", "DATABASE_URI"},
+	{"delay", "ACCRUAL_DELAY"},
+	{"rate-limit", "RATE_LIMIT"},
+	{"log-level", "LOG_LEVEL"},
+}
+
+// loadConfig reads flags and env variables. Flags take precedence, like in
+// gophermart; empty env variables are ignored.
+func loadConfig(name string, args []string) (*config, error) {
+	cfg := &config{}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&cfg.RunAddress, "a", "localhost:8081", "address and port to run server (env RUN_ADDRESS)")
+	fs.StringVar(&cfg.DatabaseURI, "d", "", "database connection uri, in-memory storage when empty (env DATABASE_URI)")
+	fs.DurationVar(&cfg.Delay, "delay", time.Second, "how long a registered order waits before it is calculated (env ACCRUAL_DELAY)")
+	fs.IntVar(&cfg.RateLimit, "rate-limit", 0, "order status requests per minute, 0 for no limit (env RATE_LIMIT)")
+	fs.StringVar(&cfg.LogLevel, "log-level", "info", "log level: debug, info, warn or error (env LOG_LEVEL)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, e := range envFlags {
+		v := os.Getenv(e.env)
+		if v == "" || set[e.flag] {
+			continue
+		}
+		if err := fs.Set(e.flag, v); err != nil {
+			return nil, fmt.Errorf("env %s: %w", e.env, err)
+		}
+	}
+
+	if cfg.Delay < 0 || cfg.RateLimit < 0 {
+		return nil, errors.New("delay and rate limit must not be negative")
+	}
+	return cfg, nil
+}
+
+func main() {
+	cfg, err := loadConfig(os.Args[0], os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatal(err)
+	}
+
+	logger, err := logging.New(logging.Config{Level: cfg.LogLevel, Format: logging.FormatJSON})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer logger.Sync()
+
+	var repo store.Accrual
+	if cfg.DatabaseURI == "" {
+		logger.Warn("using in-memory storage, data will be lost on restart")
+		repo = memory.NewAccrualRepository(memory.New())
+	} else {
+		db, err := postgres.NewPostgresDB(context.Background(), postgres.Config{
+			URL:     cfg.DatabaseURI,
+			Schemas: []postgres.Schema{postgres.SchemaAccrual},
+		})
+		if err != nil {
+			logger.Fatal("failed to initialize db: " + err.Error())
+		}
+		defer db.Close()
+		repo = accrualstore.NewRepository(db)
+	}
+
+	handler := accrual.NewHandler(logger, accrual.NewEngine(repo, cfg.Delay), accrual.ServerConfig{
+		RateLimit: cfg.RateLimit,
+	})
+
+	logger.Info("Running server on", zap.String("address", cfg.RunAddress))
+	err = http.ListenAndServe(cfg.RunAddress, handler)
+	if err != http.ErrServerClosed {
+		logger.Fatal("HTTP server ListenAndServe Error", zap.Error(err))
+	}
+}
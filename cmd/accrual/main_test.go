@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clearEnv keeps the environment of the test run out of loadConfig.
+func clearEnv(t *testing.T) {
+	t.Helper()
+
+	for _, e := range envFlags {
+		t.Setenv(e.env, "")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want config
+	}{
+		{
+			name: "defaults",
+			want: config{RunAddress: "localhost:8081", Delay: time.Second, LogLevel: "info"},
+		},
+		{
+			name: "env over defaults",
+			env:  map[string]string{"RUN_ADDRESS": "env:1", "ACCRUAL_DELAY": "5s", "RATE_LIMIT": "60"},
+			want: config{RunAddress: "env:1", Delay: 5 * time.Second, RateLimit: 60, LogLevel: "info"},
+		},
+		{
+			name: "empty env is ignored",
+			env:  map[string]string{"RUN_ADDRESS": ""},
+			want: config{RunAddress: "localhost:8081", Delay: time.Second, LogLevel: "info"},
+		},
+		{
+			name: "flag over env",
+			env:  map[string]string{"RUN_ADDRESS": "env:1", "DATABASE_URI": "postgres://env", "LOG_LEVEL": "debug"},
+			args: []string{"-a", "flag:2", "-log-level", "warn"},
+			want: config{RunAddress: "flag:2", DatabaseURI: "postgres://env", Delay: time.Second, LogLevel: "warn"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			cfg, err := loadConfig("accrual", tt.args)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, *cfg)
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"bad flag value", nil, []string{"-delay", "soon"}, "delay"},
+		{"bad env value", map[string]string{"RATE_LIMIT": "many"}, nil, "env RATE_LIMIT"},
+		{"negative delay", nil, []string{"-delay", "-1s"}, "must not be negative"},
+		{"negative rate limit", map[string]string{"RATE_LIMIT": "-1"}, nil, "must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			_, err := loadConfig("accrual", tt.args)
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+}
@@ -2,73 +2,269 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 
 	"github.com/go-resty/resty/v2"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
 
+	"github.com/shevchukeugeni/gofermart/internal/accrual"
+	"github.com/shevchukeugeni/gofermart/internal/auth"
+	"github.com/shevchukeugeni/gofermart/internal/config"
+	"github.com/shevchukeugeni/gofermart/internal/events"
+	"github.com/shevchukeugeni/gofermart/internal/logging"
+	"github.com/shevchukeugeni/gofermart/internal/metrics"
 	"github.com/shevchukeugeni/gofermart/internal/server"
+	"github.com/shevchukeugeni/gofermart/internal/sink"
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	accrualstore "github.com/shevchukeugeni/gofermart/internal/store/accrual"
+	"github.com/shevchukeugeni/gofermart/internal/store/memory"
 	"github.com/shevchukeugeni/gofermart/internal/store/order"
+	"github.com/shevchukeugeni/gofermart/internal/store/outbox"
 	"github.com/shevchukeugeni/gofermart/internal/store/postgres"
+	"github.com/shevchukeugeni/gofermart/internal/store/tier"
 	"github.com/shevchukeugeni/gofermart/internal/store/user"
+	"github.com/shevchukeugeni/gofermart/internal/store/webhook"
 	"github.com/shevchukeugeni/gofermart/internal/store/withdrawal"
+	"github.com/shevchukeugeni/gofermart/internal/tracing"
+	"github.com/shevchukeugeni/gofermart/internal/types"
 	"github.com/shevchukeugeni/gofermart/internal/worker"
 )
 
-var flagRunAddr, dbURI, accrualSystemAddr string
-
-func init() {
-	flag.StringVar(&flagRunAddr, "a", "localhost:8080", "address and port to run server")
-	flag.StringVar(&dbURI, "d", "", "database connection uri")
-	flag.StringVar(&accrualSystemAddr, "r", "", "accrual system address")
-
-	if envRunAddr := os.Getenv("RUN_ADDRESS"); envRunAddr != "" {
-		flagRunAddr = envRunAddr
-	}
-
-	if envDBURL := os.Getenv("DATABASE_URI"); envDBURL != "" {
-		dbURI = envDBURL
+func main() {
+	cfg, opts, err := config.Load(os.Args[0], os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatal(err)
 	}
 
-	if asa := os.Getenv("ACCRUAL_SYSTEM_ADDRESS"); asa != "" {
-		accrualSystemAddr = asa
+	if opts.PrintConfig {
+		fmt.Print(cfg)
+		return
 	}
-}
 
-func main() {
-	flag.Parse()
-
-	logger, err := zap.NewDevelopment()
+	logger, err := logging.New(logging.Config{Level: cfg.Log.Level, Format: cfg.Log.Format})
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer logger.Sync()
 
-	db, err := postgres.NewPostgresDB(postgres.Config{URL: dbURI})
+	logger.Info("effective configuration", zap.Stringer("config", cfg))
+	if cfg.Auth.JWTSecret == config.DefaultJWTSecret {
+		logger.Warn("using the default JWT secret, set JWT_SECRET in production")
+	}
+
+	auth.Setup(cfg.Auth.JWTSecret, cfg.Auth.TokenTTL)
+	types.SetOrderLength(cfg.Orders.MinLength, cfg.Orders.MaxLength)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter: cfg.Tracing.Exporter,
+		Endpoint: cfg.Tracing.Endpoint,
+		Insecure: cfg.Tracing.Insecure,
+	})
 	if err != nil {
-		logger.Fatal("failed to initialize db: " + err.Error())
+		logger.Fatal("failed to initialize tracing: " + err.Error())
 	}
-	defer db.Close()
+	defer shutdownTracing(context.Background())
 
 	ctx, cancelCtx := context.WithCancel(context.Background())
 
-	userRepo := user.NewRepository(db)
-	orderRepo := order.NewRepository(db)
-	withdrawalRepo := withdrawal.NewRepository(db, orderRepo)
+	var (
+		db             *pgxpool.Pool
+		userRepo       store.User
+		orderRepo      store.Order
+		withdrawalRepo store.Withdrawal
+		tierRepo       store.Tier
+		accrualRepo    store.Accrual
+		webhookRepo    store.Webhook
+		outboxRepo     store.Outbox
+	)
+
+	switch cfg.Storage {
+	case config.StorageMemory:
+		logger.Warn("using in-memory storage, data will be lost on restart")
+		mem := memory.New()
+		userRepo = memory.NewUserRepository(mem)
+		orderRepo = memory.NewOrderRepository(mem)
+		withdrawalRepo = memory.NewWithdrawalRepository(mem)
+		tierRepo = memory.NewTierRepository(mem)
+		accrualRepo = memory.NewAccrualRepository(mem)
+		webhookRepo = memory.NewWebhookRepository(mem)
+		outboxRepo = memory.NewOutboxRepository(mem)
+	default:
+		schemas := []postgres.Schema{postgres.SchemaGophermart}
+		if cfg.Accrual.Engine {
+			schemas = append(schemas, postgres.SchemaAccrual)
+		}
+		db, err = postgres.NewPostgresDB(ctx, postgres.Config{
+			URL:             cfg.DatabaseURI,
+			MaxConns:        int32(cfg.Database.MaxConns),
+			MinConns:        int32(cfg.Database.MinConns),
+			MaxConnLifetime: cfg.Database.MaxConnLifetime,
+			MaxConnIdleTime: cfg.Database.MaxConnIdleTime,
+			Schemas:         schemas,
+		})
+		if err != nil {
+			logger.Fatal("failed to initialize db: " + err.Error())
+		}
+		defer db.Close()
+
+		metrics.RegisterPoolStats(db)
+
+		userRepo = user.NewRepository(db)
+		orderRepo = order.NewRepository(db)
+		withdrawalRepo = withdrawal.NewRepository(db)
+		tierRepo = tier.NewRepository(db)
+		accrualRepo = accrualstore.NewRepository(db)
+		webhookRepo = webhook.NewRepository(db)
+		outboxRepo = outbox.NewRepository(db)
+	}
+
+	var (
+		accrualClient accrual.Client
+		registrar     accrual.Registrar
+	)
+	if cfg.Accrual.Engine {
+		engine := accrual.NewEngine(accrualRepo, cfg.Accrual.Delay)
+		for _, reward := range cfg.Accrual.RewardRules() {
+			changed, err := engine.SaveReward(ctx, reward)
+			if err != nil {
+				logger.Fatal("failed to register reward "+reward.Match, zap.Error(err))
+			}
+			if changed {
+				logger.Info("reward registered", zap.String("match", reward.Match),
+					zap.Float64("reward", reward.Reward), zap.String("reward_type", reward.RewardType))
+			}
+		}
+		accrualClient, registrar = engine, engine
+		logger.Info("using the in-process accrual engine")
+	} else {
+		client := resty.New().SetTimeout(cfg.Worker.RequestTimeout)
+		accrualClient = accrual.NewHTTPClient(logger, client, cfg.AccrualSystemAddress, uint(cfg.Worker.RetryAttempts))
+	}
 
-	client := resty.New()
+	// Without a database there is a single instance, so events need not
+	// leave the process.
+	hub := events.NewHub()
+	var publisher events.Publisher = hub
+	if db != nil {
+		notifier := events.NewNotifier(logger, db, hub)
+		go notifier.Listen(ctx)
+		publisher = notifier
+	}
 
-	updater := worker.NewWorker(logger, db, accrualSystemAddr, orderRepo, client)
+	updater := worker.NewWorker(logger, db, worker.Config{
+		PollInterval: cfg.Worker.PollInterval,
+		Events:       publisher,
+	}, orderRepo, accrualClient)
 
 	go updater.Run(ctx)
 
-	router := server.SetupRouter(logger, userRepo, orderRepo, withdrawalRepo)
+	if cfg.Points.TTL > 0 {
+		expirer := worker.NewExpirer(logger, worker.ExpiryConfig{
+			TTL:      cfg.Points.TTL,
+			Interval: cfg.Points.ExpiryInterval,
+			Events:   publisher,
+		}, withdrawalRepo)
+		go expirer.Run(ctx)
+	}
+
+	dispatcher := worker.NewWebhookDispatcher(logger, worker.WebhookConfig{
+		Interval:    cfg.Webhooks.Interval,
+		MaxAttempts: cfg.Webhooks.MaxAttempts,
+		Backoff:     cfg.Webhooks.Backoff,
+		Timeout:     cfg.Webhooks.Timeout,
+	}, webhookRepo)
+	go dispatcher.Run(ctx)
+
+	eventSink, err := sink.Open(sink.Config{
+		Kind:    cfg.Outbox.Sink,
+		Path:    cfg.Outbox.Path,
+		URL:     cfg.Outbox.URL,
+		Topic:   cfg.Outbox.Topic,
+		Timeout: cfg.Outbox.Timeout,
+	})
+	if err != nil {
+		logger.Fatal("failed to open event sink", zap.Error(err))
+	}
+	if eventSink != nil {
+		defer eventSink.Close()
+		outboxPublisher := worker.NewOutboxPublisher(logger, worker.OutboxConfig{
+			Interval:  cfg.Outbox.Interval,
+			BatchSize: cfg.Outbox.BatchSize,
+		}, outboxRepo, eventSink)
+		go outboxPublisher.Run(ctx)
+	}
+
+	// Events owed to a sink are never dropped.
+	pruner := worker.NewOutboxPruner(logger, worker.OutboxPruneConfig{
+		Interval:    cfg.Outbox.PruneInterval,
+		Retention:   cfg.Outbox.Retention,
+		MaxPending:  cfg.Outbox.MaxPending,
+		DropPending: eventSink == nil,
+	}, outboxRepo)
+	go pruner.Run(ctx)
+
+	tiers := cfg.Tiers.TierLevels()
+	if len(tiers) > 0 {
+		recalculator := worker.NewTierRecalculator(logger, worker.TierConfig{
+			Tiers:    tiers,
+			Basis:    cfg.Tiers.Basis,
+			Window:   cfg.Tiers.Window,
+			Interval: cfg.Tiers.RecalcInterval,
+		}, tierRepo)
+		go recalculator.Run(ctx)
+	} else {
+		// Multipliers assigned while tiers were enabled must not keep
+		// scaling accruals.
+		reset, err := tierRepo.ResetTiers(ctx)
+		if err != nil {
+			logger.Fatal("failed to reset loyalty tiers", zap.Error(err))
+		}
+		if reset > 0 {
+			logger.Info("loyalty tiers are disabled, users taken out of their tiers", zap.Int("users", reset))
+		}
+	}
+
+	merchants := make(map[string]types.Validator, len(cfg.Merchants))
+	for id, m := range cfg.Merchants {
+		merchants[id], err = types.NewValidator(m.Scheme, m.Pattern, m.Checksum)
+		if err != nil {
+			logger.Fatal("invalid merchant "+id, zap.Error(err))
+		}
+	}
+
+	router := server.SetupRouter(logger, userRepo, orderRepo, withdrawalRepo, server.Config{
+		Validators:          types.NewValidators(nil, merchants),
+		PointsTTL:           cfg.Points.TTL,
+		PointsWarningWindow: cfg.Points.WarningWindow,
+		Tiers:               tierRepo,
+		TierLevels:          tiers,
+		TransferDailyLimit:  cfg.Transfers.DailyLimit,
+		AdminToken:          cfg.Admin.Token,
+		Accrual:             registrar,
+		Events:              hub,
+		Publisher:           publisher,
+		Webhooks:            webhookRepo,
+	})
+
+	srv := &http.Server{
+		Addr:         cfg.RunAddress,
+		Handler:      router,
+		ReadTimeout:  cfg.HTTP.ReadTimeout,
+		WriteTimeout: cfg.HTTP.WriteTimeout,
+		IdleTimeout:  cfg.HTTP.IdleTimeout,
+	}
 
-	logger.Info("Running server on", zap.String("address", flagRunAddr))
-	err = http.ListenAndServe(flagRunAddr, router)
+	logger.Info("Running server on", zap.String("address", cfg.RunAddress))
+	err = srv.ListenAndServe()
 	if err != http.ErrServerClosed {
 		logger.Fatal("HTTP server ListenAndServe Error", zap.Error(err))
 	}
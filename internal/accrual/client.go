@@ -0,0 +1,123 @@
+// Package accrual talks to the system that calculates loyalty points for
+// orders: either the external accrual service or the in-process Engine.
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/avast/retry-go"
+	"github.com/go-resty/resty/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/gofermart/internal/tracing"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+// Client reports the accrual calculated for an order.
+type Client interface {
+	// GetOrder fails with ErrNotRegistered when the accrual system does not
+	// know the order and with *RateLimitError when it asks to back off.
+	GetOrder(ctx context.Context, number string) (*types.AccrualResponse, error)
+}
+
+// Registrar accepts orders for calculation. Only the in-process Engine
+// implements it; the external service learns about orders on its own.
+type Registrar interface {
+	RegisterOrder(ctx context.Context, number string, goods []types.Good) error
+}
+
+var ErrNotRegistered = errors.New("order is not registered in the accrual system")
+
+type RateLimitError struct {
+	// RetryAfter is zero when the response did not say how long to wait.
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("accrual system rate limit exceeded, retry after %s", e.RetryAfter)
+}
+
+// HTTPClient queries the external accrual service.
+type HTTPClient struct {
+	logger        *zap.Logger
+	client        *resty.Client
+	addr          string
+	retryAttempts uint
+}
+
+func NewHTTPClient(logger *zap.Logger, client *resty.Client, addr string, retryAttempts uint) *HTTPClient {
+	return &HTTPClient{
+		logger:        logger.Named("AccrualClient"),
+		client:        client,
+		addr:          addr,
+		retryAttempts: retryAttempts,
+	}
+}
+
+func (c *HTTPClient) GetOrder(ctx context.Context, number string) (_ *types.AccrualResponse, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "accrual.GetOrder",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("order.number", number)))
+	defer func() { tracing.End(span, err) }()
+
+	req := c.client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Content-Encoding", "gzip")
+	tracing.Inject(ctx, req.Header)
+
+	res := new(resty.Response)
+	var innerErr error
+	err = c.withRetry(ctx, func() error {
+		res, innerErr = req.Get(fmt.Sprintf("http://%s/api/orders/%s", c.addr, url.PathEscape(number)))
+		return innerErr
+	})
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode()))
+
+	switch res.StatusCode() {
+	case http.StatusOK:
+		var resp types.AccrualResponse
+		if err = json.Unmarshal(res.Body(), &resp); err != nil {
+			return nil, fmt.Errorf("unable decode accrual response: %w", err)
+		}
+		if resp.Accrual < 0 {
+			return nil, fmt.Errorf("negative accrual %v for order %s", resp.Accrual, number)
+		}
+		return &resp, nil
+	case http.StatusNoContent:
+		return nil, ErrNotRegistered
+	case http.StatusTooManyRequests:
+		rateErr := &RateLimitError{}
+		if retryAfter, err := strconv.ParseInt(res.Header().Get("Retry-After"), 10, 64); err == nil && retryAfter > 0 {
+			rateErr.RetryAfter = time.Duration(retryAfter) * time.Second
+		}
+		return nil, rateErr
+	default:
+		return nil, fmt.Errorf("unexpected accrual system response: %s", res.Status())
+	}
+}
+
+// withRetry calls fn up to retryAttempts times while it fails, doubling the
+// delay between attempts from a second on. It gives up once ctx is done.
+func (c *HTTPClient) withRetry(ctx context.Context, fn func() error) error {
+	return retry.Do(fn,
+		retry.Context(ctx),
+		retry.Attempts(c.retryAttempts),
+		retry.Delay(time.Second),
+		retry.DelayType(retry.BackOffDelay),
+		retry.OnRetry(func(n uint, err error) {
+			c.logger.Warn("accrual request failed", zap.Uint("attempt", n+1), zap.Error(err))
+		}))
+}
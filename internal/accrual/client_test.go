@@ -0,0 +1,95 @@
+package accrual
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+func TestHTTPClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.EscapedPath(), "/api/orders/") {
+		case "1":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"order":"1","status":"PROCESSED","accrual":500}`))
+		case "2":
+			w.WriteHeader(http.StatusNoContent)
+		case "3":
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "4":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "7%2F8%3Fx=1":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"order":"7/8?x=1","status":"INVALID"}`))
+		case "6":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"order":"6","status":"PROCESSED","accrual":-10}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	client := NewHTTPClient(zap.NewNop(), resty.New(), strings.TrimPrefix(srv.URL, "http://"), 1)
+	ctx := context.Background()
+
+	resp, err := client.GetOrder(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, types.AccrualResponse{Order: "1", Status: "PROCESSED", Accrual: 500}, *resp)
+
+	_, err = client.GetOrder(ctx, "2")
+	assert.ErrorIs(t, err, ErrNotRegistered)
+
+	var rateErr *RateLimitError
+	_, err = client.GetOrder(ctx, "3")
+	require.ErrorAs(t, err, &rateErr)
+	assert.Equal(t, time.Minute, rateErr.RetryAfter)
+
+	_, err = client.GetOrder(ctx, "4")
+	require.ErrorAs(t, err, &rateErr)
+	assert.Zero(t, rateErr.RetryAfter)
+
+	_, err = client.GetOrder(ctx, "5")
+	assert.Error(t, err)
+
+	// Numbers of merchant schemes may hold characters special in URLs.
+	resp, err = client.GetOrder(ctx, "7/8?x=1")
+	require.NoError(t, err)
+	assert.Equal(t, "INVALID", resp.Status)
+
+	_, err = client.GetOrder(ctx, "6")
+	assert.ErrorContains(t, err, "negative accrual")
+}
+
+func TestHTTPClientRetry(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	srv.Close()
+
+	core, logs := observer.New(zap.WarnLevel)
+	client := NewHTTPClient(zap.New(core), resty.New(), addr, 5)
+
+	// The delay before the second attempt outlasts the context.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.GetOrder(ctx, "12345678903")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+
+	entries := logs.FilterMessage("accrual request failed").All()
+	require.Len(t, entries, 1)
+	assert.EqualValues(t, 1, entries[0].ContextMap()["attempt"])
+}
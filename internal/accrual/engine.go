@@ -0,0 +1,118 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/tracing"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+// Engine calculates accruals in process from registered reward rules, so
+// that the external accrual service is not needed. An order is calculated
+// on the first request at least Delay after its registration, with the
+// rules known at that time.
+type Engine struct {
+	store store.Accrual
+	delay time.Duration
+	now   func() time.Time
+}
+
+var _ Client = (*Engine)(nil)
+var _ Registrar = (*Engine)(nil)
+
+func NewEngine(s store.Accrual, delay time.Duration) *Engine {
+	return &Engine{
+		store: s,
+		delay: delay,
+		now:   time.Now,
+	}
+}
+
+// RegisterReward adds a rule. It fails with ErrInvalidReward for a malformed
+// rule and with ErrAlreadyExists when the match is taken.
+func (e *Engine) RegisterReward(ctx context.Context, reward types.Reward) error {
+	if err := reward.Validate(); err != nil {
+		return err
+	}
+	return e.store.CreateReward(ctx, reward)
+}
+
+// SaveReward adds a rule or replaces the values of the rule with the same
+// match, and reports whether anything changed. Orders calculated before keep
+// their accruals.
+func (e *Engine) SaveReward(ctx context.Context, reward types.Reward) (bool, error) {
+	if err := reward.Validate(); err != nil {
+		return false, err
+	}
+	return e.store.SaveReward(ctx, reward)
+}
+
+// RegisterOrder accepts an order for calculation. It fails with
+// ErrAlreadyExists when the number was registered before.
+func (e *Engine) RegisterOrder(ctx context.Context, number string, goods []types.Good) error {
+	for _, g := range goods {
+		if g.Price < 0 {
+			return fmt.Errorf("%w: negative price of %q", types.ErrInvalidOrder, g.Description)
+		}
+	}
+	return e.store.RegisterOrder(ctx, number, goods)
+}
+
+func (e *Engine) GetOrder(ctx context.Context, number string) (_ *types.AccrualResponse, err error) {
+	ctx, span := tracing.Start(ctx, "accrual.Engine.GetOrder")
+	defer func() { tracing.End(span, err) }()
+
+	order, err := e.store.GetAccrualOrder(ctx, number)
+	if errors.Is(err, types.ErrNotFound) {
+		return nil, ErrNotRegistered
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if order.Status == types.Registered && !e.now().Before(order.RegisteredAt.Add(e.delay)) {
+		rewards, err := e.store.GetRewards(ctx)
+		if err != nil {
+			return nil, err
+		}
+		order.Status, order.Accrual = types.Processed, Calculate(rewards, order.Goods)
+		if err = e.store.SetAccrual(ctx, number, order.Status, order.Accrual); err != nil {
+			return nil, err
+		}
+	}
+
+	return &types.AccrualResponse{
+		Order:   order.Number,
+		Status:  string(order.Status),
+		Accrual: order.Accrual,
+	}, nil
+}
+
+// Calculate sums the rewards for goods. Each good earns by the first rule,
+// in registration order, whose match is contained in its description;
+// matching ignores case. The result is rounded to hundredths.
+func Calculate(rewards []types.Reward, goods []types.Good) float64 {
+	var sum float64
+	for _, g := range goods {
+		description := strings.ToLower(g.Description)
+		for _, r := range rewards {
+			if !strings.Contains(description, strings.ToLower(r.Match)) {
+				continue
+			}
+			switch r.RewardType {
+			case types.RewardPercent:
+				sum += g.Price * r.Reward / 100
+			case types.RewardPoints:
+				sum += r.Reward
+			}
+			break
+		}
+	}
+	return math.Round(sum*100) / 100
+}
@@ -0,0 +1,84 @@
+package accrual
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/shevchukeugeni/gofermart/internal/store/memory"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+func TestCalculate(t *testing.T) {
+	rewards := []types.Reward{
+		{Match: "Bork", Reward: 10, RewardType: types.RewardPercent},
+		{Match: "LG", Reward: 50, RewardType: types.RewardPoints},
+		{Match: "Чайник", Reward: 5, RewardType: types.RewardPercent},
+	}
+
+	tests := []struct {
+		name  string
+		goods []types.Good
+		want  float64
+	}{
+		{"no goods", nil, 0},
+		{"no match", []types.Good{{Description: "Samsung TV", Price: 1000}}, 0},
+		{"percent", []types.Good{{Description: "Чайник Bork", Price: 7000}}, 700},
+		{"points", []types.Good{{Description: "Холодильник LG", Price: 50000}}, 50},
+		{"case insensitive", []types.Good{{Description: "BORK kettle", Price: 100}}, 10},
+		{"first rule wins", []types.Good{{Description: "Чайник LG", Price: 1000}}, 50},
+		{"sum of goods", []types.Good{
+			{Description: "Чайник Bork", Price: 7000},
+			{Description: "Чайник Tefal", Price: 2000},
+			{Description: "Утюг", Price: 3000},
+		}, 800},
+		{"rounded", []types.Good{{Description: "Bork", Price: 0.333}}, 0.03},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.InDelta(t, tt.want, Calculate(rewards, tt.goods), 1e-9)
+		})
+	}
+}
+
+func TestEngine(t *testing.T) {
+	ctx := context.Background()
+	engine := NewEngine(memory.NewAccrualRepository(memory.New()), time.Minute)
+	now := time.Now()
+	engine.now = func() time.Time { return now }
+
+	assert.ErrorIs(t, engine.RegisterReward(ctx, types.Reward{Match: "Bork", Reward: 10, RewardType: "x"}), types.ErrInvalidReward)
+	assert.ErrorIs(t, engine.RegisterReward(ctx, types.Reward{Match: "Bork", Reward: 110, RewardType: types.RewardPercent}), types.ErrInvalidReward)
+	require.NoError(t, engine.RegisterReward(ctx, types.Reward{Match: "Bork", Reward: 10, RewardType: types.RewardPercent}))
+	assert.ErrorIs(t, engine.RegisterReward(ctx, types.Reward{Match: "Bork", Reward: 5, RewardType: types.RewardPoints}), types.ErrAlreadyExists)
+	_, err := engine.SaveReward(ctx, types.Reward{Match: "Bork", Reward: 0, RewardType: types.RewardPoints})
+	assert.ErrorIs(t, err, types.ErrInvalidReward)
+
+	_, err = engine.GetOrder(ctx, "12345678903")
+	assert.ErrorIs(t, err, ErrNotRegistered)
+
+	assert.ErrorIs(t, engine.RegisterOrder(ctx, "12345678903", []types.Good{{Description: "Bork", Price: -1}}), types.ErrInvalidOrder)
+	require.NoError(t, engine.RegisterOrder(ctx, "12345678903", []types.Good{{Description: "Чайник Bork", Price: 7000}}))
+	assert.ErrorIs(t, engine.RegisterOrder(ctx, "12345678903", nil), types.ErrAlreadyExists)
+
+	resp, err := engine.GetOrder(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, types.AccrualResponse{Order: "12345678903", Status: string(types.Registered)}, *resp)
+
+	// Rules registered while the order waits apply to it.
+	require.NoError(t, engine.RegisterReward(ctx, types.Reward{Match: "Чайник", Reward: 100, RewardType: types.RewardPoints}))
+
+	now = now.Add(2 * time.Minute)
+	resp, err = engine.GetOrder(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, types.AccrualResponse{Order: "12345678903", Status: string(types.Processed), Accrual: 700}, *resp)
+
+	// The result is final.
+	require.NoError(t, engine.RegisterReward(ctx, types.Reward{Match: "7000", Reward: 1, RewardType: types.RewardPoints}))
+	resp, err = engine.GetOrder(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.InDelta(t, 700, resp.Accrual, 1e-9)
+}
@@ -0,0 +1,165 @@
+package accrual
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/gofermart/internal/logging"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+type ServerConfig struct {
+	// RateLimit caps order status requests per minute; zero means no limit.
+	RateLimit int
+}
+
+type server struct {
+	logger  *zap.Logger
+	engine  *Engine
+	limiter *limiter
+}
+
+// NewHandler serves the accrual service API described in SPECIFICATION.md
+// on top of engine.
+func NewHandler(logger *zap.Logger, engine *Engine, cfg ServerConfig) http.Handler {
+	s := &server{
+		logger: logger,
+		engine: engine,
+	}
+	if cfg.RateLimit > 0 {
+		s.limiter = &limiter{limit: cfg.RateLimit, now: time.Now}
+	}
+
+	rtr := chi.NewRouter()
+	rtr.Use(middleware.RequestID)
+	rtr.Use(logging.Middleware(logger))
+	rtr.Post("/api/orders", s.registerOrder)
+	rtr.Post("/api/goods", s.registerReward)
+	rtr.Get("/api/orders/{number}", s.getOrder)
+	return rtr
+}
+
+func (s *server) internalError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	logging.FromContext(r.Context()).Error(msg, zap.Error(err))
+	http.Error(w, msg+": "+err.Error(), http.StatusInternalServerError)
+}
+
+func (s *server) registerOrder(w http.ResponseWriter, r *http.Request) {
+	var req types.AccrualOrderRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Unable to decode json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = types.ValidateOrder(req.Order); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.engine.RegisterOrder(r.Context(), req.Order, req.Goods)
+	switch {
+	case errors.Is(err, types.ErrInvalidOrder):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, types.ErrAlreadyExists):
+		http.Error(w, "Order already registered", http.StatusConflict)
+	case err == nil:
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		s.internalError(w, r, "Unable to register order", err)
+	}
+}
+
+func (s *server) registerReward(w http.ResponseWriter, r *http.Request) {
+	var req types.Reward
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Unable to decode json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.engine.RegisterReward(r.Context(), req)
+	switch {
+	case errors.Is(err, types.ErrInvalidReward):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, types.ErrAlreadyExists):
+		http.Error(w, "Reward already registered", http.StatusConflict)
+	case err == nil:
+		w.WriteHeader(http.StatusOK)
+	default:
+		s.internalError(w, r, "Unable to register reward", err)
+	}
+}
+
+func (s *server) getOrder(w http.ResponseWriter, r *http.Request) {
+	if s.limiter != nil {
+		if wait := s.limiter.allow(); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			http.Error(w, fmt.Sprintf("No more than %d requests per minute allowed", s.limiter.limit), http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	// chi matches the escaped path, see HTTPClient.GetOrder.
+	number, err := url.PathUnescape(chi.URLParam(r, "number"))
+	if err != nil {
+		http.Error(w, "Incorrect order number", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := s.engine.GetOrder(r.Context(), number)
+	if errors.Is(err, ErrNotRegistered) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, "Unable to get order", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		s.internalError(w, r, "Can't marshal data", err)
+		return
+	}
+}
+
+// limiter admits limit requests per calendar minute.
+type limiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Time
+	count  int
+	now    func() time.Time
+}
+
+// allow counts a request and returns zero if it is admitted, or how long
+// until the next window otherwise.
+func (l *limiter) allow() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if window := now.Truncate(time.Minute); !window.Equal(l.window) {
+		l.window, l.count = window, 0
+	}
+	if l.count >= l.limit {
+		return l.window.Add(time.Minute).Sub(now)
+	}
+	l.count++
+	return 0
+}
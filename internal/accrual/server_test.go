@@ -0,0 +1,103 @@
+package accrual
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/gofermart/internal/store/memory"
+)
+
+func do(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestHandler(t *testing.T) {
+	h := NewHandler(zap.NewNop(), NewEngine(memory.NewAccrualRepository(memory.New()), 0), ServerConfig{})
+
+	rewards := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"malformed json", `{"match":`, http.StatusBadRequest},
+		{"unknown type", `{"match":"Bork","reward":10,"reward_type":"x"}`, http.StatusBadRequest},
+		{"registered", `{"match":"Bork","reward":10,"reward_type":"%"}`, http.StatusOK},
+		{"duplicate", `{"match":"Bork","reward":5,"reward_type":"pt"}`, http.StatusConflict},
+	}
+	for _, tt := range rewards {
+		t.Run("goods "+tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, do(h, http.MethodPost, "/api/goods", tt.body).Code)
+		})
+	}
+
+	orders := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"malformed json", `{"order":`, http.StatusBadRequest},
+		{"bad number", `{"order":"12345678900","goods":[]}`, http.StatusBadRequest},
+		{"negative price", `{"order":"12345678903","goods":[{"description":"Bork","price":-1}]}`, http.StatusBadRequest},
+		{"registered", `{"order":"12345678903","goods":[{"description":"Чайник Bork","price":7000}]}`, http.StatusAccepted},
+		{"without reward", `{"order":"9278923470","goods":[{"description":"Утюг","price":3000}]}`, http.StatusAccepted},
+		{"duplicate", `{"order":"12345678903","goods":[]}`, http.StatusConflict},
+	}
+	for _, tt := range orders {
+		t.Run("orders "+tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, do(h, http.MethodPost, "/api/orders", tt.body).Code)
+		})
+	}
+
+	w := do(h, http.MethodGet, "/api/orders/12345678903", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"order":"12345678903","status":"PROCESSED","accrual":700}`, w.Body.String())
+
+	// Without an accrual the field is left out.
+	w = do(h, http.MethodGet, "/api/orders/9278923470", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"order":"9278923470","status":"PROCESSED"}`, w.Body.String())
+
+	w = do(h, http.MethodGet, "/api/orders/346436439", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 15, 0, time.UTC)
+	l := &limiter{limit: 2, now: func() time.Time { return now }}
+
+	assert.Zero(t, l.allow())
+	assert.Zero(t, l.allow())
+	assert.Equal(t, 45*time.Second, l.allow())
+
+	now = now.Add(45 * time.Second)
+	assert.Zero(t, l.allow())
+}
+
+func TestHandlerRateLimit(t *testing.T) {
+	h := NewHandler(zap.NewNop(), NewEngine(memory.NewAccrualRepository(memory.New()), 0), ServerConfig{RateLimit: 2})
+
+	assert.Equal(t, http.StatusNoContent, do(h, http.MethodGet, "/api/orders/12345678903", "").Code)
+	assert.Equal(t, http.StatusNoContent, do(h, http.MethodGet, "/api/orders/12345678903", "").Code)
+
+	w := do(h, http.MethodGet, "/api/orders/12345678903", "")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "No more than 2 requests per minute allowed\n", w.Body.String())
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.True(t, retryAfter >= 1 && retryAfter <= 60, retryAfter)
+
+	// Registration is not limited.
+	assert.Equal(t, http.StatusAccepted, do(h, http.MethodPost, "/api/orders", `{"order":"12345678903","goods":[]}`).Code)
+}
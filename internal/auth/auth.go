@@ -11,10 +11,16 @@ import (
 
 var TokenAuth *jwtauth.JWTAuth
 
-const Secret = "secret-gofermart"
+var tokenTTL = time.Hour
 
 func init() {
-	TokenAuth = jwtauth.New("HS256", []byte(Secret), nil)
+	Setup("secret-gofermart", time.Hour)
+}
+
+// Setup replaces the signing secret and lifetime of issued tokens.
+func Setup(secret string, ttl time.Duration) {
+	TokenAuth = jwtauth.New("HS256", []byte(secret), nil)
+	tokenTTL = ttl
 }
 
 func GetUserID(r *http.Request) (string, error) {
@@ -32,7 +38,7 @@ func GetUserID(r *http.Request) (string, error) {
 }
 
 func GenerateToken(userID string) (string, error) {
-	_, tokenString, err := TokenAuth.Encode(map[string]interface{}{"user_id": userID, "exp": time.Now().Unix() + int64(time.Hour)})
+	_, tokenString, err := TokenAuth.Encode(map[string]interface{}{"user_id": userID, "exp": time.Now().Add(tokenTTL).Unix()})
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,528 @@
+// Package config loads gophermart settings.
+//
+// Values are resolved in the following order, each step overriding the
+// previous one:
+//
+//  1. built-in defaults;
+//  2. the config file given by -c or CONFIG (YAML or JSON);
+//  3. environment variables;
+//  4. command line flags.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+
+	"github.com/shevchukeugeni/gofermart/internal/logging"
+	"github.com/shevchukeugeni/gofermart/internal/sink"
+	"github.com/shevchukeugeni/gofermart/internal/tracing"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+const redacted = "REDACTED"
+
+const (
+	StoragePostgres = "postgres"
+	StorageMemory   = "memory"
+)
+
+// DefaultJWTSecret is only meant for local runs and autotests.
+const DefaultJWTSecret = "secret-gofermart"
+
+type Config struct {
+	RunAddress           string `yaml:"run_address"`
+	DatabaseURI          string `yaml:"database_uri"`
+	AccrualSystemAddress string `yaml:"accrual_system_address"`
+	// Storage selects the backend; memory keeps data in process and is meant
+	// for demos only.
+	Storage string `yaml:"storage"`
+
+	HTTP      HTTP      `yaml:"http"`
+	Database  Database  `yaml:"database"`
+	Auth      Auth      `yaml:"auth"`
+	Admin     Admin     `yaml:"admin"`
+	Orders    Orders    `yaml:"orders"`
+	Points    Points    `yaml:"points"`
+	Tiers     Tiers     `yaml:"tiers"`
+	Transfers Transfers `yaml:"transfers"`
+	Worker    Worker    `yaml:"worker"`
+	Accrual   Accrual   `yaml:"accrual"`
+	Webhooks  Webhooks  `yaml:"webhooks"`
+	Outbox    Outbox    `yaml:"outbox"`
+	Log       Log       `yaml:"log"`
+	Tracing   Tracing   `yaml:"tracing"`
+
+	// Merchants maps the merchant identifier sent with order uploads to the
+	// validation scheme of its receipt numbers. It can only be set in the
+	// config file.
+	Merchants map[string]Merchant `yaml:"merchants,omitempty"`
+}
+
+type HTTP struct {
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+}
+
+type Database struct {
+	MaxConns        int           `yaml:"max_conns"`
+	MinConns        int           `yaml:"min_conns"`
+	MaxConnLifetime time.Duration `yaml:"max_conn_lifetime"`
+	MaxConnIdleTime time.Duration `yaml:"max_conn_idle_time"`
+}
+
+type Auth struct {
+	JWTSecret string        `yaml:"jwt_secret"`
+	TokenTTL  time.Duration `yaml:"token_ttl"`
+}
+
+// Admin protects the support endpoints under /api/admin; they are disabled
+// while Token is empty.
+type Admin struct {
+	Token string `yaml:"token"`
+}
+
+// Orders limits the length of uploaded order numbers; a zero MaxLength means
+// no upper limit.
+type Orders struct {
+	MinLength int `yaml:"min_length"`
+	MaxLength int `yaml:"max_length"`
+}
+
+// Points configures expiration of accrued points. A zero TTL keeps points
+// forever.
+type Points struct {
+	TTL time.Duration `yaml:"ttl"`
+	// ExpiryInterval is how often expired points are written off.
+	ExpiryInterval time.Duration `yaml:"expiry_interval"`
+	// WarningWindow is how far ahead the balance reports expiring points.
+	WarningWindow time.Duration `yaml:"warning_window"`
+}
+
+// Tiers configures loyalty tiers. They are disabled while Levels is empty;
+// levels can only be set in the config file, for example:
+//
+//	tiers:
+//	  basis: earned
+//	  window: 2160h
+//	  levels:
+//	    - {name: bronze, threshold: 0, multiplier: 1}
+//	    - {name: silver, threshold: 1000, multiplier: 1.1}
+//	    - {name: gold, threshold: 5000, multiplier: 1.25}
+type Tiers struct {
+	// Basis is what moves users between tiers: points "earned" or "spent"
+	// within the rolling Window.
+	Basis          string        `yaml:"basis"`
+	Window         time.Duration `yaml:"window"`
+	RecalcInterval time.Duration `yaml:"recalc_interval"`
+	Levels         []TierLevel   `yaml:"levels,omitempty"`
+}
+
+// TierLevel is reached once the activity within the window is at least
+// Threshold; accruals are multiplied by Multiplier.
+type TierLevel struct {
+	Name       string  `yaml:"name"`
+	Threshold  float64 `yaml:"threshold"`
+	Multiplier float64 `yaml:"multiplier"`
+}
+
+type Transfers struct {
+	// DailyLimit caps the points a user may send to others per UTC day;
+	// zero means no limit.
+	DailyLimit float64 `yaml:"daily_limit"`
+}
+
+// Merchant describes how order numbers of a merchant are validated, see
+// types.NewValidator.
+type Merchant struct {
+	Scheme   string `yaml:"scheme"`
+	Pattern  string `yaml:"pattern,omitempty"`
+	Checksum string `yaml:"checksum,omitempty"`
+}
+
+type Worker struct {
+	PollInterval   time.Duration `yaml:"poll_interval"`
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	RetryAttempts  int           `yaml:"retry_attempts"`
+}
+
+// Accrual configures the in-process accrual engine, which replaces the
+// external service at AccrualSystemAddress when Engine is set. Rewards can
+// only be set in the config file, for example:
+//
+//	accrual:
+//	  engine: true
+//	  delay: 10s
+//	  rewards:
+//	    - {match: Bork, reward: 10, reward_type: "%"}
+//	    - {match: Samsung, reward: 50, reward_type: pt}
+type Accrual struct {
+	Engine bool `yaml:"engine"`
+	// Delay is how long a registered order waits before it is calculated.
+	Delay time.Duration `yaml:"delay"`
+	// Rewards are registered on start, replacing the values of rules with
+	// the same match registered before.
+	Rewards []Reward `yaml:"rewards,omitempty"`
+}
+
+// Webhooks configures delivery of merchant webhooks. A failed delivery is
+// retried after Backoff, doubling for every next attempt, and parked as dead
+// after MaxAttempts.
+type Webhooks struct {
+	Interval    time.Duration `yaml:"interval"`
+	MaxAttempts int           `yaml:"max_attempts"`
+	Backoff     time.Duration `yaml:"backoff"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// Outbox configures publishing of domain events to downstream systems. Sink
+// is one of none, stdout, file or kafka-rest; with none the events wait in
+// the outbox until a sink is configured. kafka-rest produces through a
+// Confluent REST proxy, not to the Kafka brokers. Published events are kept
+// for Retention. MaxPending caps the unpublished events, zero meaning no
+// cap: with the none sink the oldest ones beyond it are dropped, with any
+// other sink exceeding it is only logged, as the sink still owes them
+// downstream.
+type Outbox struct {
+	Sink string `yaml:"sink"`
+	// Path is the file of the file sink.
+	Path string `yaml:"path"`
+	// URL is the Confluent REST proxy of the kafka-rest sink.
+	URL string `yaml:"url"`
+	// Topic is the Kafka topic of the kafka-rest sink.
+	Topic     string        `yaml:"topic"`
+	Interval  time.Duration `yaml:"interval"`
+	BatchSize int           `yaml:"batch_size"`
+	Timeout   time.Duration `yaml:"timeout"`
+	// PruneInterval is how often the outbox is pruned.
+	PruneInterval time.Duration `yaml:"prune_interval"`
+	Retention     time.Duration `yaml:"retention"`
+	MaxPending    int           `yaml:"max_pending"`
+}
+
+type Reward struct {
+	Match      string  `yaml:"match"`
+	Reward     float64 `yaml:"reward"`
+	RewardType string  `yaml:"reward_type"`
+}
+
+type Log struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+type Tracing struct {
+	Exporter string `yaml:"exporter"`
+	Endpoint string `yaml:"endpoint"`
+	Insecure bool   `yaml:"insecure"`
+}
+
+func Default() *Config {
+	return &Config{
+		RunAddress: "localhost:8080",
+		Storage:    StoragePostgres,
+		HTTP: HTTP{
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+			IdleTimeout:  time.Minute,
+		},
+		Database: Database{
+			MaxConns:        20,
+			MinConns:        2,
+			MaxConnLifetime: time.Hour,
+			MaxConnIdleTime: 10 * time.Minute,
+		},
+		Auth: Auth{
+			JWTSecret: DefaultJWTSecret,
+			TokenTTL:  time.Hour,
+		},
+		Orders: Orders{
+			MinLength: 1,
+		},
+		Points: Points{
+			ExpiryInterval: time.Hour,
+			WarningWindow:  30 * 24 * time.Hour,
+		},
+		Tiers: Tiers{
+			Basis:          types.TierBasisEarned,
+			Window:         90 * 24 * time.Hour,
+			RecalcInterval: time.Hour,
+		},
+		Worker: Worker{
+			PollInterval:   10 * time.Second,
+			RequestTimeout: 5 * time.Second,
+			RetryAttempts:  3,
+		},
+		Webhooks: Webhooks{
+			Interval:    5 * time.Second,
+			MaxAttempts: 10,
+			Backoff:     30 * time.Second,
+			Timeout:     10 * time.Second,
+		},
+		Outbox: Outbox{
+			Sink:          sink.KindNone,
+			Topic:         "gophermart.events",
+			Interval:      time.Second,
+			BatchSize:     100,
+			Timeout:       10 * time.Second,
+			PruneInterval: time.Hour,
+			Retention:     7 * 24 * time.Hour,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: logging.FormatJSON,
+		},
+		Tracing: Tracing{
+			Exporter: tracing.ExporterNone,
+			Insecure: true,
+		},
+	}
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(c.RunAddress); err != nil {
+		errs = append(errs, fmt.Errorf("run_address: %w", err))
+	}
+	switch c.Storage {
+	case StoragePostgres:
+		if c.DatabaseURI == "" {
+			errs = append(errs, errors.New("database_uri: must be set for postgres storage"))
+		}
+	case StorageMemory:
+	default:
+		errs = append(errs, fmt.Errorf("storage: unknown backend %q", c.Storage))
+	}
+	if c.AccrualSystemAddress == "" && !c.Accrual.Engine {
+		errs = append(errs, errors.New("accrual_system_address: must be set unless accrual.engine is enabled"))
+	}
+	if c.Accrual.Delay < 0 {
+		errs = append(errs, errors.New("accrual.delay: must not be negative"))
+	}
+	for i, r := range c.Accrual.RewardRules() {
+		if err := r.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("accrual.rewards[%d]: %w", i, err))
+		}
+	}
+
+	if c.HTTP.ReadTimeout < 0 || c.HTTP.WriteTimeout < 0 || c.HTTP.IdleTimeout < 0 {
+		errs = append(errs, errors.New("http: timeouts must not be negative"))
+	}
+
+	if c.Database.MaxConns < 1 || c.Database.MinConns < 0 {
+		errs = append(errs, errors.New("database: max_conns must be positive and min_conns not negative"))
+	}
+	if c.Database.MinConns > c.Database.MaxConns {
+		errs = append(errs, errors.New("database: min_conns must not exceed max_conns"))
+	}
+	if c.Database.MaxConnLifetime < 0 || c.Database.MaxConnIdleTime < 0 {
+		errs = append(errs, errors.New("database: connection lifetimes must not be negative"))
+	}
+
+	if c.Auth.JWTSecret == "" {
+		errs = append(errs, errors.New("auth.jwt_secret: must be set"))
+	}
+	if c.Auth.TokenTTL <= 0 {
+		errs = append(errs, errors.New("auth.token_ttl: must be positive"))
+	}
+
+	if c.Orders.MinLength < 1 {
+		errs = append(errs, errors.New("orders.min_length: must be at least 1"))
+	}
+	if c.Orders.MaxLength < 0 || c.Orders.MaxLength > 0 && c.Orders.MaxLength < c.Orders.MinLength {
+		errs = append(errs, errors.New("orders.max_length: must be 0 (no limit) or not less than min_length"))
+	}
+
+	if c.Points.TTL < 0 {
+		errs = append(errs, errors.New("points.ttl: must not be negative"))
+	}
+	if c.Points.ExpiryInterval <= 0 {
+		errs = append(errs, errors.New("points.expiry_interval: must be positive"))
+	}
+	if c.Points.WarningWindow < 0 {
+		errs = append(errs, errors.New("points.warning_window: must not be negative"))
+	}
+
+	if c.Transfers.DailyLimit < 0 {
+		errs = append(errs, errors.New("transfers.daily_limit: must not be negative"))
+	}
+
+	if err := c.Tiers.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("tiers: %w", err))
+	}
+
+	for id, m := range c.Merchants {
+		if _, err := types.NewValidator(m.Scheme, m.Pattern, m.Checksum); err != nil {
+			errs = append(errs, fmt.Errorf("merchants.%s: %w", id, err))
+		}
+	}
+
+	if c.Worker.PollInterval <= 0 {
+		errs = append(errs, errors.New("worker.poll_interval: must be positive"))
+	}
+	if c.Worker.RequestTimeout <= 0 {
+		errs = append(errs, errors.New("worker.request_timeout: must be positive"))
+	}
+	if c.Worker.RetryAttempts < 1 {
+		errs = append(errs, errors.New("worker.retry_attempts: must be at least 1"))
+	}
+
+	if c.Webhooks.Interval <= 0 || c.Webhooks.Backoff <= 0 || c.Webhooks.Timeout <= 0 {
+		errs = append(errs, errors.New("webhooks: interval, backoff and timeout must be positive"))
+	}
+	if c.Webhooks.MaxAttempts < 1 {
+		errs = append(errs, errors.New("webhooks.max_attempts: must be at least 1"))
+	}
+
+	if err := c.Outbox.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("outbox: %w", err))
+	}
+
+	if _, err := zapcore.ParseLevel(c.Log.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	switch c.Log.Format {
+	case logging.FormatJSON, logging.FormatConsole:
+	default:
+		errs = append(errs, fmt.Errorf("log.format: unknown format %q", c.Log.Format))
+	}
+
+	switch c.Tracing.Exporter {
+	case tracing.ExporterNone, tracing.ExporterStdout, tracing.ExporterOTLP:
+	default:
+		errs = append(errs, fmt.Errorf("tracing.exporter: unknown exporter %q", c.Tracing.Exporter))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (t *Tiers) validate() error {
+	var errs []error
+
+	switch t.Basis {
+	case types.TierBasisEarned, types.TierBasisSpent:
+	default:
+		errs = append(errs, fmt.Errorf("unknown basis %q", t.Basis))
+	}
+	if t.Window <= 0 || t.RecalcInterval <= 0 {
+		errs = append(errs, errors.New("window and recalc_interval must be positive"))
+	}
+
+	names := map[string]bool{}
+	for i, l := range t.Levels {
+		if l.Name == "" || names[l.Name] {
+			errs = append(errs, fmt.Errorf("levels[%d]: name must be set and unique", i))
+		}
+		names[l.Name] = true
+		if l.Multiplier <= 0 {
+			errs = append(errs, fmt.Errorf("levels[%d]: multiplier must be positive", i))
+		}
+		switch {
+		case i == 0 && l.Threshold != 0:
+			errs = append(errs, errors.New("levels[0]: threshold must be 0"))
+		case i > 0 && l.Threshold <= t.Levels[i-1].Threshold:
+			errs = append(errs, fmt.Errorf("levels[%d]: thresholds must increase", i))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (o *Outbox) validate() error {
+	var errs []error
+
+	switch o.Sink {
+	case sink.KindNone, sink.KindStdout:
+	case sink.KindFile:
+		if o.Path == "" {
+			errs = append(errs, errors.New("path must be set for the file sink"))
+		}
+	case sink.KindKafkaREST:
+		if o.URL == "" || o.Topic == "" {
+			errs = append(errs, fmt.Errorf("url and topic must be set for the %s sink", o.Sink))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown sink %q", o.Sink))
+	}
+	if o.Interval <= 0 || o.Timeout <= 0 {
+		errs = append(errs, errors.New("interval and timeout must be positive"))
+	}
+	if o.BatchSize < 1 {
+		errs = append(errs, errors.New("batch_size must be at least 1"))
+	}
+	if o.PruneInterval <= 0 || o.Retention <= 0 {
+		errs = append(errs, errors.New("prune_interval and retention must be positive"))
+	}
+	if o.MaxPending < 0 {
+		errs = append(errs, errors.New("max_pending must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// TierLevels converts the configured levels.
+func (t *Tiers) TierLevels() []types.Tier {
+	ret := make([]types.Tier, 0, len(t.Levels))
+	for _, l := range t.Levels {
+		ret = append(ret, types.Tier{Name: l.Name, Threshold: l.Threshold, Multiplier: l.Multiplier})
+	}
+	return ret
+}
+
+// RewardRules converts the configured rewards.
+func (a *Accrual) RewardRules() []types.Reward {
+	ret := make([]types.Reward, 0, len(a.Rewards))
+	for _, r := range a.Rewards {
+		ret = append(ret, types.Reward{Match: r.Match, Reward: r.Reward, RewardType: r.RewardType})
+	}
+	return ret
+}
+
+var dsnPassword = regexp.MustCompile(`(password=)(\S+)`)
+
+// Redacted returns a copy of c that is safe to print.
+func (c Config) Redacted() Config {
+	if c.Auth.JWTSecret != "" {
+		c.Auth.JWTSecret = redacted
+	}
+	if c.Admin.Token != "" {
+		c.Admin.Token = redacted
+	}
+	c.DatabaseURI = redactURI(c.DatabaseURI)
+	c.Outbox.URL = redactURI(c.Outbox.URL)
+	return c
+}
+
+func (c Config) String() string {
+	out, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
+
+func redactURI(uri string) string {
+	if uri == "" {
+		return uri
+	}
+	if u, err := url.Parse(uri); err == nil && u.Scheme != "" {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+		q := u.Query()
+		if q.Has("password") {
+			q.Set("password", redacted)
+			u.RawQuery = q.Encode()
+		}
+		return u.String()
+	}
+	return dsnPassword.ReplaceAllString(uri, "${1}"+redacted)
+}
@@ -0,0 +1,238 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// setting describes a single option that can be set from env and flags.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	field func(c *Config) interface{}
+}
+
+var settings = []setting{
+	{"a", "RUN_ADDRESS", "address and port to run server", func(c *Config) interface{} { return &c.RunAddress }},
+	{"d", "DATABASE_URI", "database connection uri", func(c *Config) interface{} { return &c.DatabaseURI }},
+	{"r", "ACCRUAL_SYSTEM_ADDRESS", "accrual system address", func(c *Config) interface{} { return &c.AccrualSystemAddress }},
+	{"storage", "STORAGE", "storage backend: postgres or memory", func(c *Config) interface{} { return &c.Storage }},
+
+	{"http-read-timeout", "HTTP_READ_TIMEOUT", "HTTP server read timeout", func(c *Config) interface{} { return &c.HTTP.ReadTimeout }},
+	{"http-write-timeout", "HTTP_WRITE_TIMEOUT", "HTTP server write timeout", func(c *Config) interface{} { return &c.HTTP.WriteTimeout }},
+	{"http-idle-timeout", "HTTP_IDLE_TIMEOUT", "HTTP server keep-alive timeout", func(c *Config) interface{} { return &c.HTTP.IdleTimeout }},
+
+	{"db-max-conns", "DB_MAX_CONNS", "maximum size of the database pool", func(c *Config) interface{} { return &c.Database.MaxConns }},
+	{"db-min-conns", "DB_MIN_CONNS", "number of database connections kept open", func(c *Config) interface{} { return &c.Database.MinConns }},
+	{"db-max-conn-lifetime", "DB_MAX_CONN_LIFETIME", "maximum lifetime of a database connection", func(c *Config) interface{} { return &c.Database.MaxConnLifetime }},
+	{"db-max-conn-idle-time", "DB_MAX_CONN_IDLE_TIME", "maximum idle time of a database connection", func(c *Config) interface{} { return &c.Database.MaxConnIdleTime }},
+
+	{"jwt-secret", "JWT_SECRET", "secret used to sign auth tokens", func(c *Config) interface{} { return &c.Auth.JWTSecret }},
+	{"token-ttl", "TOKEN_TTL", "auth token lifetime", func(c *Config) interface{} { return &c.Auth.TokenTTL }},
+	{"admin-token", "ADMIN_TOKEN", "bearer token of the admin endpoints, empty to disable them", func(c *Config) interface{} { return &c.Admin.Token }},
+
+	{"order-min-length", "ORDER_MIN_LENGTH", "minimum number of digits in an order number", func(c *Config) interface{} { return &c.Orders.MinLength }},
+	{"order-max-length", "ORDER_MAX_LENGTH", "maximum number of digits in an order number, 0 for no limit", func(c *Config) interface{} { return &c.Orders.MaxLength }},
+
+	{"points-ttl", "POINTS_TTL", "lifetime of accrued points, 0 to never expire (e.g. 8760h)", func(c *Config) interface{} { return &c.Points.TTL }},
+	{"points-expiry-interval", "POINTS_EXPIRY_INTERVAL", "how often expired points are written off", func(c *Config) interface{} { return &c.Points.ExpiryInterval }},
+	{"points-warning-window", "POINTS_WARNING_WINDOW", "how far ahead the balance reports expiring points", func(c *Config) interface{} { return &c.Points.WarningWindow }},
+
+	{"tier-basis", "TIER_BASIS", "what decides loyalty tiers: earned or spent", func(c *Config) interface{} { return &c.Tiers.Basis }},
+	{"tier-window", "TIER_WINDOW", "rolling window of activity deciding loyalty tiers", func(c *Config) interface{} { return &c.Tiers.Window }},
+	{"tier-recalc-interval", "TIER_RECALC_INTERVAL", "how often loyalty tiers are recalculated", func(c *Config) interface{} { return &c.Tiers.RecalcInterval }},
+
+	{"transfer-daily-limit", "TRANSFER_DAILY_LIMIT", "points a user may transfer per UTC day, 0 for no limit", func(c *Config) interface{} { return &c.Transfers.DailyLimit }},
+
+	{"poll-interval", "POLL_INTERVAL", "accrual system polling interval", func(c *Config) interface{} { return &c.Worker.PollInterval }},
+	{"accrual-timeout", "ACCRUAL_TIMEOUT", "accrual system request timeout", func(c *Config) interface{} { return &c.Worker.RequestTimeout }},
+	{"accrual-retry-attempts", "ACCRUAL_RETRY_ATTEMPTS", "attempts per accrual system request", func(c *Config) interface{} { return &c.Worker.RetryAttempts }},
+	{"accrual-engine", "ACCRUAL_ENGINE", "calculate accruals in process instead of calling the accrual system", func(c *Config) interface{} { return &c.Accrual.Engine }},
+	{"accrual-engine-delay", "ACCRUAL_ENGINE_DELAY", "how long the accrual engine waits before calculating an order", func(c *Config) interface{} { return &c.Accrual.Delay }},
+
+	{"webhook-interval", "WEBHOOK_INTERVAL", "how often queued webhook deliveries are sent", func(c *Config) interface{} { return &c.Webhooks.Interval }},
+	{"webhook-max-attempts", "WEBHOOK_MAX_ATTEMPTS", "attempts before a webhook delivery is parked as dead", func(c *Config) interface{} { return &c.Webhooks.MaxAttempts }},
+	{"webhook-backoff", "WEBHOOK_BACKOFF", "delay before the first webhook retry, doubled for each next one", func(c *Config) interface{} { return &c.Webhooks.Backoff }},
+	{"webhook-timeout", "WEBHOOK_TIMEOUT", "webhook request timeout", func(c *Config) interface{} { return &c.Webhooks.Timeout }},
+
+	{"outbox-sink", "OUTBOX_SINK", "domain event sink: none, stdout, file or kafka-rest", func(c *Config) interface{} { return &c.Outbox.Sink }},
+	{"outbox-path", "OUTBOX_PATH", "file of the file event sink", func(c *Config) interface{} { return &c.Outbox.Path }},
+	{"outbox-url", "OUTBOX_URL", "Confluent REST proxy URL of the kafka-rest event sink", func(c *Config) interface{} { return &c.Outbox.URL }},
+	{"outbox-topic", "OUTBOX_TOPIC", "Kafka topic of domain events", func(c *Config) interface{} { return &c.Outbox.Topic }},
+	{"outbox-interval", "OUTBOX_INTERVAL", "how often recorded domain events are published", func(c *Config) interface{} { return &c.Outbox.Interval }},
+	{"outbox-batch-size", "OUTBOX_BATCH_SIZE", "domain events published at once", func(c *Config) interface{} { return &c.Outbox.BatchSize }},
+	{"outbox-timeout", "OUTBOX_TIMEOUT", "event sink request timeout", func(c *Config) interface{} { return &c.Outbox.Timeout }},
+	{"outbox-prune-interval", "OUTBOX_PRUNE_INTERVAL", "how often the outbox is pruned", func(c *Config) interface{} { return &c.Outbox.PruneInterval }},
+	{"outbox-retention", "OUTBOX_RETENTION", "how long published domain events are kept", func(c *Config) interface{} { return &c.Outbox.Retention }},
+	{"outbox-max-pending", "OUTBOX_MAX_PENDING", "cap of unpublished domain events; beyond it the oldest are dropped with the none sink and reported otherwise; 0 means no cap", func(c *Config) interface{} { return &c.Outbox.MaxPending }},
+
+	{"log-level", "LOG_LEVEL", "log level: debug, info, warn or error", func(c *Config) interface{} { return &c.Log.Level }},
+	{"log-format", "LOG_FORMAT", "log format: json or console", func(c *Config) interface{} { return &c.Log.Format }},
+
+	{"trace-exporter", "TRACE_EXPORTER", "trace exporter: none, stdout or otlp", func(c *Config) interface{} { return &c.Tracing.Exporter }},
+	{"otlp-endpoint", "OTLP_ENDPOINT", "OTLP/HTTP collector endpoint (host:port)", func(c *Config) interface{} { return &c.Tracing.Endpoint }},
+	{"otlp-insecure", "OTLP_INSECURE", "use plain HTTP for the OTLP exporter", func(c *Config) interface{} { return &c.Tracing.Insecure }},
+}
+
+var secretSettings = map[string]bool{"jwt-secret": true, "admin-token": true}
+
+// Options holds flags that control loading itself rather than the service.
+type Options struct {
+	PrintConfig bool
+}
+
+// Load resolves the configuration from defaults, the config file, env and
+// args (without the program name) and validates the result.
+func Load(name string, args []string) (*Config, *Options, error) {
+	cfg := Default()
+	opts := &Options{}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := os.Getenv("CONFIG")
+	fs.StringVar(&configPath, "c", configPath, "path to a YAML or JSON config file (env CONFIG)")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the effective config and exit")
+
+	flagValues := map[string]string{}
+	defaults := Default()
+	for _, s := range settings {
+		s := s
+		def := deref(s.field(defaults))
+		if secretSettings[s.flag] {
+			def = redacted
+		}
+		usage := fmt.Sprintf("%s (env %s, default %v)", s.usage, s.env, def)
+		fs.Var(&rawValue{isBool: isBool(s.field(defaults)), set: func(v string) error {
+			flagValues[s.flag] = v
+			return setValue(s.field(Default()), v)
+		}}, s.flag, usage)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if configPath != "" {
+		if err := loadFile(cfg, configPath); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok && v != "" {
+			if err := setValue(s.field(cfg), v); err != nil {
+				return nil, nil, fmt.Errorf("env %s: %w", s.env, err)
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := flagValues[s.flag]; ok {
+			if err := setValue(s.field(cfg), v); err != nil {
+				return nil, nil, fmt.Errorf("flag -%s: %w", s.flag, err)
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return cfg, opts, nil
+}
+
+// loadFile reads YAML or JSON; JSON is handled by the YAML decoder as well.
+func loadFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+	if err = yaml.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func setValue(field interface{}, v string) error {
+	switch f := field.(type) {
+	case *string:
+		*f = v
+	case *int:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*f = n
+	case *float64:
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return err
+		}
+		*f = n
+	case *bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*f = b
+	case *time.Duration:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*f = d
+	default:
+		return fmt.Errorf("unsupported setting type %T", field)
+	}
+	return nil
+}
+
+func deref(field interface{}) interface{} {
+	switch f := field.(type) {
+	case *string:
+		if *f == "" {
+			return `""`
+		}
+		return *f
+	case *int:
+		return *f
+	case *float64:
+		return *f
+	case *bool:
+		return *f
+	case *time.Duration:
+		return *f
+	}
+	return nil
+}
+
+func isBool(field interface{}) bool {
+	_, ok := field.(*bool)
+	return ok
+}
+
+// rawValue validates a flag value on parse but defers applying it until the
+// config file and env have been processed.
+type rawValue struct {
+	isBool bool
+	set    func(string) error
+	value  string
+}
+
+func (v *rawValue) String() string {
+	return v.value
+}
+
+func (v *rawValue) Set(s string) error {
+	v.value = s
+	return v.set(s)
+}
+
+func (v *rawValue) IsBoolFlag() bool {
+	return v.isBool
+}
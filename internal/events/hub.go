@@ -0,0 +1,78 @@
+// Package events delivers order and balance changes to the event streams of
+// the users they belong to.
+package events
+
+import (
+	"context"
+	"sync"
+
+	"github.com/shevchukeugeni/gofermart/internal/metrics"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+// Publisher announces a change to the subscribers of the event's user.
+type Publisher interface {
+	Publish(ctx context.Context, event types.Event) error
+}
+
+// subscriberBuffer is how many events a stream may fall behind before
+// further events are dropped for it.
+const subscriberBuffer = 16
+
+// Hub fans events out to the streams open on this instance. As a Publisher
+// it delivers only locally; use Notifier to reach other instances.
+type Hub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan types.Event]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[string]map[chan types.Event]struct{})}
+}
+
+// Subscribe opens a stream of the events of userID. The returned function
+// closes it and must be called once the stream is no longer read.
+func (h *Hub) Subscribe(userID string) (<-chan types.Event, func()) {
+	ch := make(chan types.Event, subscriberBuffer)
+
+	h.mu.Lock()
+	if h.subs[userID] == nil {
+		h.subs[userID] = make(map[chan types.Event]struct{})
+	}
+	h.subs[userID][ch] = struct{}{}
+	h.mu.Unlock()
+	metrics.EventSubscribers.Inc()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs[userID], ch)
+			if len(h.subs[userID]) == 0 {
+				delete(h.subs, userID)
+			}
+			h.mu.Unlock()
+			metrics.EventSubscribers.Dec()
+		})
+	}
+}
+
+func (h *Hub) Publish(_ context.Context, event types.Event) error {
+	h.dispatch(event)
+	return nil
+}
+
+// dispatch never blocks: a stream that fell behind misses the event rather
+// than holding up everyone else.
+func (h *Hub) dispatch(event types.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs[event.UserID] {
+		select {
+		case ch <- event:
+		default:
+			metrics.EventsDropped.Inc()
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/gofermart/internal/store/postgres"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+// Channel is the Postgres notification channel events travel on.
+const Channel = "gophermart_events"
+
+// Notifier publishes events with Postgres NOTIFY and hands the notifications
+// received by Listen to the local Hub, so that a change made on one instance
+// reaches the streams open on all of them.
+type Notifier struct {
+	logger *zap.Logger
+	db     *pgxpool.Pool
+	hub    *Hub
+}
+
+func NewNotifier(logger *zap.Logger, db *pgxpool.Pool, hub *Hub) *Notifier {
+	return &Notifier{
+		logger: logger.Named("Notifier"),
+		db:     db,
+		hub:    hub,
+	}
+}
+
+// Publish does not deliver to the local hub directly: the notification comes
+// back through Listen like on every other instance.
+func (n *Notifier) Publish(ctx context.Context, event types.Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = n.db.Exec(ctx, "SELECT pg_notify($1, $2)", Channel, string(payload))
+	return err
+}
+
+// Listen hands the events published on any instance to the local Hub until
+// ctx is done. Events published while it is reconnecting are missed.
+func (n *Notifier) Listen(ctx context.Context) {
+	postgres.Listen(ctx, n.logger, n.db, Channel, func(payload string) {
+		event := types.Event{}
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			n.logger.Error("malformed event notification", zap.Error(err))
+			return
+		}
+		n.hub.dispatch(event)
+	})
+}
@@ -0,0 +1,135 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+type Config struct {
+	Level  string
+	Format string
+}
+
+func New(cfg Config) (*zap.Logger, error) {
+	level := zap.InfoLevel
+	if cfg.Level != "" {
+		var err error
+		level, err = zapcore.ParseLevel(cfg.Level)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var zcfg zap.Config
+	switch cfg.Format {
+	case "", FormatJSON:
+		zcfg = zap.NewProductionConfig()
+		zcfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	case FormatConsole:
+		zcfg = zap.NewDevelopmentConfig()
+	default:
+		return nil, fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+	zcfg.Level = zap.NewAtomicLevelAt(level)
+
+	return zcfg.Build()
+}
+
+type loggerKey struct{}
+
+type requestInfoKey struct{}
+
+// requestInfo is filled in by inner handlers so that the access log written
+// by Middleware can report data that is only known after authentication.
+type requestInfo struct {
+	userID string
+}
+
+func WithContext(ctx context.Context, logger *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the request-scoped logger or a no-op logger.
+func FromContext(ctx context.Context) *zap.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*zap.Logger); ok {
+		return logger
+	}
+	return zap.NewNop()
+}
+
+// SetUserID attaches the authenticated user to the request logger and to the
+// access log entry.
+func SetUserID(r *http.Request, userID string) *http.Request {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.userID = userID
+	}
+	logger := FromContext(r.Context()).With(zap.String("user_id", userID))
+	return r.WithContext(WithContext(r.Context(), logger))
+}
+
+// Middleware writes one access log entry per request and exposes a logger
+// carrying the request ID to handlers. It expects middleware.RequestID to run
+// before it.
+func Middleware(base *zap.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			reqID := middleware.GetReqID(r.Context())
+			if reqID != "" {
+				w.Header().Set(middleware.RequestIDHeader, reqID)
+			}
+
+			info := &requestInfo{}
+			ctx := context.WithValue(r.Context(), requestInfoKey{}, info)
+			ctx = WithContext(ctx, base.With(zap.String("request_id", reqID)))
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			route := ""
+			if rctx := chi.RouteContext(r.Context()); rctx != nil {
+				route = rctx.RoutePattern()
+			}
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			fields := []zap.Field{
+				zap.String("request_id", reqID),
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+				zap.String("route", route),
+				zap.Int("status", status),
+				zap.Duration("latency", time.Since(start)),
+				zap.Int("bytes", ww.BytesWritten()),
+				zap.String("remote_addr", r.RemoteAddr),
+			}
+			if info.userID != "" {
+				fields = append(fields, zap.String("user_id", info.userID))
+			}
+
+			switch {
+			case status >= http.StatusInternalServerError:
+				base.Error("request", fields...)
+			case status >= http.StatusBadRequest:
+				base.Warn("request", fields...)
+			default:
+				base.Info("request", fields...)
+			}
+		})
+	}
+}
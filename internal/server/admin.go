@@ -0,0 +1,74 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth"
+
+	"github.com/shevchukeugeni/gofermart/internal/metrics"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+// adminOnly lets through requests bearing the configured admin token.
+func (ro *router) adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := jwtauth.TokenFromHeader(r)
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(ro.cfg.AdminToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (ro *router) reverseWithdrawal(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Incorrect withdrawal id", http.StatusBadRequest)
+		return
+	}
+
+	var req types.ReversalRequest
+
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Unable to decode json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "Missing reason", http.StatusBadRequest)
+		return
+	}
+
+	wtdrw, err := ro.withdrawalRepo.ReverseWithdrawal(r.Context(), id, req.Reason)
+	switch {
+	case errors.Is(err, types.ErrNotFound):
+		http.Error(w, "Withdrawal not found", http.StatusNotFound)
+		return
+	case errors.Is(err, types.ErrWithdrawalReversed):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		ro.internalError(w, r, "Unable to reverse withdrawal", err)
+		return
+	}
+	metrics.PointsRefunded.Add(wtdrw.Sum)
+	ro.publishBalance(r.Context(), wtdrw.UserID)
+	wtdrw.UserID = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(wtdrw)
+	if err != nil {
+		ro.internalError(w, r, "Can't marshal data", err)
+		return
+	}
+}
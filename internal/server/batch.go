@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/shevchukeugeni/gofermart/internal/auth"
+	"github.com/shevchukeugeni/gofermart/internal/metrics"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+const (
+	// maxBatchOrders bounds the number of order numbers in one batch upload.
+	maxBatchOrders = 1000
+	// maxBatchBody bounds the size of a batch upload body.
+	maxBatchBody = 1 << 20
+)
+
+var errBatchTooLarge = fmt.Errorf("batch exceeds %d orders", maxBatchOrders)
+
+// newOrders registers a batch of order numbers sent either as a JSON array or
+// as newline-separated text. Valid numbers are inserted in one transaction;
+// the response lists the outcome for every number in request order.
+func (ro *router) newOrders(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	merchant, validator, err := ro.orderValidator(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxBatchBody)
+	defer body.Close()
+
+	var numbers []string
+	switch mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType {
+	case "application/json":
+		numbers, err = parseJSONBatch(body)
+	case "text/plain":
+		numbers, err = parseTextBatch(body)
+	default:
+		http.Error(w, "incorrect request format", http.StatusBadRequest)
+		return
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errBatchTooLarge), errors.As(err, &maxBytesErr):
+		http.Error(w, "Batch is too large", http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		http.Error(w, "Unable to read batch: "+err.Error(), http.StatusBadRequest)
+		return
+	case len(numbers) == 0:
+		http.Error(w, "Batch is empty", http.StatusBadRequest)
+		return
+	}
+
+	ret := make([]types.OrderUploadResult, len(numbers))
+	valid := make([]types.Order, 0, len(numbers))
+	for i, number := range numbers {
+		ret[i].Number = number
+		if validator.Validate(number) != nil {
+			ret[i].Result = types.UploadInvalid
+			continue
+		}
+		valid = append(valid, types.Order{
+			Number:     number,
+			UserID:     userID,
+			MerchantID: merchant,
+			Scheme:     validator.Scheme(),
+		})
+	}
+
+	if len(valid) > 0 {
+		created, err := ro.orderRepo.CreateOrders(r.Context(), valid)
+		if err != nil {
+			ro.internalError(w, r, "Unable to create orders", err)
+			return
+		}
+
+		accepted := 0
+		for i := range ret {
+			if ret[i].Result == types.UploadInvalid {
+				continue
+			}
+			ret[i] = created[0]
+			created = created[1:]
+			switch ret[i].Result {
+			case types.UploadAccepted:
+				accepted++
+				fallthrough
+			case types.UploadAlreadyYours:
+				if err = ro.registerAccrual(r, ret[i].Number, nil); err != nil {
+					ro.internalError(w, r, "Unable to register order for accrual", err)
+					return
+				}
+			}
+		}
+		metrics.OrdersUploaded.Add(float64(accepted))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(ret)
+	if err != nil {
+		ro.internalError(w, r, "Can't marshal data", err)
+		return
+	}
+}
+
+// parseJSONBatch reads an array of order numbers. Numbers may be given as
+// strings or as JSON numbers; any other element is kept verbatim and later
+// reported as invalid.
+func parseJSONBatch(r io.Reader) ([]string, error) {
+	var raw []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	if len(raw) > maxBatchOrders {
+		return nil, errBatchTooLarge
+	}
+
+	ret := make([]string, 0, len(raw))
+	for _, elem := range raw {
+		elem = bytes.TrimSpace(elem)
+		number := string(elem)
+		if len(elem) > 0 && elem[0] == '"' {
+			if err := json.Unmarshal(elem, &number); err != nil {
+				return nil, err
+			}
+			number = types.NormalizeOrder(number)
+		}
+		ret = append(ret, number)
+	}
+	return ret, nil
+}
+
+// parseTextBatch reads one order number per line, skipping blank lines.
+func parseTextBatch(r io.Reader) ([]string, error) {
+	var ret []string
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		number := types.NormalizeOrder(sc.Text())
+		if number == "" {
+			continue
+		}
+		if len(ret) == maxBatchOrders {
+			return nil, errBatchTooLarge
+		}
+		ret = append(ret, number)
+	}
+	return ret, sc.Err()
+}
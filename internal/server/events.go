@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/gofermart/internal/auth"
+	"github.com/shevchukeugeni/gofermart/internal/logging"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+// keepAliveInterval is how often an idle event stream gets a comment line,
+// so that proxies do not close it as stale.
+const keepAliveInterval = 15 * time.Second
+
+// events streams the user's order status and balance changes as
+// Server-Sent Events. The stream opens with the current balance.
+func (ro *router) events(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Subscribe before reading the balance so that no change is missed in
+	// between.
+	stream, unsubscribe := ro.cfg.Events.Subscribe(userID)
+	defer unsubscribe()
+
+	balance, err := ro.userBalance(r.Context(), userID)
+	if err != nil {
+		ro.internalError(w, r, "Unable to get balance", err)
+		return
+	}
+
+	logger := logging.FromContext(r.Context())
+	rc := http.NewResponseController(w)
+	// The stream lives longer than the server's write timeout allows.
+	err = rc.SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		ro.internalError(w, r, "Unable to open event stream", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event types.EventType, data interface{}) error {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+		if err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	err = send(types.EventBalance, balance)
+	if err != nil {
+		logger.Debug("event stream closed", zap.Error(err))
+		return
+	}
+
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			_, err = io.WriteString(w, ": keep-alive\n\n")
+			if err == nil {
+				err = rc.Flush()
+			}
+		case event := <-stream:
+			switch event.Type {
+			case types.EventOrder:
+				err = send(event.Type, types.OrderEvent{
+					Number:  event.Order,
+					Status:  event.Status,
+					Accrual: event.Accrual,
+				})
+			case types.EventBalance:
+				balance, err = ro.userBalance(r.Context(), userID)
+				if err != nil {
+					logger.Error("Unable to get balance", zap.Error(err))
+					continue
+				}
+				err = send(event.Type, balance)
+			}
+		}
+		if err != nil {
+			logger.Debug("event stream closed", zap.Error(err))
+			return
+		}
+	}
+}
+
+// publishBalance announces a change of the user's balance. A lost event only
+// leaves the client to find the change on its next request.
+func (ro *router) publishBalance(ctx context.Context, userID string) {
+	if ro.publisher == nil {
+		return
+	}
+	err := ro.publisher.Publish(ctx, types.Event{Type: types.EventBalance, UserID: userID})
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to publish event", zap.Error(err))
+	}
+}
+
+// publishRecipientBalance announces the points received by the user with
+// login.
+func (ro *router) publishRecipientBalance(ctx context.Context, login string) {
+	if ro.publisher == nil {
+		return
+	}
+	recipient, err := ro.userRepo.GetByLogin(ctx, login)
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to get transfer recipient", zap.Error(err))
+		return
+	}
+	ro.publishBalance(ctx, recipient.ID)
+}
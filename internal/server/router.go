@@ -1,15 +1,24 @@
 package server
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/shevchukeugeni/gofermart/internal/accrual"
 	"github.com/shevchukeugeni/gofermart/internal/auth"
+	"github.com/shevchukeugeni/gofermart/internal/events"
+	"github.com/shevchukeugeni/gofermart/internal/logging"
+	"github.com/shevchukeugeni/gofermart/internal/metrics"
 	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/tracing"
 	"golang.org/x/crypto/sha3"
 	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -19,40 +28,147 @@ import (
 	"github.com/shevchukeugeni/gofermart/internal/types"
 )
 
+// Config holds optional router settings; the zero value is usable.
+type Config struct {
+	// Validators selects the order-number validation scheme per merchant.
+	// Only Luhn-checked numbers are accepted when it is nil.
+	Validators *types.Validators
+	// PointsTTL is the lifetime of accrued points, zero if they never
+	// expire. Points expiring within PointsWarningWindow are reported in
+	// the balance.
+	PointsTTL           time.Duration
+	PointsWarningWindow time.Duration
+	// Tiers stores loyalty tiers; they are reported only when TierLevels is
+	// not empty.
+	Tiers      store.Tier
+	TierLevels []types.Tier
+	// TransferDailyLimit caps the points a user may send per UTC day; zero
+	// means no limit.
+	TransferDailyLimit float64
+	// AdminToken authorizes the /api/admin endpoints, which are not
+	// registered while it is empty.
+	AdminToken string
+	// Accrual registers accepted orders with the in-process accrual
+	// engine; it is nil when the external accrual service is used.
+	Accrual accrual.Registrar
+	// Events feeds the /api/user/events stream, which is not registered
+	// while it is nil.
+	Events *events.Hub
+	// Publisher announces the balance changes made through the API. It
+	// defaults to Events, which reaches the streams of this instance only.
+	Publisher events.Publisher
+	// Webhooks stores merchant webhooks, managed under /api/admin/webhooks
+	// when it and AdminToken are set.
+	Webhooks store.Webhook
+}
+
 type router struct {
 	logger         *zap.Logger
 	userRepo       store.User
 	orderRepo      store.Order
 	withdrawalRepo store.Withdrawal
+	validators     *types.Validators
+	publisher      events.Publisher
+	cfg            Config
+	now            func() time.Time
 }
 
-func SetupRouter(logger *zap.Logger, user store.User, order store.Order, wtd store.Withdrawal) http.Handler {
+func SetupRouter(logger *zap.Logger, user store.User, order store.Order, wtd store.Withdrawal, cfg Config) http.Handler {
 	ro := &router{
 		logger:         logger,
 		userRepo:       user,
 		orderRepo:      order,
 		withdrawalRepo: wtd,
+		validators:     cfg.Validators,
+		cfg:            cfg,
+		now:            time.Now,
+	}
+	if ro.validators == nil {
+		ro.validators = types.NewValidators(nil, nil)
+	}
+	ro.publisher = cfg.Publisher
+	if ro.publisher == nil && cfg.Events != nil {
+		ro.publisher = cfg.Events
 	}
 	return ro.Handler()
 }
 
 func (ro *router) Handler() http.Handler {
 	rtr := chi.NewRouter()
-	rtr.Use(middleware.Logger)
+	rtr.Use(middleware.RequestID)
+	rtr.Use(logging.Middleware(ro.logger))
+	rtr.Use(metrics.Middleware)
+	rtr.Use(tracing.Middleware)
+	rtr.Handle("/metrics", metrics.Handler())
 	rtr.Post("/api/user/register", ro.register)
 	rtr.Post("/api/user/login", ro.auth)
 	rtr.Route("/api/user", func(r chi.Router) {
 		r.Use(jwtauth.Verifier(auth.TokenAuth))
 		r.Use(jwtauth.Authenticator)
+		r.Use(ro.identify)
 		r.Post("/orders", ro.newOrder)
+		r.Post("/orders/batch", ro.newOrders)
 		r.Get("/orders", ro.orders)
+		r.Get("/orders/{number}", ro.order)
 		r.Get("/balance", ro.balance)
 		r.Post("/balance/withdraw", ro.withdraw)
+		r.Post("/balance/transfer", ro.transfer)
+		r.Get("/transfers", ro.transfersList)
 		r.Get("/withdrawals", ro.withdrawalsList)
+		r.Get("/transactions", ro.transactions)
+		r.Get("/statement", ro.statement)
+		if ro.tiersEnabled() {
+			r.Get("/tier/history", ro.tierHistory)
+		}
+		if ro.cfg.Events != nil {
+			r.Get("/events", ro.events)
+		}
 	})
+	if ro.cfg.AdminToken != "" {
+		rtr.Route("/api/admin", func(r chi.Router) {
+			r.Use(ro.adminOnly)
+			r.Post("/withdrawals/{id}/reverse", ro.reverseWithdrawal)
+			if ro.cfg.Webhooks != nil {
+				r.Post("/webhooks", ro.createWebhook)
+				r.Get("/webhooks", ro.webhooksList)
+				r.Delete("/webhooks/{id}", ro.deleteWebhook)
+				r.Get("/webhooks/deliveries/dead", ro.deadDeliveries)
+				r.Post("/webhooks/deliveries/{id}/replay", ro.replayDelivery)
+			}
+		})
+	}
 	return rtr
 }
 
+// identify exposes the authenticated user to the request logger.
+func (ro *router) identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if userID, err := auth.GetUserID(r); err == nil {
+			r = logging.SetUserID(r, userID)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// merchantHeader identifies the merchant an order comes from; the merchant
+// query parameter is accepted as well for clients that cannot set headers.
+const merchantHeader = "X-Merchant-ID"
+
+// orderValidator resolves the merchant of an order upload and its validator.
+func (ro *router) orderValidator(r *http.Request) (string, types.Validator, error) {
+	merchant := r.Header.Get(merchantHeader)
+	if merchant == "" {
+		merchant = r.URL.Query().Get("merchant")
+	}
+	v, err := ro.validators.For(merchant)
+	return merchant, v, err
+}
+
+func (ro *router) internalError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	logging.FromContext(r.Context()).Error(msg, zap.Error(err))
+	http.Error(w, msg+": "+err.Error(), http.StatusInternalServerError)
+}
+
 func (ro *router) register(w http.ResponseWriter, r *http.Request) {
 	var req types.UserLoginRequest
 
@@ -74,14 +190,15 @@ func (ro *router) register(w http.ResponseWriter, r *http.Request) {
 		if errors.Is(err, types.ErrUserAlreadyExists) {
 			http.Error(w, "Unable to create user: "+err.Error(), http.StatusConflict)
 		} else {
-			http.Error(w, "Unable to create user: "+err.Error(), http.StatusInternalServerError)
+			ro.internalError(w, r, "Unable to create user", err)
 		}
 		return
 	}
+	metrics.Registrations.Inc()
 
 	tokenString, err := auth.GenerateToken(usr.ID)
 	if err != nil {
-		http.Error(w, "Unable to generate token: "+err.Error(), http.StatusInternalServerError)
+		ro.internalError(w, r, "Unable to generate token", err)
 		return
 	}
 
@@ -105,7 +222,11 @@ func (ro *router) auth(w http.ResponseWriter, r *http.Request) {
 
 	usr, err := ro.userRepo.GetByLogin(r.Context(), req.Login)
 	if err != nil {
-		http.Error(w, "Unable to find user: "+err.Error(), http.StatusBadRequest)
+		if errors.Is(err, types.ErrNotFound) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		} else {
+			ro.internalError(w, r, "Unable to find user", err)
+		}
 		return
 	}
 
@@ -119,7 +240,7 @@ func (ro *router) auth(w http.ResponseWriter, r *http.Request) {
 
 	tokenString, err := auth.GenerateToken(usr.ID)
 	if err != nil {
-		http.Error(w, "Unable to generate token: "+err.Error(), http.StatusInternalServerError)
+		ro.internalError(w, r, "Unable to generate token", err)
 		return
 	}
 
@@ -128,7 +249,8 @@ func (ro *router) auth(w http.ResponseWriter, r *http.Request) {
 }
 
 func (ro *router) newOrder(w http.ResponseWriter, r *http.Request) {
-	if r.Header.Get("Content-Type") != "text/plain" {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "text/plain" && mediaType != "application/json" {
 		http.Error(w, "incorrect request format", http.StatusBadRequest)
 		return
 	}
@@ -139,38 +261,108 @@ func (ro *router) newOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	numberB, err := io.ReadAll(r.Body)
+	var req types.OrderUploadRequest
+	if mediaType == "application/json" {
+		err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBody)).Decode(&req)
+		if err != nil {
+			http.Error(w, "Unable to decode json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = validatePurchase(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		numberB, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Unable to read body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Number = string(numberB)
+	}
+	r.Body.Close()
+
+	merchant, validator, err := ro.orderValidator(r)
 	if err != nil {
-		http.Error(w, "Unable to read body: "+err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	r.Body.Close()
 
-	number := string(numberB)
+	number := types.NormalizeOrder(req.Number)
 
-	err = types.ValidateOrder(number)
+	err = validator.Validate(number)
 	if err != nil {
 		http.Error(w, "Order number validation failed", http.StatusUnprocessableEntity)
 		return
 	}
 
-	err = ro.orderRepo.CreateOrder(r.Context(), number, userID)
+	err = ro.orderRepo.CreateOrder(r.Context(), &types.Order{
+		Number:     number,
+		UserID:     userID,
+		MerchantID: merchant,
+		Scheme:     validator.Scheme(),
+		Total:      req.Total,
+		Goods:      req.Goods,
+	})
 	switch {
 	case errors.Is(err, types.ErrOrderAlreadyCreatedByUser):
+		// Registration may have failed on the first upload.
+		if err = ro.registerAccrual(r, number, req.Goods); err != nil {
+			ro.internalError(w, r, "Unable to register order for accrual", err)
+			return
+		}
 		w.WriteHeader(200)
 		return
 	case errors.Is(err, types.ErrOrderAlreadyCreatedByAnother):
 		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	case err == nil:
+		metrics.OrdersUploaded.Inc()
+		if err = ro.registerAccrual(r, number, req.Goods); err != nil {
+			ro.internalError(w, r, "Unable to register order for accrual", err)
+			return
+		}
 		w.WriteHeader(http.StatusAccepted)
 		return
 	default:
-		http.Error(w, "Unable to create order: "+err.Error(), http.StatusInternalServerError)
+		ro.internalError(w, r, "Unable to create order", err)
 		return
 	}
 }
 
+// maxOrderGoods limits the line items of a single order upload.
+const maxOrderGoods = 1000
+
+// validatePurchase checks the total and goods of a JSON order upload; the
+// number is validated separately.
+func validatePurchase(req types.OrderUploadRequest) error {
+	if req.Total < 0 {
+		return errors.New("total must not be negative")
+	}
+	if len(req.Goods) > maxOrderGoods {
+		return fmt.Errorf("no more than %d goods per order allowed", maxOrderGoods)
+	}
+	for i, g := range req.Goods {
+		if g.Description == "" || g.Price < 0 {
+			return fmt.Errorf("goods[%d]: description must be set and price not negative", i)
+		}
+	}
+	return nil
+}
+
+// registerAccrual passes an order of the user to the in-process accrual
+// engine, if any. Orders registered before are left alone.
+func (ro *router) registerAccrual(r *http.Request, number string, goods []types.Good) error {
+	if ro.cfg.Accrual == nil {
+		return nil
+	}
+	err := ro.cfg.Accrual.RegisterOrder(r.Context(), number, goods)
+	if errors.Is(err, types.ErrAlreadyExists) {
+		return nil
+	}
+	return err
+}
+
 func (ro *router) orders(w http.ResponseWriter, r *http.Request) {
 	userID, err := auth.GetUserID(r)
 	if err != nil {
@@ -180,7 +372,7 @@ func (ro *router) orders(w http.ResponseWriter, r *http.Request) {
 
 	ret, err := ro.orderRepo.GetOrdersByUser(r.Context(), userID)
 	if err != nil {
-		http.Error(w, "Unable to get orders: "+err.Error(), http.StatusInternalServerError)
+		ro.internalError(w, r, "Unable to get orders", err)
 		return
 	}
 
@@ -193,7 +385,40 @@ func (ro *router) orders(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(w).Encode(ret)
 	if err != nil {
-		http.Error(w, "Can't marshal data: "+err.Error(), http.StatusInternalServerError)
+		ro.internalError(w, r, "Can't marshal data", err)
+		return
+	}
+}
+
+func (ro *router) order(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// chi matches the escaped path, so numbers with a slash stay one segment.
+	number, err := url.PathUnescape(chi.URLParam(r, "number"))
+	if err != nil {
+		http.Error(w, "Incorrect order number", http.StatusBadRequest)
+		return
+	}
+
+	order, err := ro.orderRepo.GetOrder(r.Context(), userID, number)
+	if errors.Is(err, types.ErrNotFound) {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		ro.internalError(w, r, "Unable to get order", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(order)
+	if err != nil {
+		ro.internalError(w, r, "Can't marshal data", err)
 		return
 	}
 }
@@ -205,9 +430,9 @@ func (ro *router) balance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	balance, err := ro.withdrawalRepo.GetBalance(r.Context(), userID)
+	balance, err := ro.userBalance(r.Context(), userID)
 	if err != nil {
-		http.Error(w, "Unable to get balance: "+err.Error(), http.StatusInternalServerError)
+		ro.internalError(w, r, "Unable to get balance", err)
 		return
 	}
 
@@ -215,11 +440,45 @@ func (ro *router) balance(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(w).Encode(balance)
 	if err != nil {
-		http.Error(w, "Can't marshal data: "+err.Error(), http.StatusInternalServerError)
+		ro.internalError(w, r, "Can't marshal data", err)
 		return
 	}
 }
 
+// userBalance returns the balance with the user's tier and expiring points
+// when those are enabled.
+func (ro *router) userBalance(ctx context.Context, userID string) (*types.UserBalance, error) {
+	balance, err := ro.withdrawalRepo.GetBalance(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if ro.tiersEnabled() {
+		balance.Tier, err = ro.cfg.Tiers.GetTier(ctx, userID)
+		if errors.Is(err, types.ErrNotFound) {
+			// Not recalculated since the user signed up.
+			balance.Tier, err = ro.cfg.TierLevels[0].Name, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get tier: %w", err)
+		}
+	}
+
+	if ro.cfg.PointsTTL > 0 {
+		// Points expire TTL after accrual: whatever was accrued before
+		// before-TTL is gone by before.
+		before := ro.now().Add(ro.cfg.PointsWarningWindow)
+		sum, err := ro.withdrawalRepo.GetExpiringPoints(ctx, userID, before.Add(-ro.cfg.PointsTTL))
+		if err != nil {
+			return nil, fmt.Errorf("get expiring points: %w", err)
+		}
+		if sum > 0 {
+			balance.Expiring = &types.ExpiringPoints{Sum: sum, Before: before}
+		}
+	}
+	return balance, nil
+}
+
 func (ro *router) withdraw(w http.ResponseWriter, r *http.Request) {
 	userID, err := auth.GetUserID(r)
 	if err != nil {
@@ -235,22 +494,101 @@ func (ro *router) withdraw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = types.ValidateOrder(req.Order)
-	if err != nil || req.Sum == 0 {
+	// Points spent at a merchant are reported to its webhooks.
+	merchant, validator, err := ro.orderValidator(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = validator.Validate(req.Order)
+	if err != nil || req.Sum <= 0 {
 		http.Error(w, "Order number validation failed", http.StatusUnprocessableEntity)
 		return
 	}
 
-	err = ro.withdrawalRepo.CreateWithdrawal(r.Context(), req.Order, userID, req.Sum)
+	err = ro.withdrawalRepo.CreateWithdrawal(r.Context(), req.Order, userID, merchant, req.Sum)
 	switch {
 	case errors.Is(err, types.ErrInsufficientBalance):
 		w.WriteHeader(402)
 		return
 	case err == nil:
+		metrics.PointsWithdrawn.Add(req.Sum)
+		ro.publishBalance(r.Context(), userID)
 		w.WriteHeader(http.StatusOK)
 		return
 	default:
-		http.Error(w, "Unable to create order: "+err.Error(), http.StatusInternalServerError)
+		ro.internalError(w, r, "Unable to create order", err)
+		return
+	}
+}
+
+func (ro *router) transfer(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req types.TransferRequest
+
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Unable to decode json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Recipient == "" || req.Sum <= 0 {
+		http.Error(w, "Missing recipient or positive sum", http.StatusBadRequest)
+		return
+	}
+
+	err = ro.withdrawalRepo.CreateTransfer(r.Context(), userID, req.Recipient, req.Sum, types.TransferLimit{
+		Max:   ro.cfg.TransferDailyLimit,
+		Since: ro.now().UTC().Truncate(24 * time.Hour),
+	})
+	switch {
+	case errors.Is(err, types.ErrInsufficientBalance):
+		w.WriteHeader(http.StatusPaymentRequired)
+	case errors.Is(err, types.ErrNotFound):
+		http.Error(w, "Recipient not found", http.StatusNotFound)
+	case errors.Is(err, types.ErrTransferToSelf):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, types.ErrTransferLimitExceeded):
+		http.Error(w, "Daily transfer limit exceeded", http.StatusForbidden)
+	case err == nil:
+		metrics.PointsTransferred.Add(req.Sum)
+		ro.publishBalance(r.Context(), userID)
+		ro.publishRecipientBalance(r.Context(), req.Recipient)
+		w.WriteHeader(http.StatusOK)
+	default:
+		ro.internalError(w, r, "Unable to create transfer", err)
+	}
+}
+
+func (ro *router) transfersList(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ret, err := ro.withdrawalRepo.GetTransfersByUser(r.Context(), userID)
+	if err != nil {
+		ro.internalError(w, r, "Unable to get transfers", err)
+		return
+	}
+
+	if len(ret) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(ret)
+	if err != nil {
+		ro.internalError(w, r, "Can't marshal data", err)
 		return
 	}
 }
@@ -264,7 +602,38 @@ func (ro *router) withdrawalsList(w http.ResponseWriter, r *http.Request) {
 
 	ret, err := ro.withdrawalRepo.GetWithdrawalsByUser(r.Context(), userID)
 	if err != nil {
-		http.Error(w, "Unable to get orders: "+err.Error(), http.StatusInternalServerError)
+		ro.internalError(w, r, "Unable to get orders", err)
+		return
+	}
+
+	if len(ret) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(ret)
+	if err != nil {
+		ro.internalError(w, r, "Can't marshal data", err)
+		return
+	}
+}
+
+func (ro *router) tiersEnabled() bool {
+	return ro.cfg.Tiers != nil && len(ro.cfg.TierLevels) > 0
+}
+
+func (ro *router) tierHistory(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ret, err := ro.cfg.Tiers.GetTierHistory(r.Context(), userID)
+	if err != nil {
+		ro.internalError(w, r, "Unable to get tier history", err)
 		return
 	}
 
@@ -277,7 +646,7 @@ func (ro *router) withdrawalsList(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(w).Encode(ret)
 	if err != nil {
-		http.Error(w, "Can't marshal data: "+err.Error(), http.StatusInternalServerError)
+		ro.internalError(w, r, "Can't marshal data", err)
 		return
 	}
 }
@@ -0,0 +1,1183 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/gofermart/internal/accrual"
+	"github.com/shevchukeugeni/gofermart/internal/auth"
+	"github.com/shevchukeugeni/gofermart/internal/events"
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/store/memory"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+type testEnv struct {
+	t        *testing.T
+	handler  http.Handler
+	orders   store.Order
+	tiers    store.Tier
+	webhooks store.Webhook
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	return newTestEnvConfig(t, Config{})
+}
+
+func newTestEnvConfig(t *testing.T, cfg Config) *testEnv {
+	db := memory.New()
+	env := &testEnv{
+		t:        t,
+		orders:   memory.NewOrderRepository(db),
+		tiers:    memory.NewTierRepository(db),
+		webhooks: memory.NewWebhookRepository(db),
+	}
+	if len(cfg.TierLevels) > 0 {
+		cfg.Tiers = env.tiers
+	}
+	if cfg.AdminToken != "" {
+		cfg.Webhooks = env.webhooks
+	}
+	env.handler = SetupRouter(zap.NewNop(), memory.NewUserRepository(db), env.orders, memory.NewWithdrawalRepository(db), cfg)
+	return env
+}
+
+type request struct {
+	method      string
+	path        string
+	body        string
+	contentType string
+	token       string
+}
+
+func (env *testEnv) do(req request) *httptest.ResponseRecorder {
+	env.t.Helper()
+
+	r := httptest.NewRequest(req.method, req.path, strings.NewReader(req.body))
+	if req.contentType != "" {
+		r.Header.Set("Content-Type", req.contentType)
+	}
+	if req.token != "" {
+		r.Header.Set("Authorization", "Bearer "+req.token)
+	}
+
+	w := httptest.NewRecorder()
+	env.handler.ServeHTTP(w, r)
+	return w
+}
+
+// register creates a user through the API and returns its token.
+func (env *testEnv) register(login string) string {
+	env.t.Helper()
+
+	w := env.do(request{
+		method:      http.MethodPost,
+		path:        "/api/user/register",
+		body:        `{"login":"` + login + `","password":"secret"}`,
+		contentType: "application/json",
+	})
+	require.Equal(env.t, http.StatusOK, w.Code, w.Body.String())
+
+	header := w.Header().Get("Authorization")
+	require.True(env.t, strings.HasPrefix(header, "Bearer "))
+	return strings.TrimPrefix(header, "Bearer ")
+}
+
+// accrue uploads an order and marks it processed with the given accrual.
+func (env *testEnv) accrue(token, number string, accrual float64) {
+	env.t.Helper()
+
+	w := env.do(request{method: http.MethodPost, path: "/api/user/orders", body: number, contentType: "text/plain", token: token})
+	require.Equal(env.t, http.StatusAccepted, w.Code, w.Body.String())
+	_, err := env.orders.UpdateOrder(context.Background(), number, string(types.Processed), accrual)
+	require.NoError(env.t, err)
+}
+
+func TestRegister(t *testing.T) {
+	env := newTestEnv(t)
+	env.register("alice")
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"duplicate login", `{"login":"alice","password":"other"}`, http.StatusConflict},
+		{"malformed json", `{"login":"bob",`, http.StatusBadRequest},
+		{"missing password", `{"login":"bob"}`, http.StatusBadRequest},
+		{"missing login", `{"password":"secret"}`, http.StatusBadRequest},
+		{"new user", `{"login":"bob","password":"secret"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := env.do(request{method: http.MethodPost, path: "/api/user/register", body: tt.body, contentType: "application/json"})
+			assert.Equal(t, tt.want, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestLogin(t *testing.T) {
+	env := newTestEnv(t)
+	env.register("alice")
+
+	tests := []struct {
+		name       string
+		body       string
+		want       int
+		wantBearer bool
+	}{
+		{"success", `{"login":"alice","password":"secret"}`, http.StatusOK, true},
+		{"wrong password", `{"login":"alice","password":"wrong"}`, http.StatusUnauthorized, false},
+		{"unknown login", `{"login":"bob","password":"secret"}`, http.StatusUnauthorized, false},
+		{"malformed json", `not json`, http.StatusBadRequest, false},
+		{"missing password", `{"login":"alice"}`, http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := env.do(request{method: http.MethodPost, path: "/api/user/login", body: tt.body, contentType: "application/json"})
+			assert.Equal(t, tt.want, w.Code, w.Body.String())
+			assert.Equal(t, tt.wantBearer, strings.HasPrefix(w.Header().Get("Authorization"), "Bearer "))
+		})
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, expired, err := auth.TokenAuth.Encode(map[string]interface{}{
+		"user_id": "someone",
+		"exp":     time.Now().Add(-time.Minute).Unix(),
+	})
+	require.NoError(t, err)
+
+	routes := []request{
+		{method: http.MethodPost, path: "/api/user/orders", body: "12345678903", contentType: "text/plain"},
+		{method: http.MethodGet, path: "/api/user/orders"},
+		{method: http.MethodGet, path: "/api/user/balance"},
+		{method: http.MethodPost, path: "/api/user/balance/withdraw", body: `{"order":"2377225624","sum":1}`, contentType: "application/json"},
+		{method: http.MethodGet, path: "/api/user/withdrawals"},
+	}
+	for _, route := range routes {
+		t.Run(route.method+" "+route.path, func(t *testing.T) {
+			assert.Equal(t, http.StatusUnauthorized, env.do(route).Code, "missing token")
+
+			route.token = "not-a-jwt"
+			assert.Equal(t, http.StatusUnauthorized, env.do(route).Code, "malformed token")
+
+			route.token = expired
+			assert.Equal(t, http.StatusUnauthorized, env.do(route).Code, "expired token")
+		})
+	}
+}
+
+func TestUploadOrder(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.register("alice")
+	bob := env.register("bob")
+
+	tests := []struct {
+		name        string
+		token       string
+		body        string
+		contentType string
+		want        int
+	}{
+		{"accepted", alice, "12345678903", "text/plain", http.StatusAccepted},
+		{"already uploaded by user", alice, "12345678903", "text/plain", http.StatusOK},
+		{"uploaded by another user", bob, "12345678903", "text/plain", http.StatusConflict},
+		{"content type with charset", alice, "9278923470", "text/plain; charset=utf-8", http.StatusAccepted},
+		{"surrounding whitespace", alice, " 4561261212345467\r\n", "text/plain", http.StatusAccepted},
+		{"longer than int64", alice, "79927398713123456789012345671", "text/plain", http.StatusAccepted},
+		{"wrong content type", alice, "346436439", "application/json", http.StatusBadRequest},
+		{"missing content type", alice, "346436439", "", http.StatusBadRequest},
+		{"luhn check fails", alice, "12345678904", "text/plain", http.StatusUnprocessableEntity},
+		{"not a number", alice, "abc", "text/plain", http.StatusUnprocessableEntity},
+		{"empty body", alice, "", "text/plain", http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := env.do(request{method: http.MethodPost, path: "/api/user/orders", body: tt.body, contentType: tt.contentType, token: tt.token})
+			assert.Equal(t, tt.want, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestUploadOrderMerchant(t *testing.T) {
+	receipt, err := types.NewRegexValidator(`ACME-\d{6}`, types.ChecksumNone)
+	require.NoError(t, err)
+	invoice, err := types.NewRegexValidator(`INV/\d+`, types.ChecksumNone)
+	require.NoError(t, err)
+	env := newTestEnvConfig(t, Config{
+		Validators: types.NewValidators(nil, map[string]types.Validator{"acme": receipt, "inv": invoice}),
+	})
+	alice := env.register("alice")
+
+	upload := func(path, merchant, body string) int {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "text/plain")
+		r.Header.Set("Authorization", "Bearer "+alice)
+		if merchant != "" {
+			r.Header.Set("X-Merchant-ID", merchant)
+		}
+		w := httptest.NewRecorder()
+		env.handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusAccepted, upload("/api/user/orders", "acme", "ACME-000123"))
+	assert.Equal(t, http.StatusAccepted, upload("/api/user/orders?merchant=acme", "", "ACME-000124"))
+	assert.Equal(t, http.StatusUnprocessableEntity, upload("/api/user/orders", "acme", "12345678903"))
+	assert.Equal(t, http.StatusUnprocessableEntity, upload("/api/user/orders", "", "ACME-000125"))
+	assert.Equal(t, http.StatusBadRequest, upload("/api/user/orders", "unknown", "12345678903"))
+	assert.Equal(t, http.StatusBadRequest, upload("/api/user/orders/batch", "unknown", "12345678903"))
+	assert.Equal(t, http.StatusOK, upload("/api/user/orders/batch", "acme", "ACME-000125\n12345678903"))
+
+	w := env.do(request{method: http.MethodGet, path: "/api/user/orders", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+	var orders []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &orders))
+	require.Len(t, orders, 3)
+	for _, order := range orders {
+		assert.Equal(t, "acme", order["merchant_id"])
+		assert.NotContains(t, order, "validation_scheme")
+	}
+
+	// Numbers with a slash are looked up escaped.
+	assert.Equal(t, http.StatusAccepted, upload("/api/user/orders", "inv", "INV/7"))
+	w = env.do(request{method: http.MethodGet, path: "/api/user/orders/" + url.PathEscape("INV/7"), token: alice})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"number":"INV/7"`)
+}
+
+func TestUploadOrdersBatch(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.register("alice")
+	bob := env.register("bob")
+	env.accrue(bob, "346436439", 0)
+	env.accrue(alice, "9278923470", 0)
+
+	upload := func(body, contentType string) *httptest.ResponseRecorder {
+		return env.do(request{method: http.MethodPost, path: "/api/user/orders/batch", body: body, contentType: contentType, token: alice})
+	}
+	decode := func(w *httptest.ResponseRecorder) []types.OrderUploadResult {
+		t.Helper()
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var ret []types.OrderUploadResult
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ret))
+		return ret
+	}
+
+	t.Run("json", func(t *testing.T) {
+		got := decode(upload(`["12345678903", 2377225624, "9278923470", "346436439", "12345678904", "12345678903", null]`, "application/json"))
+		assert.Equal(t, []types.OrderUploadResult{
+			{Number: "12345678903", Result: types.UploadAccepted},
+			{Number: "2377225624", Result: types.UploadAccepted},
+			{Number: "9278923470", Result: types.UploadAlreadyYours},
+			{Number: "346436439", Result: types.UploadConflict},
+			{Number: "12345678904", Result: types.UploadInvalid},
+			{Number: "12345678903", Result: types.UploadAlreadyYours},
+			{Number: "null", Result: types.UploadInvalid},
+		}, got)
+	})
+
+	t.Run("text", func(t *testing.T) {
+		got := decode(upload("4561261212345467\r\n\n  12345678903  \nabc\n", "text/plain; charset=utf-8"))
+		assert.Equal(t, []types.OrderUploadResult{
+			{Number: "4561261212345467", Result: types.UploadAccepted},
+			{Number: "12345678903", Result: types.UploadAlreadyYours},
+			{Number: "abc", Result: types.UploadInvalid},
+		}, got)
+	})
+
+	t.Run("only invalid", func(t *testing.T) {
+		got := decode(upload(`["1"]`, "application/json"))
+		assert.Equal(t, []types.OrderUploadResult{{Number: "1", Result: types.UploadInvalid}}, got)
+	})
+
+	tooMany := strings.Repeat("12345678903\n", maxBatchOrders+1)
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		want        int
+	}{
+		{"empty array", `[]`, "application/json", http.StatusBadRequest},
+		{"empty text", "\n\n", "text/plain", http.StatusBadRequest},
+		{"malformed json", `["12345678903"`, "application/json", http.StatusBadRequest},
+		{"not an array", `{"order":"12345678903"}`, "application/json", http.StatusBadRequest},
+		{"wrong content type", "12345678903", "application/xml", http.StatusBadRequest},
+		{"too many orders", tooMany, "text/plain", http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := upload(tt.body, tt.contentType)
+			assert.Equal(t, tt.want, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestListOrders(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.register("alice")
+
+	w := env.do(request{method: http.MethodGet, path: "/api/user/orders", token: alice})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	env.accrue(alice, "12345678903", 500)
+	time.Sleep(5 * time.Millisecond)
+	w = env.do(request{method: http.MethodPost, path: "/api/user/orders", body: "9278923470", contentType: "text/plain", token: alice})
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	w = env.do(request{method: http.MethodGet, path: "/api/user/orders", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var got []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	require.Len(t, got, 2)
+
+	assert.Equal(t, "9278923470", got[0]["number"])
+	assert.Equal(t, "NEW", got[0]["status"])
+	assert.NotContains(t, got[0], "accrual")
+
+	assert.Equal(t, "12345678903", got[1]["number"])
+	assert.Equal(t, "PROCESSED", got[1]["status"])
+	assert.Equal(t, 500.0, got[1]["accrual"])
+
+	for _, order := range got {
+		_, err := time.Parse(time.RFC3339, order["uploaded_at"].(string))
+		assert.NoError(t, err)
+		assert.NotContains(t, order, "user_id")
+	}
+}
+
+func TestBalance(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.register("alice")
+
+	w := env.do(request{method: http.MethodGet, path: "/api/user/balance", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"current":0,"withdrawn":0}`, w.Body.String())
+
+	env.accrue(alice, "12345678903", 500.5)
+	w = env.do(request{method: http.MethodPost, path: "/api/user/balance/withdraw", body: `{"order":"2377225624","sum":42}`, contentType: "application/json", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = env.do(request{method: http.MethodGet, path: "/api/user/balance", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"current":458.5,"withdrawn":42}`, w.Body.String())
+}
+
+func TestBalanceExpiring(t *testing.T) {
+	env := newTestEnvConfig(t, Config{PointsTTL: 24 * time.Hour, PointsWarningWindow: 48 * time.Hour})
+	alice := env.register("alice")
+	env.accrue(alice, "12345678903", 100)
+	w := env.do(request{method: http.MethodPost, path: "/api/user/balance/withdraw", body: `{"order":"2377225624","sum":30}`, contentType: "application/json", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = env.do(request{method: http.MethodGet, path: "/api/user/balance", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var balance struct {
+		Current  float64
+		Expiring struct {
+			Sum    float64
+			Before string
+		}
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &balance))
+	assert.InDelta(t, 70, balance.Current, 1e-9)
+	assert.InDelta(t, 70, balance.Expiring.Sum, 1e-9)
+	before, err := time.Parse(time.RFC3339, balance.Expiring.Before)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(48*time.Hour), before, time.Minute)
+
+	// Nothing accrued now expires within an hour.
+	env = newTestEnvConfig(t, Config{PointsTTL: 24 * time.Hour, PointsWarningWindow: time.Hour})
+	alice = env.register("alice")
+	env.accrue(alice, "12345678903", 100)
+
+	w = env.do(request{method: http.MethodGet, path: "/api/user/balance", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"current":100,"withdrawn":0}`, w.Body.String())
+}
+
+func TestTiers(t *testing.T) {
+	levels := []types.Tier{
+		{Name: "bronze", Threshold: 0, Multiplier: 1},
+		{Name: "silver", Threshold: 100, Multiplier: 1.5},
+	}
+	env := newTestEnvConfig(t, Config{TierLevels: levels})
+	alice := env.register("alice")
+
+	w := env.do(request{method: http.MethodGet, path: "/api/user/balance", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"current":0,"withdrawn":0,"tier":"bronze"}`, w.Body.String())
+
+	w = env.do(request{method: http.MethodGet, path: "/api/user/tier/history", token: alice})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	env.accrue(alice, "12345678903", 100)
+	_, err := env.tiers.RecalculateTiers(context.Background(), levels, types.TierBasisEarned, time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	env.accrue(alice, "9278923470", 10)
+
+	w = env.do(request{method: http.MethodGet, path: "/api/user/balance", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"current":115,"withdrawn":0,"tier":"silver"}`, w.Body.String())
+
+	w = env.do(request{method: http.MethodGet, path: "/api/user/tier/history", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+	var history []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	require.Len(t, history, 1)
+	assert.Equal(t, "silver", history[0]["to"])
+	assert.NotContains(t, history[0], "from")
+
+	// Without tiers neither the field nor the endpoint exist.
+	env = newTestEnv(t)
+	alice = env.register("alice")
+	w = env.do(request{method: http.MethodGet, path: "/api/user/balance", token: alice})
+	assert.JSONEq(t, `{"current":0,"withdrawn":0}`, w.Body.String())
+	w = env.do(request{method: http.MethodGet, path: "/api/user/tier/history", token: alice})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestWithdraw(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.register("alice")
+	env.accrue(alice, "12345678903", 100)
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"success", `{"order":"2377225624","sum":60}`, http.StatusOK},
+		{"insufficient balance", `{"order":"2377225624","sum":40.01}`, http.StatusPaymentRequired},
+		{"invalid order number", `{"order":"2377225625","sum":1}`, http.StatusUnprocessableEntity},
+		{"zero sum", `{"order":"2377225624","sum":0}`, http.StatusUnprocessableEntity},
+		{"negative sum", `{"order":"2377225624","sum":-10}`, http.StatusUnprocessableEntity},
+		{"malformed json", `{"order":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := env.do(request{method: http.MethodPost, path: "/api/user/balance/withdraw", body: tt.body, contentType: "application/json", token: alice})
+			assert.Equal(t, tt.want, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	env := newTestEnvConfig(t, Config{TransferDailyLimit: 100})
+	alice := env.register("alice")
+	bob := env.register("bob")
+	env.accrue(alice, "12345678903", 150)
+
+	transfer := func(token, body string) int {
+		w := env.do(request{method: http.MethodPost, path: "/api/user/balance/transfer", body: body, contentType: "application/json", token: token})
+		return w.Code
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"malformed json", `{"recipient":`, http.StatusBadRequest},
+		{"missing recipient", `{"sum":10}`, http.StatusBadRequest},
+		{"negative sum", `{"recipient":"bob","sum":-10}`, http.StatusBadRequest},
+		{"to self", `{"recipient":"alice","sum":10}`, http.StatusBadRequest},
+		{"unknown recipient", `{"recipient":"carol","sum":10}`, http.StatusNotFound},
+		{"accepted", `{"recipient":"bob","sum":60}`, http.StatusOK},
+		{"over daily limit", `{"recipient":"bob","sum":50}`, http.StatusForbidden},
+		{"within daily limit", `{"recipient":"bob","sum":40}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, transfer(alice, tt.body))
+		})
+	}
+
+	assert.Equal(t, http.StatusPaymentRequired, transfer(bob, `{"recipient":"alice","sum":100.5}`))
+
+	w := env.do(request{method: http.MethodGet, path: "/api/user/balance", token: bob})
+	assert.JSONEq(t, `{"current":100,"withdrawn":0}`, w.Body.String())
+	w = env.do(request{method: http.MethodGet, path: "/api/user/balance", token: alice})
+	assert.JSONEq(t, `{"current":50,"withdrawn":0}`, w.Body.String())
+
+	w = env.do(request{method: http.MethodGet, path: "/api/user/transfers", token: bob})
+	require.Equal(t, http.StatusOK, w.Code)
+	var transfers []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &transfers))
+	require.Len(t, transfers, 2)
+	assert.Equal(t, "in", transfers[0]["direction"])
+	assert.Equal(t, "alice", transfers[0]["counterparty"])
+	assert.Equal(t, 40.0, transfers[0]["sum"])
+
+	env = newTestEnv(t)
+	alice = env.register("alice")
+	w = env.do(request{method: http.MethodGet, path: "/api/user/transfers", token: alice})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestListWithdrawals(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.register("alice")
+
+	w := env.do(request{method: http.MethodGet, path: "/api/user/withdrawals", token: alice})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	env.accrue(alice, "12345678903", 100)
+	w = env.do(request{method: http.MethodPost, path: "/api/user/balance/withdraw", body: `{"order":"2377225624","sum":30}`, contentType: "application/json", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = env.do(request{method: http.MethodGet, path: "/api/user/withdrawals", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var got []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	require.Len(t, got, 1)
+	assert.Equal(t, "2377225624", got[0]["order"])
+	assert.Equal(t, 30.0, got[0]["sum"])
+	_, err := time.Parse(time.RFC3339, got[0]["processed_at"].(string))
+	assert.NoError(t, err)
+
+	// Other users must not see alice's withdrawals.
+	bob := env.register("bob")
+	w = env.do(request{method: http.MethodGet, path: "/api/user/withdrawals", token: bob})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestTransactions(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.register("alice")
+	env.register("bob")
+
+	list := func(query string) *httptest.ResponseRecorder {
+		return env.do(request{method: http.MethodGet, path: "/api/user/transactions" + query, token: alice})
+	}
+
+	assert.Equal(t, http.StatusNoContent, list("").Code)
+
+	env.accrue(alice, "12345678903", 100)
+	w := env.do(request{method: http.MethodPost, path: "/api/user/balance/withdraw", body: `{"order":"2377225624","sum":30}`, contentType: "application/json", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+	w = env.do(request{method: http.MethodPost, path: "/api/user/balance/transfer", body: `{"recipient":"bob","sum":20}`, contentType: "application/json", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = list("")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var got []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	require.Len(t, got, 3)
+	assert.Equal(t, "ACCRUAL", got[0]["type"])
+	assert.Equal(t, "12345678903", got[0]["order"])
+	assert.Equal(t, "WITHDRAWAL", got[1]["type"])
+	assert.Equal(t, -30.0, got[1]["amount"])
+	assert.Equal(t, 70.0, got[1]["balance"])
+	assert.Equal(t, "TRANSFER_OUT", got[2]["type"])
+	assert.Equal(t, "bob", got[2]["counterparty"])
+	assert.Equal(t, 50.0, got[2]["balance"])
+	assert.NotContains(t, got[2], "order")
+	_, err := time.Parse(time.RFC3339, got[0]["processed_at"].(string))
+	assert.NoError(t, err)
+
+	w = list("?limit=1&offset=2")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	require.Len(t, got, 1)
+	assert.Equal(t, "TRANSFER_OUT", got[0]["type"])
+
+	future := time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+	assert.Equal(t, http.StatusNoContent, list("?from="+future).Code)
+	w = list("?to=" + future)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Len(t, got, 3)
+
+	for _, query := range []string{
+		"?from=yesterday",
+		"?to=2024-01-01",
+		"?from=" + future + "&to=" + future,
+		"?limit=0",
+		"?limit=501",
+		"?offset=-1",
+	} {
+		assert.Equal(t, http.StatusBadRequest, list(query).Code, query)
+	}
+}
+
+func TestStatement(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.register("alice")
+	env.register("bob")
+
+	env.accrue(alice, "12345678903", 100)
+	w := env.do(request{method: http.MethodPost, path: "/api/user/balance/withdraw", body: `{"order":"2377225624","sum":30}`, contentType: "application/json", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+	time.Sleep(10 * time.Millisecond)
+	from := time.Now().UTC()
+	time.Sleep(10 * time.Millisecond)
+	w = env.do(request{method: http.MethodPost, path: "/api/user/balance/transfer", body: `{"recipient":"bob","sum":20}`, contentType: "application/json", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+	env.accrue(alice, "9278923470", 50)
+	to := from.Add(time.Hour)
+
+	statement := func(query string) *httptest.ResponseRecorder {
+		return env.do(request{method: http.MethodGet, path: "/api/user/statement" + query, token: alice})
+	}
+	period := "?from=" + from.Format(time.RFC3339Nano) + "&to=" + to.Format(time.RFC3339Nano)
+	filename := "statement-" + from.Format("2006-01-02") + "-" + to.Format("2006-01-02")
+
+	w = statement(period)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=`+filename+`.json`, w.Header().Get("Content-Disposition"))
+
+	var got struct {
+		From         string                   `json:"from"`
+		To           string                   `json:"to"`
+		Opening      types.UserBalance        `json:"opening_balance"`
+		Transactions []map[string]interface{} `json:"transactions"`
+		Closing      types.UserBalance        `json:"closing_balance"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Equal(t, from.Format(time.RFC3339), got.From)
+	assert.Equal(t, types.UserBalance{Current: 70, Withdrawn: 30}, got.Opening)
+	require.Len(t, got.Transactions, 2)
+	assert.Equal(t, "TRANSFER_OUT", got.Transactions[0]["type"])
+	assert.Equal(t, 50.0, got.Transactions[0]["balance"])
+	assert.Equal(t, "ACCRUAL", got.Transactions[1]["type"])
+	assert.Equal(t, "9278923470", got.Transactions[1]["order"])
+	assert.Equal(t, types.UserBalance{Current: 100, Withdrawn: 30}, got.Closing)
+
+	w = statement(period + "&format=csv")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=`+filename+`.csv`, w.Header().Get("Content-Disposition"))
+
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 5)
+	assert.Equal(t, []string{"processed_at", "type", "order", "counterparty", "amount", "balance", "withdrawn"}, rows[0])
+	assert.Equal(t, []string{from.Format(time.RFC3339), "OPENING", "", "", "", "70", "30"}, rows[1])
+	assert.Equal(t, []string{"TRANSFER_OUT", "", "bob", "-20", "50", ""}, rows[2][1:])
+	assert.Equal(t, []string{"ACCRUAL", "9278923470", "", "50", "100", ""}, rows[3][1:])
+	assert.Equal(t, []string{to.Format(time.RFC3339), "CLOSING", "", "", "", "100", "30"}, rows[4])
+
+	for _, query := range []string{
+		"",
+		"?from=" + from.Format(time.RFC3339),
+		"?from=yesterday&to=" + to.Format(time.RFC3339),
+		period + "&format=xml",
+		"?from=" + to.Add(-367*24*time.Hour).Format(time.RFC3339) + "&to=" + to.Format(time.RFC3339),
+	} {
+		assert.Equal(t, http.StatusBadRequest, statement(query).Code, query)
+	}
+}
+
+func TestUploadOrderJSON(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.register("alice")
+	bob := env.register("bob")
+
+	upload := func(body string) int {
+		w := env.do(request{method: http.MethodPost, path: "/api/user/orders", body: body, contentType: "application/json", token: alice})
+		return w.Code
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"malformed json", `{"number":`, http.StatusBadRequest},
+		{"negative total", `{"number":"12345678903","total":-1}`, http.StatusBadRequest},
+		{"negative price", `{"number":"12345678903","goods":[{"description":"Утюг","price":-1}]}`, http.StatusBadRequest},
+		{"missing description", `{"number":"12345678903","goods":[{"price":1}]}`, http.StatusBadRequest},
+		{"bad number", `{"number":"12345678900"}`, http.StatusUnprocessableEntity},
+		{"accepted", `{"number":"12345678903","total":10000,"goods":[{"description":"Чайник Bork","price":7000},{"description":"Утюг","price":3000}]}`, http.StatusAccepted},
+		{"number only", `{"number":"9278923470"}`, http.StatusAccepted},
+		{"repeated", `{"number":"12345678903"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, upload(tt.body))
+		})
+	}
+
+	w := env.do(request{method: http.MethodGet, path: "/api/user/orders/12345678903", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var order map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &order))
+	assert.Equal(t, "NEW", order["status"])
+	assert.Equal(t, 10000.0, order["total"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"description": "Чайник Bork", "price": 7000.0},
+		map[string]interface{}{"description": "Утюг", "price": 3000.0},
+	}, order["goods"])
+
+	assert.NotContains(t, order, "attempts")
+	assert.NotContains(t, order, "last_checked_at")
+	assert.NotContains(t, order, "history")
+
+	w = env.do(request{method: http.MethodGet, path: "/api/user/orders/9278923470", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "goods")
+
+	ctx := context.Background()
+	require.NoError(t, env.orders.RecordCheck(ctx, "12345678903"))
+	_, err := env.orders.UpdateOrder(ctx, "12345678903", string(types.Processing), 0)
+	require.NoError(t, err)
+
+	w = env.do(request{method: http.MethodGet, path: "/api/user/orders/12345678903", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+	order = nil
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &order))
+	assert.Equal(t, "PROCESSING", order["status"])
+	assert.Equal(t, 1.0, order["attempts"])
+	_, err = time.Parse(time.RFC3339, order["last_checked_at"].(string))
+	assert.NoError(t, err)
+	history := order["history"].([]interface{})
+	require.Len(t, history, 1)
+	change := history[0].(map[string]interface{})
+	assert.Equal(t, "NEW", change["from"])
+	assert.Equal(t, "PROCESSING", change["to"])
+	_, err = time.Parse(time.RFC3339, change["changed_at"].(string))
+	assert.NoError(t, err)
+
+	w = env.do(request{method: http.MethodGet, path: "/api/user/orders/12345678903", token: bob})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = env.do(request{method: http.MethodGet, path: "/api/user/orders/346436439", token: alice})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestEvents(t *testing.T) {
+	hub := events.NewHub()
+	env := newTestEnvConfig(t, Config{Events: hub})
+	alice := env.register("alice")
+	token, err := auth.TokenAuth.Decode(alice)
+	require.NoError(t, err)
+	aliceID, _ := token.Get("user_id")
+
+	w := env.do(request{method: http.MethodGet, path: "/api/user/events"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	srv := httptest.NewServer(env.handler)
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/user/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+alice)
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	stream := bufio.NewReader(resp.Body)
+	next := func() (string, map[string]interface{}) {
+		t.Helper()
+		var name string
+		data := map[string]interface{}{}
+		for {
+			line, err := stream.ReadString('\n')
+			require.NoError(t, err)
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "":
+				return name, data
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data))
+			}
+		}
+	}
+
+	name, data := next()
+	assert.Equal(t, "balance", name)
+	assert.Equal(t, 0.0, data["current"])
+
+	// Events of other users are not streamed.
+	require.NoError(t, hub.Publish(ctx, types.Event{Type: types.EventBalance, UserID: "bob"}))
+
+	env.accrue(alice, "12345678903", 500)
+	require.NoError(t, hub.Publish(ctx, types.Event{
+		Type:    types.EventOrder,
+		UserID:  aliceID.(string),
+		Order:   "12345678903",
+		Status:  types.Processed,
+		Accrual: 500,
+	}))
+	require.NoError(t, hub.Publish(ctx, types.Event{Type: types.EventBalance, UserID: aliceID.(string)}))
+
+	name, data = next()
+	assert.Equal(t, "order", name)
+	assert.Equal(t, map[string]interface{}{"number": "12345678903", "status": "PROCESSED", "accrual": 500.0}, data)
+
+	name, data = next()
+	assert.Equal(t, "balance", name)
+	assert.Equal(t, 500.0, data["current"])
+}
+
+func TestBalanceEvents(t *testing.T) {
+	hub := events.NewHub()
+	env := newTestEnvConfig(t, Config{Events: hub, AdminToken: "admin-secret"})
+	subscribe := func(login string) (string, <-chan types.Event) {
+		token := env.register(login)
+		jwt, err := auth.TokenAuth.Decode(token)
+		require.NoError(t, err)
+		userID, _ := jwt.Get("user_id")
+		stream, unsubscribe := hub.Subscribe(userID.(string))
+		t.Cleanup(unsubscribe)
+		return token, stream
+	}
+	alice, aliceEvents := subscribe("alice")
+	_, bobEvents := subscribe("bob")
+	// The hub delivers synchronously, so the events of a request are queued
+	// once it is served.
+	published := func(stream <-chan types.Event) bool {
+		select {
+		case event := <-stream:
+			return event.Type == types.EventBalance
+		default:
+			return false
+		}
+	}
+	env.accrue(alice, "12345678903", 100)
+
+	w := env.do(request{method: http.MethodPost, path: "/api/user/balance/withdraw", body: `{"order":"2377225624","sum":500}`, contentType: "application/json", token: alice})
+	require.Equal(t, http.StatusPaymentRequired, w.Code)
+	assert.False(t, published(aliceEvents), "rejected withdrawal")
+
+	w = env.do(request{method: http.MethodPost, path: "/api/user/balance/withdraw", body: `{"order":"2377225624","sum":30}`, contentType: "application/json", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, published(aliceEvents), "withdrawal")
+
+	w = env.do(request{method: http.MethodPost, path: "/api/user/balance/transfer", body: `{"recipient":"bob","sum":20}`, contentType: "application/json", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, published(aliceEvents), "transfer sender")
+	assert.True(t, published(bobEvents), "transfer recipient")
+
+	w = env.do(request{method: http.MethodGet, path: "/api/user/withdrawals", token: alice})
+	var withdrawals []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &withdrawals))
+	require.Len(t, withdrawals, 1)
+	w = env.do(request{method: http.MethodPost, path: fmt.Sprintf("/api/admin/withdrawals/%v/reverse", withdrawals[0]["id"]), body: `{"reason":"cancelled"}`, contentType: "application/json", token: "admin-secret"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "user_id")
+	assert.True(t, published(aliceEvents), "reversal")
+	assert.False(t, published(bobEvents))
+}
+
+func TestAccrualEngineRegistration(t *testing.T) {
+	engine := accrual.NewEngine(memory.NewAccrualRepository(memory.New()), 0)
+	env := newTestEnvConfig(t, Config{Accrual: engine})
+	alice := env.register("alice")
+	ctx := context.Background()
+
+	w := env.do(request{method: http.MethodPost, path: "/api/user/orders", body: "12345678903", contentType: "text/plain", token: alice})
+	require.Equal(t, http.StatusAccepted, w.Code)
+	w = env.do(request{method: http.MethodPost, path: "/api/user/orders", body: "12345678903", contentType: "text/plain", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+	w = env.do(request{method: http.MethodPost, path: "/api/user/orders/batch", body: `["12345678903","9278923470"]`, contentType: "application/json", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	for _, number := range []string{"12345678903", "9278923470"} {
+		resp, err := engine.GetOrder(ctx, number)
+		require.NoError(t, err, number)
+		assert.Equal(t, string(types.Processed), resp.Status)
+	}
+
+	// Goods of JSON uploads are passed on to the engine.
+	require.NoError(t, engine.RegisterReward(ctx, types.Reward{Match: "Bork", Reward: 10, RewardType: types.RewardPercent}))
+	w = env.do(request{method: http.MethodPost, path: "/api/user/orders", body: `{"number":"346436439","goods":[{"description":"Чайник Bork","price":7000}]}`, contentType: "application/json", token: alice})
+	require.Equal(t, http.StatusAccepted, w.Code)
+	resp, err := engine.GetOrder(ctx, "346436439")
+	require.NoError(t, err)
+	assert.InDelta(t, 700, resp.Accrual, 1e-9)
+}
+
+func TestReverseWithdrawal(t *testing.T) {
+	env := newTestEnvConfig(t, Config{AdminToken: "admin-secret"})
+	alice := env.register("alice")
+	env.accrue(alice, "12345678903", 100)
+	w := env.do(request{method: http.MethodPost, path: "/api/user/balance/withdraw", body: `{"order":"2377225624","sum":30}`, contentType: "application/json", token: alice})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = env.do(request{method: http.MethodGet, path: "/api/user/withdrawals", token: alice})
+	var withdrawals []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &withdrawals))
+	require.Len(t, withdrawals, 1)
+	assert.Equal(t, "ACTIVE", withdrawals[0]["status"])
+	path := fmt.Sprintf("/api/admin/withdrawals/%v/reverse", withdrawals[0]["id"])
+
+	reverse := func(path, body, token string) *httptest.ResponseRecorder {
+		return env.do(request{method: http.MethodPost, path: path, body: body, contentType: "application/json", token: token})
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		body  string
+		token string
+		want  int
+	}{
+		{"no token", path, `{"reason":"cancelled"}`, "", http.StatusUnauthorized},
+		{"user token", path, `{"reason":"cancelled"}`, alice, http.StatusUnauthorized},
+		{"bad id", "/api/admin/withdrawals/abc/reverse", `{"reason":"cancelled"}`, "admin-secret", http.StatusBadRequest},
+		{"missing reason", path, `{"reason":" "}`, "admin-secret", http.StatusBadRequest},
+		{"unknown withdrawal", "/api/admin/withdrawals/999/reverse", `{"reason":"cancelled"}`, "admin-secret", http.StatusNotFound},
+		{"reversed", path, `{"reason":"order cancelled"}`, "admin-secret", http.StatusOK},
+		{"reversed twice", path, `{"reason":"order cancelled"}`, "admin-secret", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, reverse(tt.path, tt.body, tt.token).Code)
+		})
+	}
+
+	w = env.do(request{method: http.MethodGet, path: "/api/user/balance", token: alice})
+	assert.JSONEq(t, `{"current":100,"withdrawn":0}`, w.Body.String())
+
+	w = env.do(request{method: http.MethodGet, path: "/api/user/withdrawals", token: alice})
+	withdrawals = nil
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &withdrawals))
+	require.Len(t, withdrawals, 1)
+	assert.Equal(t, "REVERSED", withdrawals[0]["status"])
+	assert.Equal(t, "order cancelled", withdrawals[0]["reason"])
+	_, err := time.Parse(time.RFC3339, withdrawals[0]["reversed_at"].(string))
+	assert.NoError(t, err)
+
+	// Without a token the admin endpoints do not exist.
+	env = newTestEnv(t)
+	w = reverse("/api/admin/withdrawals/1/reverse", `{"reason":"cancelled"}`, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestWebhooks(t *testing.T) {
+	env := newTestEnvConfig(t, Config{
+		AdminToken: "admin-secret",
+		Validators: types.NewValidators(nil, map[string]types.Validator{"acme": types.LuhnValidator{}}),
+	})
+	ctx := context.Background()
+
+	admin := func(method, path, body string) *httptest.ResponseRecorder {
+		return env.do(request{method: method, path: path, body: body, contentType: "application/json", token: "admin-secret"})
+	}
+
+	w := env.do(request{method: http.MethodGet, path: "/api/admin/webhooks", token: "wrong"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, http.StatusNoContent, admin(http.MethodGet, "/api/admin/webhooks", "").Code)
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"malformed json", `{"merchant_id":`, http.StatusBadRequest},
+		{"missing merchant", `{"url":"https://acme.example/hook"}`, http.StatusBadRequest},
+		{"unknown merchant", `{"merchant_id":"other","url":"https://acme.example/hook"}`, http.StatusBadRequest},
+		{"relative url", `{"merchant_id":"acme","url":"/hook"}`, http.StatusBadRequest},
+		{"unknown event", `{"merchant_id":"acme","url":"https://acme.example/hook","events":["order.lost"]}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, admin(http.MethodPost, "/api/admin/webhooks", tt.body).Code)
+		})
+	}
+
+	w = admin(http.MethodPost, "/api/admin/webhooks", `{"merchant_id":"acme","url":"https://acme.example/hook"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Len(t, created["secret"], 2*webhookSecretSize)
+	assert.Equal(t, []interface{}{"order.processed", "order.invalid", "points.spent"}, created["events"])
+	id := created["id"].(float64)
+
+	w = admin(http.MethodGet, "/api/admin/webhooks", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "secret")
+
+	// Points spent at the merchant are queued for its webhook.
+	alice := env.register("alice")
+	env.accrue(alice, "12345678903", 100)
+	withdraw := func(path string) int {
+		return env.do(request{method: http.MethodPost, path: path, body: `{"order":"2377225624","sum":30}`, contentType: "application/json", token: alice}).Code
+	}
+	assert.Equal(t, http.StatusBadRequest, withdraw("/api/user/balance/withdraw?merchant=other"))
+	assert.Equal(t, http.StatusOK, withdraw("/api/user/balance/withdraw?merchant=acme"))
+
+	deliveries, err := env.webhooks.ClaimDeliveries(ctx, 10, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, types.WebhookPointsSpent, deliveries[0].Event)
+	require.NoError(t, env.webhooks.FailDelivery(ctx, deliveries[0].ID, "unexpected status 500", 0))
+
+	w = admin(http.MethodGet, "/api/admin/webhooks/deliveries/dead", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var dead []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &dead))
+	require.Len(t, dead, 1)
+	assert.Equal(t, "DEAD", dead[0]["status"])
+	assert.Equal(t, "unexpected status 500", dead[0]["last_error"])
+	assert.Equal(t, "2377225624", dead[0]["payload"].(map[string]interface{})["order"])
+
+	replay := fmt.Sprintf("/api/admin/webhooks/deliveries/%v/replay", dead[0]["id"])
+	assert.Equal(t, http.StatusAccepted, admin(http.MethodPost, replay, "").Code)
+	assert.Equal(t, http.StatusNotFound, admin(http.MethodPost, replay, "").Code)
+	assert.Equal(t, http.StatusBadRequest, admin(http.MethodPost, "/api/admin/webhooks/deliveries/abc/replay", "").Code)
+	assert.Equal(t, http.StatusNoContent, admin(http.MethodGet, "/api/admin/webhooks/deliveries/dead", "").Code)
+
+	path := fmt.Sprintf("/api/admin/webhooks/%v", id)
+	assert.Equal(t, http.StatusNoContent, admin(http.MethodDelete, path, "").Code)
+	assert.Equal(t, http.StatusNotFound, admin(http.MethodDelete, path, "").Code)
+	assert.Equal(t, http.StatusBadRequest, admin(http.MethodDelete, "/api/admin/webhooks/abc", "").Code)
+}
+
+var errStorage = errors.New("storage is down")
+
+type failingUsers struct{}
+
+func (failingUsers) CreateUser(context.Context, *types.User) error { return errStorage }
+func (failingUsers) GetByLogin(context.Context, string) (*types.User, error) {
+	return nil, errStorage
+}
+
+type failingOrders struct{}
+
+func (failingOrders) CreateOrder(context.Context, *types.Order) error { return errStorage }
+func (failingOrders) GetOrder(context.Context, string, string) (*types.Order, error) {
+	return nil, errStorage
+}
+func (failingOrders) CreateOrders(context.Context, []types.Order) ([]types.OrderUploadResult, error) {
+	return nil, errStorage
+}
+func (failingOrders) UpdateOrder(context.Context, string, string, float64) (float64, error) {
+	return 0, errStorage
+}
+func (failingOrders) RecordCheck(context.Context, string) error { return errStorage }
+func (failingOrders) GetOrdersByUser(context.Context, string) ([]types.Order, error) {
+	return nil, errStorage
+}
+func (failingOrders) GetProcessedOrdersByUser(context.Context, string) ([]types.Order, error) {
+	return nil, errStorage
+}
+func (failingOrders) GetPendingOrdersNumbers(context.Context) ([]types.Order, error) {
+	return nil, errStorage
+}
+
+type failingWithdrawals struct{}
+
+func (failingWithdrawals) CreateWithdrawal(context.Context, string, string, string, float64) error {
+	return errStorage
+}
+func (failingWithdrawals) GetBalance(context.Context, string) (*types.UserBalance, error) {
+	return nil, errStorage
+}
+func (failingWithdrawals) GetWithdrawalsByUser(context.Context, string) ([]types.Withdrawal, error) {
+	return nil, errStorage
+}
+func (failingWithdrawals) ReverseWithdrawal(context.Context, int64, string) (*types.Withdrawal, error) {
+	return nil, errStorage
+}
+func (failingWithdrawals) CreateTransfer(context.Context, string, string, float64, types.TransferLimit) error {
+	return errStorage
+}
+func (failingWithdrawals) GetTransfersByUser(context.Context, string) ([]types.Transfer, error) {
+	return nil, errStorage
+}
+func (failingWithdrawals) GetExpiringPoints(context.Context, string, time.Time) (float64, error) {
+	return 0, errStorage
+}
+func (failingWithdrawals) ExpirePoints(context.Context, time.Time) (map[string]float64, error) {
+	return nil, errStorage
+}
+func (failingWithdrawals) GetTransactions(context.Context, string, types.TransactionFilter) ([]types.Transaction, error) {
+	return nil, errStorage
+}
+func (failingWithdrawals) WriteStatement(context.Context, string, time.Time, time.Time, types.StatementWriter) error {
+	return errStorage
+}
+
+type failingWebhooks struct{}
+
+func (failingWebhooks) CreateWebhook(context.Context, *types.Webhook) error { return errStorage }
+func (failingWebhooks) GetWebhooks(context.Context) ([]types.Webhook, error) {
+	return nil, errStorage
+}
+func (failingWebhooks) DeleteWebhook(context.Context, int64) error { return errStorage }
+func (failingWebhooks) ClaimDeliveries(context.Context, int, time.Duration) ([]types.WebhookDelivery, error) {
+	return nil, errStorage
+}
+func (failingWebhooks) CompleteDelivery(context.Context, int64) error { return errStorage }
+func (failingWebhooks) FailDelivery(context.Context, int64, string, time.Duration) error {
+	return errStorage
+}
+func (failingWebhooks) GetDeadDeliveries(context.Context) ([]types.WebhookDelivery, error) {
+	return nil, errStorage
+}
+func (failingWebhooks) ReplayDelivery(context.Context, int64) error { return errStorage }
+
+func TestStorageErrors(t *testing.T) {
+	env := &testEnv{t: t, handler: SetupRouter(zap.NewNop(), failingUsers{}, failingOrders{}, failingWithdrawals{}, Config{
+		AdminToken: "admin",
+		Events:     events.NewHub(),
+		Webhooks:   failingWebhooks{},
+		Validators: types.NewValidators(nil, map[string]types.Validator{"acme": types.LuhnValidator{}}),
+	})}
+
+	token, err := auth.GenerateToken("user")
+	require.NoError(t, err)
+
+	routes := []request{
+		{method: http.MethodPost, path: "/api/user/register", body: `{"login":"a","password":"b"}`, contentType: "application/json"},
+		{method: http.MethodPost, path: "/api/user/login", body: `{"login":"a","password":"b"}`, contentType: "application/json"},
+		{method: http.MethodPost, path: "/api/user/orders", body: "12345678903", contentType: "text/plain", token: token},
+		{method: http.MethodPost, path: "/api/user/orders/batch", body: `["12345678903"]`, contentType: "application/json", token: token},
+		{method: http.MethodGet, path: "/api/user/orders", token: token},
+		{method: http.MethodGet, path: "/api/user/orders/12345678903", token: token},
+		{method: http.MethodGet, path: "/api/user/balance", token: token},
+		{method: http.MethodGet, path: "/api/user/events", token: token},
+		{method: http.MethodPost, path: "/api/user/balance/withdraw", body: `{"order":"2377225624","sum":1}`, contentType: "application/json", token: token},
+		{method: http.MethodGet, path: "/api/user/withdrawals", token: token},
+		{method: http.MethodPost, path: "/api/user/balance/transfer", body: `{"recipient":"bob","sum":1}`, contentType: "application/json", token: token},
+		{method: http.MethodGet, path: "/api/user/transfers", token: token},
+		{method: http.MethodGet, path: "/api/user/transactions", token: token},
+		{method: http.MethodGet, path: "/api/user/statement?from=2024-01-01T00:00:00Z&to=2024-02-01T00:00:00Z", token: token},
+		{method: http.MethodPost, path: "/api/admin/withdrawals/1/reverse", body: `{"reason":"cancelled"}`, contentType: "application/json", token: "admin"},
+		{method: http.MethodPost, path: "/api/admin/webhooks", body: `{"merchant_id":"acme","url":"https://acme.example/hook"}`, contentType: "application/json", token: "admin"},
+		{method: http.MethodGet, path: "/api/admin/webhooks", token: "admin"},
+		{method: http.MethodDelete, path: "/api/admin/webhooks/1", token: "admin"},
+		{method: http.MethodGet, path: "/api/admin/webhooks/deliveries/dead", token: "admin"},
+		{method: http.MethodPost, path: "/api/admin/webhooks/deliveries/1/replay", token: "admin"},
+	}
+	for _, route := range routes {
+		t.Run(route.method+" "+route.path, func(t *testing.T) {
+			assert.Equal(t, http.StatusInternalServerError, env.do(route).Code)
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/gofermart/internal/auth"
+	"github.com/shevchukeugeni/gofermart/internal/logging"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+// Formats of the statement export.
+const (
+	statementCSV  = "csv"
+	statementJSON = "json"
+)
+
+// maxStatementPeriod bounds the range of a statement, which is read in a
+// single transaction holding a database connection while it is written.
+const maxStatementPeriod = 366 * 24 * time.Hour
+
+// statement exports the transactions of the user made between the from
+// and to query parameters, at most maxStatementPeriod apart, with the
+// balances at both ends, as a CSV or JSON attachment. The statement is
+// written as it is read from the store.
+func (ro *router) statement(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	filter, err := parseTransactionRange(r)
+	switch {
+	case err != nil:
+	case filter.From.IsZero() || filter.To.IsZero():
+		err = errors.New("Incorrect range: from and to are required")
+	case filter.To.Sub(filter.From) > maxStatementPeriod:
+		err = errors.New("Incorrect range: must not exceed 366 days")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = statementJSON
+	}
+	sw := &statementWriter{w: w, from: filter.From, to: filter.To, format: format}
+	switch format {
+	case statementCSV:
+		sw.csv = csv.NewWriter(w)
+	case statementJSON:
+	default:
+		http.Error(w, "Incorrect format: must be csv or json", http.StatusBadRequest)
+		return
+	}
+
+	// A long statement takes longer to write than the server's write
+	// timeout allows.
+	err = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		ro.internalError(w, r, "Unable to get statement", err)
+		return
+	}
+
+	err = ro.withdrawalRepo.WriteStatement(r.Context(), userID, filter.From, filter.To, sw)
+	if err != nil {
+		if !sw.started {
+			ro.internalError(w, r, "Unable to get statement", err)
+			return
+		}
+		logging.FromContext(r.Context()).Error("Unable to write statement", zap.Error(err))
+		// The status is sent already. Breaking the connection keeps the
+		// client from taking the statement for complete.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+var statementCSVHeader = []string{"processed_at", "type", "order", "counterparty", "amount", "balance", "withdrawn"}
+
+// statementWriter writes a statement to the response in its format. The
+// opening and closing balances of a CSV statement are rows of the types
+// OPENING and CLOSING.
+type statementWriter struct {
+	w       http.ResponseWriter
+	csv     *csv.Writer
+	from    time.Time
+	to      time.Time
+	format  string
+	started bool
+	first   bool
+}
+
+func (sw *statementWriter) WriteOpening(balance types.UserBalance) error {
+	filename := "statement-" + sw.from.Format("2006-01-02") + "-" + sw.to.Format("2006-01-02") + "." + sw.format
+	if sw.format == statementCSV {
+		sw.w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		sw.w.Header().Set("Content-Type", "application/json")
+	}
+	sw.w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	sw.w.WriteHeader(http.StatusOK)
+	sw.started = true
+
+	if sw.csv != nil {
+		if err := sw.csv.Write(statementCSVHeader); err != nil {
+			return err
+		}
+		return sw.writeBalance("OPENING", sw.from, balance)
+	}
+
+	from, _ := json.Marshal(sw.from.Format(time.RFC3339))
+	to, _ := json.Marshal(sw.to.Format(time.RFC3339))
+	opening, err := json.Marshal(balance)
+	if err != nil {
+		return err
+	}
+	_, err = sw.w.Write([]byte(`{"from":` + string(from) + `,"to":` + string(to) +
+		`,"opening_balance":` + string(opening) + `,"transactions":[`))
+	sw.first = true
+	return err
+}
+
+func (sw *statementWriter) WriteTransaction(t *types.Transaction) error {
+	if sw.csv != nil {
+		return sw.csv.Write([]string{
+			t.ProcessedAt.Format(time.RFC3339),
+			string(t.Type),
+			t.Order,
+			t.Counterparty,
+			formatPoints(t.Amount),
+			formatPoints(t.Balance),
+			"",
+		})
+	}
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if !sw.first {
+		data = append([]byte{','}, data...)
+	}
+	sw.first = false
+	_, err = sw.w.Write(data)
+	return err
+}
+
+func (sw *statementWriter) WriteClosing(balance types.UserBalance) error {
+	if sw.csv != nil {
+		if err := sw.writeBalance("CLOSING", sw.to, balance); err != nil {
+			return err
+		}
+		sw.csv.Flush()
+		return sw.csv.Error()
+	}
+
+	closing, err := json.Marshal(balance)
+	if err != nil {
+		return err
+	}
+	_, err = sw.w.Write([]byte(`],"closing_balance":` + string(closing) + "}\n"))
+	return err
+}
+
+func (sw *statementWriter) writeBalance(kind string, at time.Time, balance types.UserBalance) error {
+	return sw.csv.Write([]string{
+		at.Format(time.RFC3339), kind, "", "", "", formatPoints(balance.Current), formatPoints(balance.Withdrawn),
+	})
+}
+
+func formatPoints(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shevchukeugeni/gofermart/internal/auth"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+// Page sizes of the transaction history.
+const (
+	defaultTransactionsLimit = 50
+	maxTransactionsLimit     = 500
+)
+
+// transactions lists the balance changes of the user, oldest first, a page
+// at a time. The optional from and to parameters are RFC3339 times bounding
+// the range, to being exclusive; limit and offset select the page.
+func (ro *router) transactions(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	filter, err := parseTransactionRange(r)
+	if err == nil {
+		filter.Limit, filter.Offset, err = parsePage(r)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ret, err := ro.withdrawalRepo.GetTransactions(r.Context(), userID, filter)
+	if err != nil {
+		ro.internalError(w, r, "Unable to get transactions", err)
+		return
+	}
+
+	if len(ret) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(ret)
+	if err != nil {
+		ro.internalError(w, r, "Can't marshal data", err)
+		return
+	}
+}
+
+// parseTransactionRange reads the from and to query parameters.
+func parseTransactionRange(r *http.Request) (types.TransactionFilter, error) {
+	var filter types.TransactionFilter
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{
+		{"from", &filter.From},
+		{"to", &filter.To},
+	} {
+		v := r.URL.Query().Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, fmt.Errorf("Incorrect %s: must be an RFC3339 time", p.name)
+		}
+		*p.dst = t
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return filter, errors.New("Incorrect range: from must be before to")
+	}
+	return filter, nil
+}
+
+// parsePage reads the limit and offset query parameters.
+func parsePage(r *http.Request) (limit, offset int, err error) {
+	limit = defaultTransactionsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxTransactionsLimit {
+			return 0, 0, fmt.Errorf("Incorrect limit: must be between 1 and %d", maxTransactionsLimit)
+		}
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("Incorrect offset: must not be negative")
+		}
+	}
+	return limit, offset, nil
+}
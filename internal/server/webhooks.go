@@ -0,0 +1,147 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+// webhookSecretSize is the number of random bytes in a webhook secret.
+const webhookSecretSize = 32
+
+// createWebhook registers a webhook of a configured merchant. The response
+// is the only place its signing secret is shown.
+func (ro *router) createWebhook(w http.ResponseWriter, r *http.Request) {
+	var req types.WebhookRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Unable to decode json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = req.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err = ro.validators.For(req.MerchantID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Events) == 0 {
+		req.Events = types.WebhookEvents
+	}
+
+	secret := make([]byte, webhookSecretSize)
+	if _, err = rand.Read(secret); err != nil {
+		ro.internalError(w, r, "Unable to generate secret", err)
+		return
+	}
+
+	webhook := &types.Webhook{
+		MerchantID: req.MerchantID,
+		URL:        req.URL,
+		Secret:     hex.EncodeToString(secret),
+		Events:     req.Events,
+	}
+	err = ro.cfg.Webhooks.CreateWebhook(r.Context(), webhook)
+	if err != nil {
+		ro.internalError(w, r, "Unable to create webhook", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(webhook)
+	if err != nil {
+		ro.internalError(w, r, "Can't marshal data", err)
+		return
+	}
+}
+
+func (ro *router) webhooksList(w http.ResponseWriter, r *http.Request) {
+	ret, err := ro.cfg.Webhooks.GetWebhooks(r.Context())
+	if err != nil {
+		ro.internalError(w, r, "Unable to get webhooks", err)
+		return
+	}
+
+	if len(ret) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(ret)
+	if err != nil {
+		ro.internalError(w, r, "Can't marshal data", err)
+		return
+	}
+}
+
+func (ro *router) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Incorrect webhook id", http.StatusBadRequest)
+		return
+	}
+
+	err = ro.cfg.Webhooks.DeleteWebhook(r.Context(), id)
+	switch {
+	case errors.Is(err, types.ErrNotFound):
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+	case err != nil:
+		ro.internalError(w, r, "Unable to delete webhook", err)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// deadDeliveries lists the deliveries that ran out of attempts.
+func (ro *router) deadDeliveries(w http.ResponseWriter, r *http.Request) {
+	ret, err := ro.cfg.Webhooks.GetDeadDeliveries(r.Context())
+	if err != nil {
+		ro.internalError(w, r, "Unable to get deliveries", err)
+		return
+	}
+
+	if len(ret) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(ret)
+	if err != nil {
+		ro.internalError(w, r, "Can't marshal data", err)
+		return
+	}
+}
+
+// replayDelivery queues a dead delivery for another round of attempts.
+func (ro *router) replayDelivery(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Incorrect delivery id", http.StatusBadRequest)
+		return
+	}
+
+	err = ro.cfg.Webhooks.ReplayDelivery(r.Context(), id)
+	switch {
+	case errors.Is(err, types.ErrNotFound):
+		http.Error(w, "Dead delivery not found", http.StatusNotFound)
+	case err != nil:
+		ro.internalError(w, r, "Unable to replay delivery", err)
+	default:
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,115 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+// Content types of the v2 API of the Confluent REST proxy.
+const (
+	kafkaContentType = "application/vnd.kafka.json.v2+json"
+	kafkaAccept      = "application/vnd.kafka.v2+json"
+)
+
+// kafkaSink produces events to Kafka through a Confluent REST proxy
+// speaking the v2 API; it cannot reach a Kafka broker directly. Records are keyed by
+// the user ID, so the events of a user share a partition and stay in order.
+type kafkaSink struct {
+	endpoint string
+	client   *http.Client
+}
+
+type kafkaRecord struct {
+	Key   string             `json:"key"`
+	Value *types.OutboxEvent `json:"value"`
+}
+
+type kafkaResponse struct {
+	Offsets []struct {
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+// NewKafkaREST returns a sink producing to topic through the Confluent REST
+// proxy at rawURL, for example http://localhost:8082.
+func NewKafkaREST(rawURL, topic string, timeout time.Duration) (Sink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("kafka-rest url must be the http(s) URL of a Confluent REST proxy")
+	}
+	if topic == "" {
+		return nil, errors.New("kafka-rest topic must be set")
+	}
+
+	return &kafkaSink{
+		endpoint: strings.TrimSuffix(rawURL, "/") + "/topics/" + url.PathEscape(topic),
+		client:   &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (s *kafkaSink) Publish(ctx context.Context, events []types.OutboxEvent) (int, error) {
+	records := make([]kafkaRecord, 0, len(events))
+	for i := range events {
+		records = append(records, kafkaRecord{Key: events[i].UserID, Value: &events[i]})
+	}
+	body, err := json.Marshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", kafkaContentType)
+	req.Header.Set("Accept", kafkaAccept)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return 0, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	var ret kafkaResponse
+	if err = json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return 0, fmt.Errorf("decode response: %w", err)
+	}
+	// Offsets come in the order of the records; the events before the first
+	// failed one are delivered.
+	for i, o := range ret.Offsets {
+		if i == len(events) {
+			break
+		}
+		if o.ErrorCode != nil {
+			return i, fmt.Errorf("produce event %d: %s (code %d)", events[i].ID, o.Error, *o.ErrorCode)
+		}
+	}
+	if len(ret.Offsets) < len(events) {
+		return len(ret.Offsets), fmt.Errorf("proxy acknowledged %d of %d events", len(ret.Offsets), len(events))
+	}
+	return len(events), nil
+}
+
+func (s *kafkaSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
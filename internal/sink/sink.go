@@ -0,0 +1,56 @@
+// Package sink delivers outbox events to downstream systems.
+package sink
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+const (
+	KindNone   = "none"
+	KindStdout = "stdout"
+	KindFile   = "file"
+	// KindKafkaREST produces to Kafka through a Confluent REST proxy; the
+	// service does not speak the Kafka protocol itself.
+	KindKafkaREST = "kafka-rest"
+)
+
+// Sink delivers events in order. Publish reports how many events were
+// delivered before it failed; an event counts as delivered once the
+// downstream system has acknowledged it, so a failed batch may leave
+// duplicates behind but never gaps.
+type Sink interface {
+	Publish(ctx context.Context, events []types.OutboxEvent) (int, error)
+	Close() error
+}
+
+type Config struct {
+	Kind string
+	// Path is the file of the file sink.
+	Path string
+	// URL is the Confluent REST proxy of the kafka-rest sink.
+	URL string
+	// Topic is the Kafka topic of the kafka-rest sink.
+	Topic   string
+	Timeout time.Duration
+}
+
+// Open creates the sink of cfg.Kind. It returns nil for KindNone.
+func Open(cfg Config) (Sink, error) {
+	switch cfg.Kind {
+	case "", KindNone:
+		return nil, nil
+	case KindStdout:
+		return NewWriter(os.Stdout), nil
+	case KindFile:
+		return OpenFile(cfg.Path)
+	case KindKafkaREST:
+		return NewKafkaREST(cfg.URL, cfg.Topic, cfg.Timeout)
+	default:
+		return nil, fmt.Errorf("unknown sink %q", cfg.Kind)
+	}
+}
@@ -0,0 +1,130 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+var testEvents = []types.OutboxEvent{
+	{ID: 1, Type: types.OutboxUserRegistered, UserID: "u1", Payload: json.RawMessage(`{"login":"alice"}`), CreatedAt: time.Now()},
+	{ID: 2, Type: types.OutboxOrderUploaded, UserID: "u1", Payload: json.RawMessage(`{"number":"12345678903"}`), CreatedAt: time.Now()},
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewWriter(&buf)
+
+	n, err := s.Publish(context.Background(), testEvents)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	var got types.OutboxEvent
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &got))
+	assert.Equal(t, int64(2), got.ID)
+	assert.Equal(t, types.OutboxOrderUploaded, got.Type)
+	assert.JSONEq(t, `{"number":"12345678903"}`, string(got.Payload))
+}
+
+type failingWriter struct{ left int }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.left == 0 {
+		return 0, io.ErrShortWrite
+	}
+	w.left--
+	return len(p), nil
+}
+
+func TestWriterPartialFailure(t *testing.T) {
+	n, err := NewWriter(&failingWriter{left: 1}).Publish(context.Background(), testEvents)
+	assert.ErrorIs(t, err, io.ErrShortWrite)
+	assert.Equal(t, 1, n)
+}
+
+func TestFileSyncFailure(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "events.jsonl"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Writes succeed but the file cannot be synced: the unsynced event is
+	// not reported as delivered, the ones before it are.
+	var buf bytes.Buffer
+	s := &writerSink{w: &buf, file: f}
+	n, err := s.Publish(context.Background(), testEvents)
+	assert.ErrorIs(t, err, os.ErrClosed)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+}
+
+func TestKafkaREST(t *testing.T) {
+	var (
+		failAt = -1
+		got    struct {
+			Records []struct {
+				Key   string            `json:"key"`
+				Value types.OutboxEvent `json:"value"`
+			} `json:"records"`
+		}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/topics/gophermart.events", r.URL.Path)
+		assert.Equal(t, kafkaContentType, r.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+
+		offsets := make([]map[string]interface{}, len(got.Records))
+		for i := range offsets {
+			offsets[i] = map[string]interface{}{"partition": 0, "offset": i, "error_code": nil, "error": nil}
+			if i == failAt {
+				offsets[i]["error_code"], offsets[i]["error"] = 50003, "Kafka error"
+			}
+		}
+		w.Header().Set("Content-Type", kafkaAccept)
+		json.NewEncoder(w).Encode(map[string]interface{}{"offsets": offsets})
+	}))
+	defer srv.Close()
+
+	s, err := NewKafkaREST(srv.URL, "gophermart.events", time.Second)
+	require.NoError(t, err)
+	defer s.Close()
+
+	n, err := s.Publish(context.Background(), testEvents)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	require.Len(t, got.Records, 2)
+	assert.Equal(t, "u1", got.Records[0].Key)
+	assert.Equal(t, int64(2), got.Records[1].Value.ID)
+
+	failAt = 1
+	n, err = s.Publish(context.Background(), testEvents)
+	assert.ErrorContains(t, err, "Kafka error")
+	assert.Equal(t, 1, n)
+}
+
+func TestOpen(t *testing.T) {
+	s, err := Open(Config{Kind: KindNone})
+	require.NoError(t, err)
+	assert.Nil(t, s)
+
+	_, err = Open(Config{Kind: "carrier-pigeon"})
+	assert.Error(t, err)
+
+	// A directory cannot be opened for appending.
+	_, err = Open(Config{Kind: KindFile, Path: t.TempDir()})
+	assert.Error(t, err)
+}
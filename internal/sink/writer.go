@@ -0,0 +1,62 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+// writerSink writes events as JSON lines.
+type writerSink struct {
+	mu   sync.Mutex
+	w    io.Writer
+	file *os.File
+}
+
+// NewWriter returns a sink writing to w. Close does not close w.
+func NewWriter(w io.Writer) Sink {
+	return &writerSink{w: w}
+}
+
+// OpenFile returns a sink appending to the file at path. Every event is
+// synced to disk before it counts as delivered, so a failed sync leaves at
+// most that event to be written again.
+func OpenFile(path string) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &writerSink{w: f, file: f}, nil
+}
+
+func (s *writerSink) Publish(_ context.Context, events []types.OutboxEvent) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range events {
+		line, err := json.Marshal(&events[i])
+		if err != nil {
+			return i, err
+		}
+		if _, err = s.w.Write(append(line, '\n')); err != nil {
+			return i, err
+		}
+		if s.file != nil {
+			if err = s.file.Sync(); err != nil {
+				return i, err
+			}
+		}
+	}
+	return len(events), nil
+}
+
+func (s *writerSink) Close() error {
+	if s.file != nil {
+		return s.file.Close()
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/store/postgres"
+	"github.com/shevchukeugeni/gofermart/internal/tracing"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+type repo struct {
+	db *pgxpool.Pool
+}
+
+// NewRepository needs a database migrated with postgres.SchemaAccrual.
+func NewRepository(db *pgxpool.Pool) store.Accrual {
+	return &repo{db: db}
+}
+
+func (repo *repo) CreateReward(ctx context.Context, reward types.Reward) (err error) {
+	ctx, span := tracing.Start(ctx, "accrual.CreateReward")
+	defer func() { tracing.End(span, err) }()
+
+	if reward.Match == "" {
+		return errors.New("repository: incorrect parameters")
+	}
+
+	_, err = repo.db.Exec(ctx,
+		"INSERT INTO accrual_rewards(match, reward, reward_type) VALUES ($1, $2, $3)",
+		reward.Match, reward.Reward, reward.RewardType)
+	return postgres.MapError(err)
+}
+
+func (repo *repo) SaveReward(ctx context.Context, reward types.Reward) (_ bool, err error) {
+	ctx, span := tracing.Start(ctx, "accrual.SaveReward")
+	defer func() { tracing.End(span, err) }()
+
+	if reward.Match == "" {
+		return false, errors.New("repository: incorrect parameters")
+	}
+
+	tag, err := repo.db.Exec(ctx, `
+		INSERT INTO accrual_rewards(match, reward, reward_type) VALUES ($1, $2, $3)
+		ON CONFLICT (match) DO UPDATE
+			SET reward = EXCLUDED.reward, reward_type = EXCLUDED.reward_type
+			WHERE (accrual_rewards.reward, accrual_rewards.reward_type) IS DISTINCT FROM (EXCLUDED.reward, EXCLUDED.reward_type)`,
+		reward.Match, reward.Reward, reward.RewardType)
+	if err != nil {
+		return false, postgres.MapError(err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (repo *repo) GetRewards(ctx context.Context) (_ []types.Reward, err error) {
+	ctx, span := tracing.Start(ctx, "accrual.GetRewards")
+	defer func() { tracing.End(span, err) }()
+
+	ret := []types.Reward{}
+	rows, err := repo.db.Query(ctx, "SELECT match, reward, reward_type FROM accrual_rewards ORDER BY id")
+	if err != nil {
+		return nil, postgres.MapError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		reward := types.Reward{}
+		err := rows.Scan(&reward.Match, &reward.Reward, &reward.RewardType)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, reward)
+	}
+
+	return ret, rows.Err()
+}
+
+func (repo *repo) RegisterOrder(ctx context.Context, number string, goods []types.Good) (err error) {
+	ctx, span := tracing.Start(ctx, "accrual.RegisterOrder")
+	defer func() { tracing.End(span, err) }()
+
+	if number == "" {
+		return errors.New("repository: incorrect parameters")
+	}
+	if goods == nil {
+		goods = []types.Good{}
+	}
+
+	data, err := json.Marshal(goods)
+	if err != nil {
+		return err
+	}
+
+	_, err = repo.db.Exec(ctx,
+		"INSERT INTO accrual_orders(number, goods, status) VALUES ($1, $2, $3)",
+		number, data, types.Registered)
+	return postgres.MapError(err)
+}
+
+func (repo *repo) GetAccrualOrder(ctx context.Context, number string) (_ *types.AccrualOrder, err error) {
+	ctx, span := tracing.Start(ctx, "accrual.GetAccrualOrder")
+	defer func() { tracing.End(span, err) }()
+
+	if number == "" {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	order := &types.AccrualOrder{Number: number}
+	var data []byte
+	err = repo.db.QueryRow(ctx,
+		"SELECT goods, status, COALESCE(accrual, 0), registered_at FROM accrual_orders WHERE number=$1",
+		number).Scan(&data, &order.Status, &order.Accrual, &order.RegisteredAt)
+	if err != nil {
+		return nil, postgres.MapError(err)
+	}
+	if err = json.Unmarshal(data, &order.Goods); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func (repo *repo) SetAccrual(ctx context.Context, number string, status types.Status, accrual float64) (err error) {
+	ctx, span := tracing.Start(ctx, "accrual.SetAccrual")
+	defer func() { tracing.End(span, err) }()
+
+	if number == "" {
+		return errors.New("repository: incorrect parameters")
+	}
+
+	_, err = repo.db.Exec(ctx,
+		"UPDATE accrual_orders SET status=$2, accrual=$3 WHERE number=$1 AND status=$4",
+		number, status, accrual, types.Registered)
+	return postgres.MapError(err)
+}
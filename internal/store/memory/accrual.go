@@ -0,0 +1,111 @@
+package memory
+
+import (
+	"context"
+	"errors"
+
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+type accrualRepo struct {
+	db *DB
+}
+
+func NewAccrualRepository(db *DB) store.Accrual {
+	return &accrualRepo{db: db}
+}
+
+func (repo *accrualRepo) CreateReward(_ context.Context, reward types.Reward) error {
+	if reward.Match == "" {
+		return errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	for _, r := range repo.db.rewards {
+		if r.Match == reward.Match {
+			return types.ErrAlreadyExists
+		}
+	}
+	repo.db.rewards = append(repo.db.rewards, reward)
+	return nil
+}
+
+func (repo *accrualRepo) SaveReward(_ context.Context, reward types.Reward) (bool, error) {
+	if reward.Match == "" {
+		return false, errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	for i, r := range repo.db.rewards {
+		if r.Match == reward.Match {
+			repo.db.rewards[i] = reward
+			return r != reward, nil
+		}
+	}
+	repo.db.rewards = append(repo.db.rewards, reward)
+	return true, nil
+}
+
+func (repo *accrualRepo) GetRewards(_ context.Context) ([]types.Reward, error) {
+	repo.db.mu.RLock()
+	defer repo.db.mu.RUnlock()
+
+	return append([]types.Reward{}, repo.db.rewards...), nil
+}
+
+func (repo *accrualRepo) RegisterOrder(_ context.Context, number string, goods []types.Good) error {
+	if number == "" {
+		return errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	if _, ok := repo.db.accrualOrders[number]; ok {
+		return types.ErrAlreadyExists
+	}
+	repo.db.accrualOrders[number] = &types.AccrualOrder{
+		Number:       number,
+		Goods:        append([]types.Good{}, goods...),
+		Status:       types.Registered,
+		RegisteredAt: repo.db.now(),
+	}
+	return nil
+}
+
+func (repo *accrualRepo) GetAccrualOrder(_ context.Context, number string) (*types.AccrualOrder, error) {
+	if number == "" {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.RLock()
+	defer repo.db.mu.RUnlock()
+
+	order, ok := repo.db.accrualOrders[number]
+	if !ok {
+		return nil, types.ErrNotFound
+	}
+	ret := *order
+	ret.Goods = append([]types.Good{}, order.Goods...)
+	return &ret, nil
+}
+
+func (repo *accrualRepo) SetAccrual(_ context.Context, number string, status types.Status, accrual float64) error {
+	if number == "" {
+		return errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	if order, ok := repo.db.accrualOrders[number]; ok && order.Status == types.Registered {
+		order.Status = status
+		order.Accrual = accrual
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// Package memory implements the store interfaces on top of in-process maps.
+// It is meant for tests and demo runs and loses all data on restart.
+package memory
+
+import (
+	"sync"
+	"time"
+
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+// DB is the shared state of all memory repositories. Repositories created
+// from the same DB see each other's data, like tables of one database.
+type DB struct {
+	mu sync.RWMutex
+
+	users       map[string]types.User // by ID
+	logins      map[string]string     // login -> user ID
+	orders      map[string]*orderRecord
+	withdrawals []*types.Withdrawal // in insertion order
+	lots        []*lot              // in accrual order
+	expirations []expiration
+	transfers   []transfer          // in insertion order
+	tiers       map[string]userTier // by user ID
+	tierHistory []tierChange
+
+	rewards       []types.Reward                 // in registration order
+	accrualOrders map[string]*types.AccrualOrder // by number
+
+	webhooks   []*types.Webhook // in creation order
+	deliveries []*delivery      // in creation order
+
+	// events holds the unpublished outbox, oldest first; published events
+	// are dropped. publishMu is held by the publishing caller.
+	events    []types.OutboxEvent
+	publishMu sync.Mutex
+
+	seq         uint64
+	webhookSeq  int64
+	deliverySeq int64
+	eventSeq    int64
+
+	now func() time.Time
+}
+
+func New() *DB {
+	return &DB{
+		users:  map[string]types.User{},
+		logins: map[string]string{},
+		orders: map[string]*orderRecord{},
+		tiers:  map[string]userTier{},
+		now:    time.Now,
+
+		accrualOrders: map[string]*types.AccrualOrder{},
+	}
+}
+
+// orderRecord keeps the insertion sequence to order uploads made within the
+// same clock tick deterministically.
+type orderRecord struct {
+	types.Order
+	seq uint64
+
+	// Detail-only data, kept apart so that lists do not return it.
+	goods         []types.Good
+	attempts      int
+	lastCheckedAt *time.Time
+	history       []types.OrderStatusChange
+}
+
+// lot tracks what is left of a single accrual, see the accrual_lots table.
+type lot struct {
+	userID    string
+	order     string
+	amount    float64
+	remaining float64
+	accruedAt time.Time
+}
+
+// delivery is a row of the webhook outbox, see the webhook_deliveries table.
+type delivery struct {
+	types.WebhookDelivery
+	nextAttemptAt time.Time
+}
+
+type transfer struct {
+	senderID    string
+	recipientID string
+	sum         float64
+	createdAt   time.Time
+}
+
+type expiration struct {
+	userID    string
+	sum       float64
+	expiredAt time.Time
+}
+
+type userTier struct {
+	name       string
+	multiplier float64
+}
+
+type tierChange struct {
+	userID string
+	types.TierChange
+}
+
+// balance must be called with db.mu held.
+func (db *DB) balance(userID string) *types.UserBalance {
+	balance := new(types.UserBalance)
+	for _, order := range db.orders {
+		if order.UserID == userID && order.Status == types.Processed {
+			balance.Current += order.Accrual
+		}
+	}
+	for _, wtdrw := range db.withdrawals {
+		if wtdrw.UserID == userID && wtdrw.Status == types.WithdrawalActive {
+			balance.Withdrawn += wtdrw.Sum
+		}
+	}
+	balance.Current -= balance.Withdrawn
+	for _, exp := range db.expirations {
+		if exp.userID == userID {
+			balance.Current -= exp.sum
+		}
+	}
+	for _, t := range db.transfers {
+		switch userID {
+		case t.senderID:
+			balance.Current -= t.sum
+		case t.recipientID:
+			balance.Current += t.sum
+		}
+	}
+	return balance
+}
+
+// consumeLots spends sum from the lots of userID, oldest first. It must be
+// called with db.mu held.
+func (db *DB) consumeLots(userID string, sum float64) {
+	for _, l := range db.lots {
+		if sum <= 0 {
+			break
+		}
+		if l.userID != userID || l.remaining <= 0 {
+			continue
+		}
+		spent := l.remaining
+		if spent > sum {
+			spent = sum
+		}
+		l.remaining -= spent
+		sum -= spent
+	}
+}
@@ -0,0 +1,73 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/shevchukeugeni/gofermart/internal/store/storetest"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) storetest.Stores {
+		db := New()
+		return storetest.Stores{
+			Users:       NewUserRepository(db),
+			Orders:      NewOrderRepository(db),
+			Withdrawals: NewWithdrawalRepository(db),
+			Tiers:       NewTierRepository(db),
+			Accrual:     NewAccrualRepository(db),
+			Webhooks:    NewWebhookRepository(db),
+			Outbox:      NewOutboxRepository(db),
+		}
+	})
+}
+
+func TestLedgerTies(t *testing.T) {
+	ctx := context.Background()
+	db := New()
+	// Everything happens within one clock tick.
+	now := time.Now()
+	db.now = func() time.Time { return now }
+	users := NewUserRepository(db)
+	orders := NewOrderRepository(db)
+	withdrawals := NewWithdrawalRepository(db)
+
+	for _, login := range []string{"alice", "bob"} {
+		user := (&types.UserLoginRequest{Login: login, Password: "password"}).User().ToDB()
+		require.NoError(t, users.CreateUser(ctx, user))
+	}
+	alice, err := users.GetByLogin(ctx, "alice")
+	require.NoError(t, err)
+
+	require.NoError(t, orders.CreateOrder(ctx, &types.Order{Number: "12345678903", UserID: alice.ID}))
+	_, err = orders.UpdateOrder(ctx, "12345678903", string(types.Processed), 100)
+	require.NoError(t, err)
+	require.NoError(t, withdrawals.CreateWithdrawal(ctx, "2377225624", alice.ID, "", 30))
+	_, err = withdrawals.ReverseWithdrawal(ctx, 1, "cancelled")
+	require.NoError(t, err)
+	require.NoError(t, withdrawals.CreateTransfer(ctx, alice.ID, "bob", 20, types.TransferLimit{}))
+
+	// Ties follow the order the transactions can happen in, so the balance
+	// never dips below zero.
+	got, err := withdrawals.GetTransactions(ctx, alice.ID, types.TransactionFilter{})
+	require.NoError(t, err)
+	want := []struct {
+		typ     types.TransactionType
+		balance float64
+	}{
+		{types.TransactionAccrual, 100},
+		{types.TransactionWithdrawal, 70},
+		{types.TransactionReversal, 100},
+		{types.TransactionTransferOut, 80},
+	}
+	require.Len(t, got, len(want))
+	for i, w := range want {
+		assert.Equal(t, w.typ, got[i].Type, i)
+		assert.InDelta(t, w.balance, got[i].Balance, 1e-9, i)
+	}
+}
@@ -0,0 +1,256 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+type orderRepo struct {
+	db *DB
+}
+
+func NewOrderRepository(db *DB) store.Order {
+	return &orderRepo{db: db}
+}
+
+func (repo *orderRepo) CreateOrder(_ context.Context, order *types.Order) error {
+	if order == nil || order.UserID == "" {
+		return errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	if _, ok := repo.db.users[order.UserID]; !ok {
+		if _, taken := repo.db.orders[order.Number]; !taken {
+			return types.ErrReferenceNotFound
+		}
+	}
+
+	switch repo.db.insertOrder(order) {
+	case types.UploadAlreadyYours:
+		return types.ErrOrderAlreadyCreatedByUser
+	case types.UploadConflict:
+		return types.ErrOrderAlreadyCreatedByAnother
+	}
+	return nil
+}
+
+func (repo *orderRepo) CreateOrders(_ context.Context, orders []types.Order) ([]types.OrderUploadResult, error) {
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	for i := range orders {
+		if orders[i].UserID == "" {
+			return nil, errors.New("repository: incorrect parameters")
+		}
+		if _, ok := repo.db.users[orders[i].UserID]; !ok {
+			return nil, types.ErrReferenceNotFound
+		}
+	}
+
+	ret := make([]types.OrderUploadResult, 0, len(orders))
+	for i := range orders {
+		ret = append(ret, types.OrderUploadResult{Number: orders[i].Number, Result: repo.db.insertOrder(&orders[i])})
+	}
+	return ret, nil
+}
+
+// insertOrder registers the order for an existing user unless its number is
+// already taken. It must be called with db.mu held.
+func (db *DB) insertOrder(order *types.Order) types.UploadResult {
+	if existing, ok := db.orders[order.Number]; ok {
+		if existing.UserID == order.UserID {
+			return types.UploadAlreadyYours
+		}
+		return types.UploadConflict
+	}
+
+	scheme := order.Scheme
+	if scheme == "" {
+		scheme = types.SchemeLuhn
+	}
+
+	db.seq++
+	db.orders[order.Number] = &orderRecord{
+		Order: types.Order{
+			Number:     order.Number,
+			UserID:     order.UserID,
+			Status:     types.New,
+			UploadedAt: db.now(),
+			MerchantID: order.MerchantID,
+			Scheme:     scheme,
+			Total:      order.Total,
+		},
+		seq:   db.seq,
+		goods: append([]types.Good(nil), order.Goods...),
+	}
+	db.recordEvent(order.UserID, types.OutboxOrderUploaded, types.OrderUploadedPayload{
+		Number:     order.Number,
+		MerchantID: order.MerchantID,
+		Total:      order.Total,
+	})
+	return types.UploadAccepted
+}
+
+func (repo *orderRepo) UpdateOrder(_ context.Context, orderNum, status string, accrual float64) (float64, error) {
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	order, ok := repo.db.orders[orderNum]
+	// Final statuses stay, so the accrual keeps matching the lot.
+	if !ok || order.Status == types.Processed || order.Status == types.Invalid {
+		return 0, nil
+	}
+	if tier, ok := repo.db.tiers[order.UserID]; ok {
+		accrual *= tier.multiplier
+	}
+	changed := order.Status != types.Status(status)
+	if changed {
+		order.history = append(order.history, types.OrderStatusChange{
+			From:      order.Status,
+			To:        types.Status(status),
+			ChangedAt: repo.db.now(),
+		})
+	}
+	order.Status = types.Status(status)
+	order.Accrual = accrual
+
+	if changed && (order.Status == types.Processed || order.Status == types.Invalid) {
+		event := types.WebhookOrderProcessed
+		if order.Status == types.Invalid {
+			event = types.WebhookOrderInvalid
+		}
+		repo.db.queueWebhooks(types.WebhookPayload{
+			Event:      event,
+			MerchantID: order.MerchantID,
+			Order:      orderNum,
+			Status:     order.Status,
+			Accrual:    accrual,
+		})
+	}
+	if changed && order.Status == types.Processed {
+		repo.db.recordEvent(order.UserID, types.OutboxOrderAccrued, types.OrderAccruedPayload{
+			Number:  orderNum,
+			Accrual: accrual,
+		})
+	}
+
+	if order.Status == types.Processed && accrual > 0 {
+		for _, l := range repo.db.lots {
+			if l.order == orderNum {
+				return accrual, nil
+			}
+		}
+		repo.db.lots = append(repo.db.lots, &lot{
+			userID:    order.UserID,
+			order:     orderNum,
+			amount:    accrual,
+			remaining: accrual,
+			accruedAt: repo.db.now(),
+		})
+	}
+	return accrual, nil
+}
+
+func (repo *orderRepo) RecordCheck(_ context.Context, orderNum string) error {
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	if order, ok := repo.db.orders[orderNum]; ok {
+		now := repo.db.now()
+		order.attempts++
+		order.lastCheckedAt = &now
+	}
+	return nil
+}
+
+func (repo *orderRepo) GetOrder(_ context.Context, userID, number string) (*types.Order, error) {
+	if userID == "" || number == "" {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.RLock()
+	defer repo.db.mu.RUnlock()
+
+	record, ok := repo.db.orders[number]
+	if !ok || record.UserID != userID {
+		return nil, types.ErrNotFound
+	}
+	order := record.Order
+	order.UserID = ""
+	order.Goods = append([]types.Good(nil), record.goods...)
+	order.Attempts = record.attempts
+	order.LastCheckedAt = record.lastCheckedAt
+	order.History = append([]types.OrderStatusChange(nil), record.history...)
+	return &order, nil
+}
+
+func (repo *orderRepo) GetOrdersByUser(_ context.Context, userID string) ([]types.Order, error) {
+	if userID == "" {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.RLock()
+	defer repo.db.mu.RUnlock()
+
+	return repo.db.selectOrders(func(o *orderRecord) bool { return o.UserID == userID }, false), nil
+}
+
+func (repo *orderRepo) GetProcessedOrdersByUser(_ context.Context, userID string) ([]types.Order, error) {
+	if userID == "" {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.RLock()
+	defer repo.db.mu.RUnlock()
+
+	return repo.db.selectOrders(func(o *orderRecord) bool {
+		return o.UserID == userID && o.Status == types.Processed
+	}, true), nil
+}
+
+func (repo *orderRepo) GetPendingOrdersNumbers(_ context.Context) ([]types.Order, error) {
+	repo.db.mu.RLock()
+	defer repo.db.mu.RUnlock()
+
+	ret := repo.db.selectOrders(func(o *orderRecord) bool {
+		return o.Status != types.Invalid && o.Status != types.Processed
+	}, true)
+	for i := range ret {
+		ret[i] = types.Order{Number: ret[i].Number, Status: ret[i].Status, UserID: ret[i].UserID}
+	}
+	return ret, nil
+}
+
+// selectOrders returns matching orders, newest first. It must be called with
+// db.mu held.
+func (db *DB) selectOrders(match func(o *orderRecord) bool, withUser bool) []types.Order {
+	records := []*orderRecord{}
+	for _, o := range db.orders {
+		if match(o) {
+			records = append(records, o)
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].UploadedAt.Equal(records[j].UploadedAt) {
+			return records[i].UploadedAt.After(records[j].UploadedAt)
+		}
+		return records[i].seq > records[j].seq
+	})
+
+	ret := make([]types.Order, 0, len(records))
+	for _, o := range records {
+		order := o.Order
+		if !withUser {
+			order.UserID = ""
+		}
+		ret = append(ret, order)
+	}
+	return ret
+}
@@ -0,0 +1,99 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+type outboxRepo struct {
+	db *DB
+}
+
+func NewOutboxRepository(db *DB) store.Outbox {
+	return &outboxRepo{db: db}
+}
+
+func (repo *outboxRepo) PublishEvents(ctx context.Context, limit int, publish store.PublishFunc) (int, error) {
+	if limit <= 0 || publish == nil {
+		return 0, errors.New("repository: incorrect parameters")
+	}
+
+	// publish may be slow, so it runs under a lock of its own rather than
+	// db.mu.
+	if !repo.db.publishMu.TryLock() {
+		return 0, nil
+	}
+	defer repo.db.publishMu.Unlock()
+
+	repo.db.mu.RLock()
+	if len(repo.db.events) < limit {
+		limit = len(repo.db.events)
+	}
+	events := append([]types.OutboxEvent(nil), repo.db.events[:limit]...)
+	repo.db.mu.RUnlock()
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	n, err := publish(ctx, events)
+	if n > len(events) {
+		n = len(events)
+	}
+
+	// Writers only append to events and publishers hold publishMu, so the
+	// first n are still the ones published.
+	repo.db.mu.Lock()
+	repo.db.events = repo.db.events[n:]
+	repo.db.mu.Unlock()
+	return n, err
+}
+
+// PruneEvents only caps the unpublished events: published ones are dropped
+// as soon as they are published.
+func (repo *outboxRepo) PruneEvents(_ context.Context, _ time.Time, maxPending int) (int, int, error) {
+	if maxPending < 0 {
+		return 0, 0, errors.New("repository: incorrect parameters")
+	}
+	if maxPending == 0 {
+		return 0, 0, nil
+	}
+
+	// Publishers count on the events they were passed staying first.
+	repo.db.publishMu.Lock()
+	defer repo.db.publishMu.Unlock()
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	pending := len(repo.db.events) - maxPending
+	if pending <= 0 {
+		return 0, 0, nil
+	}
+	repo.db.events = append([]types.OutboxEvent(nil), repo.db.events[pending:]...)
+	return 0, pending, nil
+}
+
+func (repo *outboxRepo) CountPending(context.Context) (int, error) {
+	repo.db.mu.RLock()
+	defer repo.db.mu.RUnlock()
+
+	return len(repo.db.events), nil
+}
+
+// recordEvent adds an event to the outbox. It must be called with db.mu
+// held.
+func (db *DB) recordEvent(userID, eventType string, payload interface{}) {
+	body, _ := json.Marshal(payload) // cannot fail for the payload types
+	db.eventSeq++
+	db.events = append(db.events, types.OutboxEvent{
+		ID:        db.eventSeq,
+		Type:      eventType,
+		UserID:    userID,
+		Payload:   body,
+		CreatedAt: db.now(),
+	})
+}
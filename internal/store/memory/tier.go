@@ -0,0 +1,118 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+type tierRepo struct {
+	db *DB
+}
+
+func NewTierRepository(db *DB) store.Tier {
+	return &tierRepo{db: db}
+}
+
+func (repo *tierRepo) RecalculateTiers(_ context.Context, tiers []types.Tier, basis string, since time.Time) (int, error) {
+	if len(tiers) == 0 {
+		return 0, errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	totals := map[string]float64{}
+	switch basis {
+	case types.TierBasisEarned:
+		for _, l := range repo.db.lots {
+			// Points received from other users or refunded do not count
+			// as earned.
+			if l.order != "" && !l.accruedAt.Before(since) {
+				totals[l.userID] += l.amount
+			}
+		}
+	case types.TierBasisSpent:
+		for _, wtdrw := range repo.db.withdrawals {
+			if wtdrw.Status == types.WithdrawalActive && !wtdrw.ProcessedAt.Before(since) {
+				totals[wtdrw.UserID] += wtdrw.Sum
+			}
+		}
+	default:
+		return 0, fmt.Errorf("repository: unknown tier basis %q", basis)
+	}
+
+	changed := 0
+	for userID := range repo.db.users {
+		total := totals[userID]
+		target := tiers[0]
+		for _, tier := range tiers[1:] {
+			if total >= tier.Threshold {
+				target = tier
+			}
+		}
+
+		current, ok := repo.db.tiers[userID]
+		repo.db.tiers[userID] = userTier{name: target.Name, multiplier: target.Multiplier}
+		if ok && current.name == target.Name {
+			continue
+		}
+
+		repo.db.tierHistory = append(repo.db.tierHistory, tierChange{
+			userID: userID,
+			TierChange: types.TierChange{
+				From:      current.name,
+				To:        target.Name,
+				Total:     total,
+				ChangedAt: repo.db.now(),
+			},
+		})
+		changed++
+	}
+	return changed, nil
+}
+
+func (repo *tierRepo) ResetTiers(context.Context) (int, error) {
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	n := len(repo.db.tiers)
+	repo.db.tiers = map[string]userTier{}
+	return n, nil
+}
+
+func (repo *tierRepo) GetTier(_ context.Context, userID string) (string, error) {
+	if userID == "" {
+		return "", errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.RLock()
+	defer repo.db.mu.RUnlock()
+
+	tier, ok := repo.db.tiers[userID]
+	if !ok {
+		return "", types.ErrNotFound
+	}
+	return tier.name, nil
+}
+
+func (repo *tierRepo) GetTierHistory(_ context.Context, userID string) ([]types.TierChange, error) {
+	if userID == "" {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.RLock()
+	defer repo.db.mu.RUnlock()
+
+	ret := []types.TierChange{}
+	for i := len(repo.db.tierHistory) - 1; i >= 0; i-- {
+		if change := repo.db.tierHistory[i]; change.userID == userID {
+			ret = append(ret, change.TierChange)
+		}
+	}
+	return ret, nil
+}
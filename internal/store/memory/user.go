@@ -0,0 +1,57 @@
+package memory
+
+import (
+	"context"
+	"errors"
+
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+type userRepo struct {
+	db *DB
+}
+
+func NewUserRepository(db *DB) store.User {
+	return &userRepo{db: db}
+}
+
+func (repo *userRepo) CreateUser(_ context.Context, user *types.User) error {
+	if user == nil {
+		return errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	if _, ok := repo.db.logins[user.Login]; ok {
+		return types.ErrUserAlreadyExists
+	}
+	if _, ok := repo.db.users[user.ID]; ok {
+		return types.ErrAlreadyExists
+	}
+
+	usr := *user
+	usr.CreatedAt = repo.db.now()
+	repo.db.users[usr.ID] = usr
+	repo.db.logins[usr.Login] = usr.ID
+	repo.db.recordEvent(usr.ID, types.OutboxUserRegistered, types.UserRegisteredPayload{Login: usr.Login})
+	return nil
+}
+
+func (repo *userRepo) GetByLogin(_ context.Context, login string) (*types.User, error) {
+	if login == "" {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.RLock()
+	defer repo.db.mu.RUnlock()
+
+	id, ok := repo.db.logins[login]
+	if !ok {
+		return nil, types.ErrNotFound
+	}
+
+	usr := repo.db.users[id]
+	return &usr, nil
+}
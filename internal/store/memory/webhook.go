@@ -0,0 +1,209 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+type webhookRepo struct {
+	db *DB
+}
+
+func NewWebhookRepository(db *DB) store.Webhook {
+	return &webhookRepo{db: db}
+}
+
+func (repo *webhookRepo) CreateWebhook(_ context.Context, webhook *types.Webhook) error {
+	if webhook == nil || webhook.MerchantID == "" || webhook.URL == "" || len(webhook.Events) == 0 {
+		return errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	repo.db.webhookSeq++
+	webhook.ID = repo.db.webhookSeq
+	webhook.CreatedAt = repo.db.now()
+	stored := *webhook
+	stored.Events = append([]string(nil), webhook.Events...)
+	repo.db.webhooks = append(repo.db.webhooks, &stored)
+	return nil
+}
+
+func (repo *webhookRepo) GetWebhooks(_ context.Context) ([]types.Webhook, error) {
+	repo.db.mu.RLock()
+	defer repo.db.mu.RUnlock()
+
+	ret := make([]types.Webhook, 0, len(repo.db.webhooks))
+	for _, w := range repo.db.webhooks {
+		webhook := *w
+		webhook.Secret = ""
+		webhook.Events = append([]string(nil), w.Events...)
+		ret = append(ret, webhook)
+	}
+	return ret, nil
+}
+
+func (repo *webhookRepo) DeleteWebhook(_ context.Context, id int64) error {
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	webhooks := repo.db.webhooks[:0]
+	for _, w := range repo.db.webhooks {
+		if w.ID != id {
+			webhooks = append(webhooks, w)
+		}
+	}
+	if len(webhooks) == len(repo.db.webhooks) {
+		return types.ErrNotFound
+	}
+	repo.db.webhooks = webhooks
+
+	deliveries := repo.db.deliveries[:0]
+	for _, d := range repo.db.deliveries {
+		if d.WebhookID != id {
+			deliveries = append(deliveries, d)
+		}
+	}
+	repo.db.deliveries = deliveries
+	return nil
+}
+
+func (repo *webhookRepo) ClaimDeliveries(_ context.Context, limit int, lease time.Duration) ([]types.WebhookDelivery, error) {
+	if limit <= 0 || lease <= 0 {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	now := repo.db.now()
+	ret := []types.WebhookDelivery{}
+	for _, d := range repo.db.deliveries {
+		if len(ret) == limit {
+			break
+		}
+		if d.Status != types.DeliveryPending || d.nextAttemptAt.After(now) {
+			continue
+		}
+		d.nextAttemptAt = now.Add(lease)
+
+		claimed := d.WebhookDelivery
+		for _, w := range repo.db.webhooks {
+			if w.ID == d.WebhookID {
+				claimed.URL, claimed.Secret = w.URL, w.Secret
+			}
+		}
+		ret = append(ret, claimed)
+	}
+	return ret, nil
+}
+
+func (repo *webhookRepo) CompleteDelivery(_ context.Context, id int64) error {
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	if d := repo.db.delivery(id); d != nil && d.Status == types.DeliveryPending {
+		d.Status = types.DeliveryDelivered
+		d.Attempts++
+	}
+	return nil
+}
+
+func (repo *webhookRepo) FailDelivery(_ context.Context, id int64, lastError string, retryIn time.Duration) error {
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	d := repo.db.delivery(id)
+	if d == nil || d.Status != types.DeliveryPending {
+		return nil
+	}
+	d.Attempts++
+	d.LastError = lastError
+	if retryIn <= 0 {
+		d.Status = types.DeliveryDead
+		return nil
+	}
+	d.nextAttemptAt = repo.db.now().Add(retryIn)
+	return nil
+}
+
+func (repo *webhookRepo) GetDeadDeliveries(_ context.Context) ([]types.WebhookDelivery, error) {
+	repo.db.mu.RLock()
+	defer repo.db.mu.RUnlock()
+
+	ret := []types.WebhookDelivery{}
+	for _, d := range repo.db.deliveries {
+		if d.Status == types.DeliveryDead {
+			ret = append(ret, d.WebhookDelivery)
+		}
+	}
+	return ret, nil
+}
+
+func (repo *webhookRepo) ReplayDelivery(_ context.Context, id int64) error {
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	d := repo.db.delivery(id)
+	if d == nil || d.Status != types.DeliveryDead {
+		return types.ErrNotFound
+	}
+	d.Status = types.DeliveryPending
+	d.Attempts = 0
+	d.nextAttemptAt = repo.db.now()
+	return nil
+}
+
+// delivery must be called with db.mu held.
+func (db *DB) delivery(id int64) *delivery {
+	for _, d := range db.deliveries {
+		if d.ID == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// queueWebhooks adds a delivery of payload for every webhook of its merchant
+// subscribed to its event. It must be called with db.mu held.
+func (db *DB) queueWebhooks(payload types.WebhookPayload) {
+	if payload.MerchantID == "" {
+		return
+	}
+	now := db.now()
+	payload.OccurredAt = now
+	body, _ := json.Marshal(payload) // cannot fail for a WebhookPayload
+
+	for _, w := range db.webhooks {
+		if w.MerchantID != payload.MerchantID || !contains(w.Events, payload.Event) {
+			continue
+		}
+		db.deliverySeq++
+		db.deliveries = append(db.deliveries, &delivery{
+			WebhookDelivery: types.WebhookDelivery{
+				ID:        db.deliverySeq,
+				WebhookID: w.ID,
+				Event:     payload.Event,
+				Payload:   body,
+				Status:    types.DeliveryPending,
+				CreatedAt: now,
+			},
+			nextAttemptAt: now,
+		})
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
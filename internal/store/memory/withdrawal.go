@@ -0,0 +1,367 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+type withdrawalRepo struct {
+	db *DB
+}
+
+func NewWithdrawalRepository(db *DB) store.Withdrawal {
+	return &withdrawalRepo{db: db}
+}
+
+func (repo *withdrawalRepo) CreateWithdrawal(_ context.Context, orderNum, userID, merchantID string, sum float64) error {
+	if userID == "" {
+		return errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	if _, ok := repo.db.users[userID]; !ok {
+		return types.ErrNotFound
+	}
+
+	if repo.db.balance(userID).Current < sum {
+		return types.ErrInsufficientBalance
+	}
+
+	repo.db.withdrawals = append(repo.db.withdrawals, &types.Withdrawal{
+		ID:          int64(len(repo.db.withdrawals) + 1),
+		UserID:      userID,
+		Number:      orderNum,
+		Sum:         sum,
+		MerchantID:  merchantID,
+		ProcessedAt: repo.db.now(),
+		Status:      types.WithdrawalActive,
+	})
+	repo.db.consumeLots(userID, sum)
+	repo.db.recordEvent(userID, types.OutboxPointsWithdrawn, types.PointsWithdrawnPayload{
+		Order:      orderNum,
+		Sum:        sum,
+		MerchantID: merchantID,
+	})
+	repo.db.queueWebhooks(types.WebhookPayload{
+		Event:      types.WebhookPointsSpent,
+		MerchantID: merchantID,
+		Order:      orderNum,
+		Sum:        sum,
+	})
+	return nil
+}
+
+func (repo *withdrawalRepo) GetBalance(_ context.Context, userID string) (*types.UserBalance, error) {
+	if userID == "" {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.RLock()
+	defer repo.db.mu.RUnlock()
+
+	return repo.db.balance(userID), nil
+}
+
+func (repo *withdrawalRepo) GetWithdrawalsByUser(_ context.Context, userID string) ([]types.Withdrawal, error) {
+	if userID == "" {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.RLock()
+	defer repo.db.mu.RUnlock()
+
+	ret := []types.Withdrawal{}
+	for i := len(repo.db.withdrawals) - 1; i >= 0; i-- {
+		wtdrw := *repo.db.withdrawals[i]
+		if wtdrw.UserID == userID {
+			wtdrw.UserID = ""
+			ret = append(ret, wtdrw)
+		}
+	}
+	return ret, nil
+}
+
+func (repo *withdrawalRepo) ReverseWithdrawal(_ context.Context, id int64, reason string) (*types.Withdrawal, error) {
+	if id <= 0 || reason == "" {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	// IDs are positions in the slice, which is never shrunk.
+	if id > int64(len(repo.db.withdrawals)) {
+		return nil, types.ErrNotFound
+	}
+	wtdrw := repo.db.withdrawals[id-1]
+	if wtdrw.Status != types.WithdrawalActive {
+		return nil, types.ErrWithdrawalReversed
+	}
+
+	now := repo.db.now()
+	wtdrw.Status = types.WithdrawalReversed
+	wtdrw.ReversedAt = &now
+	wtdrw.Reason = reason
+	repo.db.lots = append(repo.db.lots, &lot{
+		userID:    wtdrw.UserID,
+		amount:    wtdrw.Sum,
+		remaining: wtdrw.Sum,
+		accruedAt: now,
+	})
+
+	ret := *wtdrw
+	return &ret, nil
+}
+
+func (repo *withdrawalRepo) CreateTransfer(_ context.Context, senderID, recipientLogin string, sum float64, limit types.TransferLimit) error {
+	if senderID == "" || recipientLogin == "" || sum <= 0 {
+		return errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	recipientID, ok := repo.db.logins[recipientLogin]
+	if !ok {
+		return types.ErrNotFound
+	}
+	if recipientID == senderID {
+		return types.ErrTransferToSelf
+	}
+
+	if repo.db.balance(senderID).Current < sum {
+		return types.ErrInsufficientBalance
+	}
+
+	if limit.Max > 0 {
+		sent := sum
+		for _, t := range repo.db.transfers {
+			if t.senderID == senderID && !t.createdAt.Before(limit.Since) {
+				sent += t.sum
+			}
+		}
+		if sent > limit.Max {
+			return types.ErrTransferLimitExceeded
+		}
+	}
+
+	now := repo.db.now()
+	repo.db.transfers = append(repo.db.transfers, transfer{
+		senderID:    senderID,
+		recipientID: recipientID,
+		sum:         sum,
+		createdAt:   now,
+	})
+	repo.db.consumeLots(senderID, sum)
+	repo.db.lots = append(repo.db.lots, &lot{
+		userID:    recipientID,
+		amount:    sum,
+		remaining: sum,
+		accruedAt: now,
+	})
+	return nil
+}
+
+func (repo *withdrawalRepo) GetTransfersByUser(_ context.Context, userID string) ([]types.Transfer, error) {
+	if userID == "" {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.RLock()
+	defer repo.db.mu.RUnlock()
+
+	ret := []types.Transfer{}
+	for i := len(repo.db.transfers) - 1; i >= 0; i-- {
+		t := repo.db.transfers[i]
+		transfer := types.Transfer{Sum: t.sum, CreatedAt: t.createdAt}
+		switch userID {
+		case t.senderID:
+			transfer.Direction = types.TransferOut
+			transfer.Counterparty = repo.db.users[t.recipientID].Login
+		case t.recipientID:
+			transfer.Direction = types.TransferIn
+			transfer.Counterparty = repo.db.users[t.senderID].Login
+		default:
+			continue
+		}
+		ret = append(ret, transfer)
+	}
+	return ret, nil
+}
+
+func (repo *withdrawalRepo) GetTransactions(_ context.Context, userID string, filter types.TransactionFilter) ([]types.Transaction, error) {
+	if userID == "" || filter.Limit < 0 || filter.Offset < 0 {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.RLock()
+	defer repo.db.mu.RUnlock()
+
+	ledger := repo.db.ledger(userID)
+	ret := []types.Transaction{}
+	skip := filter.Offset
+	for _, t := range ledger {
+		if filter.Limit > 0 && len(ret) == filter.Limit {
+			break
+		}
+		if !filter.Includes(t.ProcessedAt) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		ret = append(ret, t)
+	}
+	return ret, nil
+}
+
+func (repo *withdrawalRepo) WriteStatement(_ context.Context, userID string, from, to time.Time, w types.StatementWriter) error {
+	if userID == "" || w == nil {
+		return errors.New("repository: incorrect parameters")
+	}
+
+	// The ledger is a copy, so a slow w does not hold up writers.
+	repo.db.mu.RLock()
+	ledger := repo.db.ledger(userID)
+	repo.db.mu.RUnlock()
+
+	var balance types.UserBalance
+	i := 0
+	for ; i < len(ledger) && ledger[i].ProcessedAt.Before(from); i++ {
+		balance.Apply(&ledger[i])
+	}
+	if err := w.WriteOpening(balance); err != nil {
+		return err
+	}
+	for ; i < len(ledger) && (to.IsZero() || ledger[i].ProcessedAt.Before(to)); i++ {
+		balance.Apply(&ledger[i])
+		if err := w.WriteTransaction(&ledger[i]); err != nil {
+			return err
+		}
+	}
+	return w.WriteClosing(balance)
+}
+
+// ledgerEntry orders transactions made at the same time like the Postgres
+// store does: by type and the id of the row they come from.
+type ledgerEntry struct {
+	types.Transaction
+	id int64
+}
+
+// ledger returns all transactions of userID, oldest first, with the running
+// balance. It must be called with db.mu held.
+func (db *DB) ledger(userID string) []types.Transaction {
+	var entries []ledgerEntry
+	add := func(id int64, t types.Transaction) {
+		entries = append(entries, ledgerEntry{Transaction: t, id: id})
+	}
+
+	for i, l := range db.lots {
+		if l.userID == userID && l.order != "" {
+			add(int64(i), types.Transaction{Type: types.TransactionAccrual, Order: l.order, Amount: l.amount, ProcessedAt: l.accruedAt})
+		}
+	}
+	for _, w := range db.withdrawals {
+		if w.UserID != userID {
+			continue
+		}
+		add(w.ID, types.Transaction{Type: types.TransactionWithdrawal, Order: w.Number, Amount: -w.Sum, ProcessedAt: w.ProcessedAt})
+		if w.ReversedAt != nil {
+			add(w.ID, types.Transaction{Type: types.TransactionReversal, Order: w.Number, Amount: w.Sum, ProcessedAt: *w.ReversedAt})
+		}
+	}
+	// An expiry run writes off all lots at the same time.
+	runs := map[time.Time]int{}
+	for i, e := range db.expirations {
+		if e.userID != userID {
+			continue
+		}
+		if j, ok := runs[e.expiredAt]; ok {
+			entries[j].Amount -= e.sum
+			continue
+		}
+		runs[e.expiredAt] = len(entries)
+		add(int64(i), types.Transaction{Type: types.TransactionExpiration, Amount: -e.sum, ProcessedAt: e.expiredAt})
+	}
+	for i, t := range db.transfers {
+		switch userID {
+		case t.senderID:
+			add(int64(i), types.Transaction{
+				Type: types.TransactionTransferOut, Counterparty: db.users[t.recipientID].Login, Amount: -t.sum, ProcessedAt: t.createdAt,
+			})
+		case t.recipientID:
+			add(int64(i), types.Transaction{
+				Type: types.TransactionTransferIn, Counterparty: db.users[t.senderID].Login, Amount: t.sum, ProcessedAt: t.createdAt,
+			})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		switch {
+		case !a.ProcessedAt.Equal(b.ProcessedAt):
+			return a.ProcessedAt.Before(b.ProcessedAt)
+		case a.Type != b.Type:
+			return a.Type.Rank() < b.Type.Rank()
+		default:
+			return a.id < b.id
+		}
+	})
+
+	ret := make([]types.Transaction, 0, len(entries))
+	var balance float64
+	for _, e := range entries {
+		balance += e.Amount
+		e.Balance = balance
+		ret = append(ret, e.Transaction)
+	}
+	return ret
+}
+
+func (repo *withdrawalRepo) GetExpiringPoints(_ context.Context, userID string, accruedBefore time.Time) (float64, error) {
+	if userID == "" {
+		return 0, errors.New("repository: incorrect parameters")
+	}
+
+	repo.db.mu.RLock()
+	defer repo.db.mu.RUnlock()
+
+	var sum float64
+	for _, l := range repo.db.lots {
+		if l.userID == userID && l.accruedAt.Before(accruedBefore) {
+			sum += l.remaining
+		}
+	}
+	return sum, nil
+}
+
+func (repo *withdrawalRepo) ExpirePoints(_ context.Context, accruedBefore time.Time) (map[string]float64, error) {
+	repo.db.mu.Lock()
+	defer repo.db.mu.Unlock()
+
+	// Like now() in a transaction, the time is the same for the whole run.
+	now := repo.db.now()
+	expired := make(map[string]float64)
+	for _, l := range repo.db.lots {
+		if l.remaining <= 0 || !l.accruedAt.Before(accruedBefore) {
+			continue
+		}
+		repo.db.expirations = append(repo.db.expirations, expiration{
+			userID:    l.userID,
+			sum:       l.remaining,
+			expiredAt: now,
+		})
+		expired[l.userID] += l.remaining
+		l.remaining = 0
+	}
+	return expired, nil
+}
@@ -2,131 +2,442 @@ package order
 
 import (
 	"context"
-	"database/sql"
 	"errors"
+	"sort"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 
 	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/store/postgres"
+	"github.com/shevchukeugeni/gofermart/internal/tracing"
 	"github.com/shevchukeugeni/gofermart/internal/types"
 )
 
 type repo struct {
-	db *sql.DB
+	db *pgxpool.Pool
 }
 
-func NewRepository(db *sql.DB) store.Order {
+func NewRepository(db *pgxpool.Pool) store.Order {
 	return &repo{db: db}
 }
 
-func (repo *repo) CreateOrder(ctx context.Context, orderNum, userId string) error {
-	if userId == "" {
+func (repo *repo) CreateOrder(ctx context.Context, order *types.Order) (err error) {
+	ctx, span := tracing.Start(ctx, "order.CreateOrder")
+	defer func() { tracing.End(span, err) }()
+
+	if order == nil || order.UserID == "" {
 		return errors.New("repository: incorrect parameters")
 	}
 
-	ret := types.Order{Number: orderNum}
-	err := repo.db.QueryRowContext(ctx, "SELECT user_id FROM orders WHERE number=$1", orderNum).Scan(
-		&ret.UserID)
-	if !errors.Is(err, sql.ErrNoRows) {
-		if err == nil {
-			if ret.UserID == userId {
-				return types.ErrOrderAlreadyCreatedByUser
-			} else {
-				return types.ErrOrderAlreadyCreatedByAnother
-			}
-		} else {
-			return err
+	// Goods and the upload event are stored along with the order.
+	tx, err := repo.db.Begin(ctx)
+	if err != nil {
+		return postgres.MapError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err = postgres.LockUsers(ctx, tx, order.UserID); err != nil {
+		return err
+	}
+
+	var (
+		owner    string
+		inserted bool
+	)
+	err = tx.QueryRow(ctx, upsertOrder, upsertArgs(order)...).Scan(&owner, &inserted)
+	if err != nil {
+		return postgres.MapError(err)
+	}
+
+	switch uploadResult(owner, order.UserID, inserted) {
+	case types.UploadAlreadyYours:
+		return types.ErrOrderAlreadyCreatedByUser
+	case types.UploadConflict:
+		return types.ErrOrderAlreadyCreatedByAnother
+	}
+
+	batch := &pgx.Batch{}
+	for i, g := range order.Goods {
+		batch.Queue("INSERT INTO order_items(order_number, position, description, price) VALUES ($1, $2, $3, $4)",
+			order.Number, i, g.Description, g.Price)
+	}
+	batch.Queue(notifyUpload, postgres.OrdersChannel)
+	if err = tx.SendBatch(ctx, batch).Close(); err != nil {
+		return postgres.MapError(err)
+	}
+	return postgres.MapError(tx.Commit(ctx))
+}
+
+func (repo *repo) CreateOrders(ctx context.Context, orders []types.Order) (_ []types.OrderUploadResult, err error) {
+	ctx, span := tracing.Start(ctx, "order.CreateOrders")
+	defer func() { tracing.End(span, err) }()
+
+	for i := range orders {
+		if orders[i].UserID == "" {
+			return nil, errors.New("repository: incorrect parameters")
 		}
 	}
 
-	_, err = repo.db.ExecContext(ctx,
-		"INSERT INTO orders(number, user_id, status) VALUES ($1, $2, $3)", orderNum, userId, types.New)
+	tx, err := repo.db.Begin(ctx)
 	if err != nil {
-		return err
+		return nil, postgres.MapError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	userIDs := make([]string, 0, len(orders))
+	for i := range orders {
+		userIDs = append(userIDs, orders[i].UserID)
+	}
+	if err = postgres.LockUsers(ctx, tx, userIDs...); err != nil {
+		return nil, err
+	}
+
+	// Each number is upserted once and in sorted order: the row locks of
+	// overlapping batches are then taken in the same order and cannot
+	// deadlock. Repeats report the result of the first upload.
+	first := make(map[string]int, len(orders))
+	unique := make([]int, 0, len(orders))
+	for i := range orders {
+		if _, ok := first[orders[i].Number]; !ok {
+			first[orders[i].Number] = i
+			unique = append(unique, i)
+		}
+	}
+	sort.Slice(unique, func(a, b int) bool {
+		return orders[unique[a]].Number < orders[unique[b]].Number
+	})
+
+	batch := &pgx.Batch{}
+	for _, i := range unique {
+		batch.Queue(upsertOrder, upsertArgs(&orders[i])...)
+	}
+
+	type upserted struct {
+		owner    string
+		inserted bool
+	}
+	rows := make(map[string]upserted, len(unique))
+	accepted := false
+	br := tx.SendBatch(ctx, batch)
+	for _, i := range unique {
+		var row upserted
+		if err = br.QueryRow().Scan(&row.owner, &row.inserted); err != nil {
+			br.Close()
+			return nil, postgres.MapError(err)
+		}
+		rows[orders[i].Number] = row
+		accepted = accepted || row.inserted
+	}
+	if err = br.Close(); err != nil {
+		return nil, postgres.MapError(err)
+	}
+
+	if accepted {
+		if _, err = tx.Exec(ctx, notifyUpload, postgres.OrdersChannel); err != nil {
+			return nil, postgres.MapError(err)
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, postgres.MapError(err)
+	}
+
+	ret := make([]types.OrderUploadResult, 0, len(orders))
+	for i, order := range orders {
+		row := rows[order.Number]
+		ret = append(ret, types.OrderUploadResult{
+			Number: order.Number,
+			Result: uploadResult(row.owner, order.UserID, row.inserted && first[order.Number] == i),
+		})
+	}
+	return ret, nil
+}
+
+// upsertOrder registers an order number and records the upload event of a
+// new one. The no-op update on conflict locks the existing row and makes
+// RETURNING report its owner, so a concurrent upload of the same number is
+// resolved by the unique key instead of a check-then-insert race. The caller
+// must hold the lock of the uploading user.
+const upsertOrder = `
+	WITH ins AS (
+		INSERT INTO orders(number, user_id, status, merchant_id, validation_scheme, total)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, NULLIF($6::decimal, 0))
+		ON CONFLICT (number) DO UPDATE SET number = EXCLUDED.number
+		RETURNING user_id, number, merchant_id, total, (xmax = 0) AS inserted
+	), event AS (
+		INSERT INTO outbox(user_id, event_type, payload)
+		SELECT user_id, $7, jsonb_strip_nulls(jsonb_build_object(
+			'number', number, 'merchant_id', merchant_id, 'total', total))
+		FROM ins WHERE inserted
+	)
+	SELECT user_id, inserted FROM ins`
+
+// notifyUpload wakes the accrual workers. The notification is sent on commit,
+// once the order is visible to them.
+const notifyUpload = "SELECT pg_notify($1, '')"
+
+// upsertArgs defaults the scheme to Luhn, the scheme of orders uploaded
+// without a merchant.
+func upsertArgs(order *types.Order) []interface{} {
+	scheme := order.Scheme
+	if scheme == "" {
+		scheme = types.SchemeLuhn
+	}
+	return []interface{}{order.Number, order.UserID, types.New, order.MerchantID, scheme, order.Total,
+		types.OutboxOrderUploaded}
+}
+
+func uploadResult(owner, userID string, inserted bool) types.UploadResult {
+	switch {
+	case inserted:
+		return types.UploadAccepted
+	case owner == userID:
+		return types.UploadAlreadyYours
+	default:
+		return types.UploadConflict
+	}
+}
+
+func (repo *repo) UpdateOrder(ctx context.Context, orderNum, status string, accrual float64) (_ float64, err error) {
+	ctx, span := tracing.Start(ctx, "order.UpdateOrder")
+	defer func() { tracing.End(span, err) }()
+
+	// The accrual is scaled by the user's tier multiplier. A processed order
+	// with a positive accrual opens a lot in the same statement, so points
+	// never appear in the balance without one. PROCESSED and INVALID are
+	// final, so an order's accrual keeps matching its lot and an invalid
+	// order never opens one. The row lock taken by old
+	// keeps concurrent updates from recording the same transition twice, and
+	// so from queueing webhook deliveries and accrual events twice.
+	var event string
+	switch types.Status(status) {
+	case types.Processed:
+		event = types.WebhookOrderProcessed
+	case types.Invalid:
+		event = types.WebhookOrderInvalid
+	}
+
+	tx, err := repo.db.Begin(ctx)
+	if err != nil {
+		return 0, postgres.MapError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userID string
+	err = tx.QueryRow(ctx, "SELECT user_id FROM orders WHERE number = $1", orderNum).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, postgres.MapError(err)
+	}
+	if err = postgres.LockUsers(ctx, tx, userID); err != nil {
+		return 0, err
+	}
+
+	var applied float64
+	err = tx.QueryRow(ctx, `
+		WITH old AS (
+			SELECT number, status FROM orders WHERE number = $3 FOR UPDATE
+		), upd AS (
+			UPDATE orders o
+			SET status  = $1,
+			    accrual = $2::decimal * COALESCE((SELECT multiplier FROM user_tiers t WHERE t.user_id = o.user_id), 1)
+			FROM old
+			WHERE o.number = old.number AND old.status NOT IN ('PROCESSED', 'INVALID')
+			RETURNING o.user_id, o.number, o.status, o.accrual, o.merchant_id, old.status AS old_status
+		), lot AS (
+			INSERT INTO accrual_lots(user_id, order_number, amount, remaining)
+			SELECT user_id, number, accrual, accrual FROM upd
+			WHERE status = 'PROCESSED' AND accrual > 0
+			ON CONFLICT (order_number) DO NOTHING
+		), history AS (
+			INSERT INTO order_status_history(order_number, from_status, to_status)
+			SELECT number, old_status, status FROM upd
+			WHERE old_status <> status
+		), hook AS (
+			INSERT INTO webhook_deliveries(webhook_id, event, payload)
+			SELECT w.id, $4, jsonb_strip_nulls(jsonb_build_object(
+				'event', $4::text, 'merchant_id', upd.merchant_id, 'order', upd.number,
+				'status', upd.status, 'accrual', NULLIF(upd.accrual, 0), 'occurred_at', now()))
+			FROM upd JOIN webhooks w ON w.merchant_id = upd.merchant_id
+			WHERE upd.old_status <> upd.status AND $4::text = ANY(w.events)
+		), event AS (
+			INSERT INTO outbox(user_id, event_type, payload)
+			SELECT user_id, $5, jsonb_build_object('number', number, 'accrual', COALESCE(accrual, 0))
+			FROM upd
+			WHERE old_status <> status AND status = 'PROCESSED'
+		)
+		SELECT accrual FROM upd`, status, accrual, orderNum, event, types.OutboxOrderAccrued).Scan(&applied)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, postgres.MapError(err)
 	}
-	return nil
+	return applied, postgres.MapError(tx.Commit(ctx))
+}
+
+func (repo *repo) RecordCheck(ctx context.Context, orderNum string) (err error) {
+	ctx, span := tracing.Start(ctx, "order.RecordCheck")
+	defer func() { tracing.End(span, err) }()
+
+	_, err = repo.db.Exec(ctx,
+		"UPDATE orders SET attempts = attempts + 1, last_checked_at = now() WHERE number=$1", orderNum)
+	return postgres.MapError(err)
 }
 
-func (repo *repo) UpdateOrder(ctx context.Context, orderNum, status string, accrual float64) error {
-	_, err := repo.db.ExecContext(ctx,
-		"UPDATE orders SET status = $1, accrual = $2 WHERE number=$3", status, accrual, orderNum)
+func (repo *repo) GetOrder(ctx context.Context, userID, number string) (_ *types.Order, err error) {
+	ctx, span := tracing.Start(ctx, "order.GetOrder")
+	defer func() { tracing.End(span, err) }()
+
+	if userID == "" || number == "" {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	order := &types.Order{Number: number}
+	var acc *float64
+	err = repo.db.QueryRow(ctx,
+		`SELECT status, accrual, uploaded_at, COALESCE(merchant_id, ''), validation_scheme, COALESCE(total, 0),
+			attempts, last_checked_at
+		FROM orders WHERE number=$1 AND user_id=$2`, number, userID).
+		Scan(&order.Status, &acc, &order.UploadedAt, &order.MerchantID, &order.Scheme, &order.Total,
+			&order.Attempts, &order.LastCheckedAt)
 	if err != nil {
-		return err
+		return nil, postgres.MapError(err)
+	}
+	if acc != nil {
+		order.Accrual = *acc
+	}
+
+	batch := &pgx.Batch{}
+	batch.Queue("SELECT description, price FROM order_items WHERE order_number=$1 ORDER BY position", number)
+	batch.Queue(`SELECT from_status, to_status, changed_at FROM order_status_history
+		WHERE order_number=$1 ORDER BY id`, number)
+	br := repo.db.SendBatch(ctx, batch)
+	defer br.Close()
+
+	rows, err := br.Query()
+	if err != nil {
+		return nil, postgres.MapError(err)
+	}
+	for rows.Next() {
+		good := types.Good{}
+		if err := rows.Scan(&good.Description, &good.Price); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		order.Goods = append(order.Goods, good)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, postgres.MapError(err)
+	}
+
+	rows, err = br.Query()
+	if err != nil {
+		return nil, postgres.MapError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		change := types.OrderStatusChange{}
+		if err := rows.Scan(&change.From, &change.To, &change.ChangedAt); err != nil {
+			return nil, err
+		}
+		order.History = append(order.History, change)
 	}
-	return nil
+
+	return order, rows.Err()
 }
 
-func (repo *repo) GetOrdersByUser(ctx context.Context, userId string) ([]types.Order, error) {
+func (repo *repo) GetOrdersByUser(ctx context.Context, userId string) (_ []types.Order, err error) {
+	ctx, span := tracing.Start(ctx, "order.GetOrdersByUser")
+	defer func() { tracing.End(span, err) }()
+
 	if userId == "" {
 		return nil, errors.New("repository: incorrect parameters")
 	}
 
 	ret := []types.Order{}
-	rows, err := repo.db.QueryContext(ctx,
-		"SELECT number, status, accrual, uploaded_at FROM orders WHERE user_id=$1 ORDER BY uploaded_at DESC", userId)
+	rows, err := repo.db.Query(ctx,
+		`SELECT number, status, accrual, uploaded_at, COALESCE(merchant_id, ''), validation_scheme, COALESCE(total, 0)
+		FROM orders WHERE user_id=$1 ORDER BY uploaded_at DESC`, userId)
 	if err != nil {
-		return nil, err
+		return nil, postgres.MapError(err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		order := types.Order{}
-		var acc sql.NullFloat64
-		err := rows.Scan(&order.Number, &order.Status, &acc, &order.UploadedAt)
+		var acc *float64
+		err := rows.Scan(&order.Number, &order.Status, &acc, &order.UploadedAt, &order.MerchantID, &order.Scheme, &order.Total)
 		if err != nil {
 			return nil, err
 		}
-		order.Accrual = acc.Float64
+		if acc != nil {
+			order.Accrual = *acc
+		}
 		ret = append(ret, order)
 	}
 
-	return ret, nil
+	return ret, rows.Err()
 }
 
-func (repo *repo) GetProcessedOrdersByUser(ctx context.Context, userId string) ([]types.Order, error) {
+func (repo *repo) GetProcessedOrdersByUser(ctx context.Context, userId string) (_ []types.Order, err error) {
+	ctx, span := tracing.Start(ctx, "order.GetProcessedOrdersByUser")
+	defer func() { tracing.End(span, err) }()
+
 	if userId == "" {
 		return nil, errors.New("repository: incorrect parameters")
 	}
 
 	ret := []types.Order{}
-	rows, err := repo.db.QueryContext(ctx,
+	rows, err := repo.db.Query(ctx,
 		"SELECT number, accrual, uploaded_at FROM orders WHERE user_id=$1 and status=$2 ORDER BY uploaded_at DESC",
 		userId, types.Processed)
 	if err != nil {
-		return nil, err
+		return nil, postgres.MapError(err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		order := types.Order{UserID: userId}
-		var acc sql.NullFloat64
+		var acc *float64
 		err := rows.Scan(&order.Number, &acc, &order.UploadedAt)
 		if err != nil {
 			return nil, err
 		}
-		order.Accrual = acc.Float64
+		if acc != nil {
+			order.Accrual = *acc
+		}
 		ret = append(ret, order)
 	}
 
-	return ret, nil
+	return ret, rows.Err()
 }
 
-func (repo *repo) GetPendingOrdersNumbers(ctx context.Context) ([]types.Order, error) {
+func (repo *repo) GetPendingOrdersNumbers(ctx context.Context) (_ []types.Order, err error) {
+	ctx, span := tracing.Start(ctx, "order.GetPendingOrdersNumbers")
+	defer func() { tracing.End(span, err) }()
+
 	ret := []types.Order{}
-	rows, err := repo.db.QueryContext(ctx,
-		"SELECT number FROM orders WHERE status!=$1 and status != $2",
+	rows, err := repo.db.Query(ctx,
+		"SELECT number, status, user_id FROM orders WHERE status!=$1 and status != $2",
 		types.Invalid, types.Processed)
 	if err != nil {
-		return nil, err
+		return nil, postgres.MapError(err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		order := types.Order{}
-		err := rows.Scan(&order.Number)
+		err := rows.Scan(&order.Number, &order.Status, &order.UserID)
 		if err != nil {
 			return nil, err
 		}
 		ret = append(ret, order)
 	}
 
-	return ret, nil
+	return ret, rows.Err()
 }
@@ -0,0 +1,132 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/store/postgres"
+	"github.com/shevchukeugeni/gofermart/internal/tracing"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+// publisherLockKey is the advisory lock held by the instance publishing
+// events. A single publisher keeps the events of a user in order; the
+// bytes spell "outbox".
+const publisherLockKey = 0x6f7574626f78
+
+type repo struct {
+	db *pgxpool.Pool
+}
+
+func NewRepository(db *pgxpool.Pool) store.Outbox {
+	return &repo{db: db}
+}
+
+func (repo *repo) PublishEvents(ctx context.Context, limit int, publish store.PublishFunc) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "outbox.PublishEvents")
+	defer func() { tracing.End(span, err) }()
+
+	if limit <= 0 || publish == nil {
+		return 0, errors.New("repository: incorrect parameters")
+	}
+
+	// The lock is released along with the transaction, so it cannot outlive
+	// a publisher that lost its connection.
+	tx, err := repo.db.Begin(ctx)
+	if err != nil {
+		return 0, postgres.MapError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	var locked bool
+	err = tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock($1)", publisherLockKey).Scan(&locked)
+	if err != nil || !locked {
+		return 0, postgres.MapError(err)
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT id, event_type, user_id, payload, created_at FROM outbox
+		WHERE published_at IS NULL ORDER BY id LIMIT $1`, limit)
+	if err != nil {
+		return 0, postgres.MapError(err)
+	}
+	events := []types.OutboxEvent{}
+	for rows.Next() {
+		e := types.OutboxEvent{}
+		if err = rows.Scan(&e.ID, &e.Type, &e.UserID, &e.Payload, &e.CreatedAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, postgres.MapError(err)
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	n, publishErr := publish(ctx, events)
+	if n > len(events) {
+		n = len(events)
+	}
+	if n > 0 {
+		ids := make([]int64, 0, n)
+		for _, e := range events[:n] {
+			ids = append(ids, e.ID)
+		}
+		_, err = tx.Exec(ctx, "UPDATE outbox SET published_at = now() WHERE id = ANY($1)", ids)
+		if err != nil {
+			return 0, postgres.MapError(err)
+		}
+		// Should the commit fail, the events are published again: delivery
+		// is at least once.
+		if err = tx.Commit(ctx); err != nil {
+			return 0, postgres.MapError(err)
+		}
+	}
+	return n, publishErr
+}
+
+func (repo *repo) PruneEvents(ctx context.Context, publishedBefore time.Time, maxPending int) (published, pending int, err error) {
+	ctx, span := tracing.Start(ctx, "outbox.PruneEvents")
+	defer func() { tracing.End(span, err) }()
+
+	if maxPending < 0 {
+		return 0, 0, errors.New("repository: incorrect parameters")
+	}
+
+	tag, err := repo.db.Exec(ctx, "DELETE FROM outbox WHERE published_at < $1", publishedBefore)
+	if err != nil {
+		return 0, 0, postgres.MapError(err)
+	}
+	published = int(tag.RowsAffected())
+	if maxPending == 0 {
+		return published, 0, nil
+	}
+
+	tag, err = repo.db.Exec(ctx, `
+		DELETE FROM outbox
+		WHERE published_at IS NULL AND id <= (
+			SELECT id FROM outbox WHERE published_at IS NULL
+			ORDER BY id DESC OFFSET $1 LIMIT 1
+		)`, maxPending)
+	if err != nil {
+		return published, 0, postgres.MapError(err)
+	}
+	return published, int(tag.RowsAffected()), nil
+}
+
+func (repo *repo) CountPending(ctx context.Context) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "outbox.CountPending")
+	defer func() { tracing.End(span, err) }()
+
+	var n int
+	err = repo.db.QueryRow(ctx, "SELECT count(*) FROM outbox WHERE published_at IS NULL").Scan(&n)
+	return n, postgres.MapError(err)
+}
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS accrual_rewards
+(
+    id          bigserial    NOT NULL PRIMARY KEY,
+    match       varchar(256) NOT NULL UNIQUE,
+    reward      decimal      NOT NULL CHECK (reward > 0),
+    reward_type varchar(2)   NOT NULL CHECK (reward_type IN ('%', 'pt'))
+);
+
+CREATE TABLE IF NOT EXISTS accrual_orders
+(
+    number        varchar     NOT NULL PRIMARY KEY,
+    goods         jsonb       NOT NULL DEFAULT '[]',
+    status        varchar(16) NOT NULL DEFAULT 'REGISTERED'
+        CHECK (status IN ('REGISTERED', 'PROCESSING', 'INVALID', 'PROCESSED')),
+    accrual       decimal,
+    registered_at timestamptz NOT NULL DEFAULT now()
+);
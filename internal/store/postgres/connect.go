@@ -1,48 +1,96 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 
 	"github.com/golang-migrate/migrate/v4"
 	migratepgx "github.com/golang-migrate/migrate/v4/database/pgx"
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
 
+	_ "github.com/shevchukeugeni/gofermart/internal/store/postgres/accrualmigrations"
 	_ "github.com/shevchukeugeni/gofermart/internal/store/postgres/migrations"
 )
 
+// Schema is a set of migrations with its own version table.
+type Schema struct {
+	source string
+	table  string
+}
+
+var (
+	SchemaGophermart = Schema{source: "embed://", table: "schema_migration"}
+	SchemaAccrual    = Schema{source: "embed-accrual://", table: "accrual_schema_migration"}
+)
+
 type Config struct {
-	URL string
+	URL             string
+	MaxConns        int32
+	MinConns        int32
+	MaxConnLifetime time.Duration
+	MaxConnIdleTime time.Duration
+	// Schemas are migrated on connect, the gophermart schema when empty.
+	Schemas []Schema
 }
 
-func NewPostgresDB(cfg Config) (*sql.DB, error) {
+func NewPostgresDB(ctx context.Context, cfg Config) (*pgxpool.Pool, error) {
 	if cfg.URL == "" {
 		return nil, errors.New("incorrect URL")
 	}
 
-	db, err := sql.Open("pgx", cfg.URL)
+	poolCfg, err := pgxpool.ParseConfig(cfg.URL)
 	if err != nil {
 		return nil, err
 	}
-	err = db.Ping()
+	if cfg.MaxConns > 0 {
+		poolCfg.MaxConns = cfg.MaxConns
+	}
+	if cfg.MinConns > 0 {
+		poolCfg.MinConns = cfg.MinConns
+	}
+	if cfg.MaxConnLifetime > 0 {
+		poolCfg.MaxConnLifetime = cfg.MaxConnLifetime
+	}
+	if cfg.MaxConnIdleTime > 0 {
+		poolCfg.MaxConnIdleTime = cfg.MaxConnIdleTime
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolCfg)
 	if err != nil {
 		return nil, err
 	}
-
-	if err = migrateDB(db, "schema_migration"); err != nil {
+	err = pool.Ping(ctx)
+	if err != nil {
+		pool.Close()
 		return nil, err
 	}
 
-	return db, nil
+	db := stdlib.OpenDBFromPool(pool)
+	defer db.Close()
+
+	schemas := cfg.Schemas
+	if len(schemas) == 0 {
+		schemas = []Schema{SchemaGophermart}
+	}
+	for _, schema := range schemas {
+		if err = migrateDB(db, schema); err != nil {
+			pool.Close()
+			return nil, err
+		}
+	}
 
+	return pool, nil
 }
 
-func migrateDB(db *sql.DB, table string) error {
-	driver, err := migratepgx.WithInstance(db, &migratepgx.Config{MigrationsTable: table})
+func migrateDB(db *sql.DB, schema Schema) error {
+	driver, err := migratepgx.WithInstance(db, &migratepgx.Config{MigrationsTable: schema.table})
 	if err != nil {
 		return err
 	}
-	migrator, err := migrate.NewWithDatabaseInstance("embed://", table, driver)
+	migrator, err := migrate.NewWithDatabaseInstance(schema.source, schema.table, driver)
 	if err != nil {
 		return err
 	}
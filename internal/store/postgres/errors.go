@@ -0,0 +1,41 @@
+package postgres
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+// MapError translates driver errors into domain errors from the types
+// package. The original error stays in the chain for logging.
+func MapError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("%w: %w", types.ErrNotFound, err)
+	}
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+
+	switch pgErr.Code {
+	case pgerrcode.UniqueViolation:
+		return fmt.Errorf("%w: %w", types.ErrAlreadyExists, err)
+	case pgerrcode.ForeignKeyViolation:
+		return fmt.Errorf("%w: %w", types.ErrReferenceNotFound, err)
+	case pgerrcode.CheckViolation, pgerrcode.NotNullViolation:
+		return fmt.Errorf("%w: %w", types.ErrConstraintViolation, err)
+	case pgerrcode.SerializationFailure, pgerrcode.DeadlockDetected:
+		return fmt.Errorf("%w: %w", types.ErrConflict, err)
+	}
+	return err
+}
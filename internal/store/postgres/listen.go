@@ -0,0 +1,62 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+// OrdersChannel is notified whenever an order is uploaded, so the accrual
+// worker need not wait for its next tick. The payload is empty.
+const OrdersChannel = "gophermart_orders"
+
+// listenReconnectDelay is the pause before listening again after the
+// connection was lost.
+const listenReconnectDelay = time.Second
+
+// Listen keeps a connection of the pool listening on channel until ctx is
+// done and calls fn with the payload of every notification. It reconnects
+// when the connection is lost; notifications sent meanwhile are missed.
+func Listen(ctx context.Context, logger *zap.Logger, db *pgxpool.Pool, channel string, fn func(payload string)) {
+	for {
+		err := listen(ctx, db, channel, fn)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Error("lost notifications, reconnecting", zap.String("channel", channel), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(listenReconnectDelay):
+		}
+	}
+}
+
+func listen(ctx context.Context, db *pgxpool.Pool, channel string, fn func(payload string)) error {
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// The connection is left in the LISTEN state or broken; either way
+		// it must not go back to the pool.
+		conn.Conn().Close(context.Background())
+		conn.Release()
+	}()
+
+	_, err = conn.Exec(ctx, "LISTEN "+channel)
+	if err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		fn(notification.Payload)
+	}
+}
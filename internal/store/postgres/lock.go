@@ -0,0 +1,14 @@
+package postgres
+
+import "context"
+
+// LockUsers takes the row locks of userIDs, so q must be a transaction.
+// Transactions recording outbox events of a user take the lock before they
+// insert the events; ids of one user's events then follow commit order, and
+// the publisher cannot see an event before an earlier one of the same user.
+func LockUsers(ctx context.Context, q Querier, userIDs ...string) error {
+	// Locking in a fixed order keeps transactions that lock the same users
+	// from deadlocking.
+	_, err := q.Exec(ctx, "SELECT FROM users WHERE id = ANY($1::uuid[]) ORDER BY id FOR UPDATE", userIDs)
+	return MapError(err)
+}
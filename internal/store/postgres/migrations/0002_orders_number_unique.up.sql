@@ -0,0 +1,10 @@
+-- Keep the earliest upload of every duplicated number: it is the one users
+-- have been seeing in their order lists.
+DELETE
+FROM orders a
+    USING orders b
+WHERE a.number = b.number
+  AND (a.uploaded_at > b.uploaded_at OR (a.uploaded_at = b.uploaded_at AND a.ctid > b.ctid));
+
+ALTER TABLE orders
+    ADD CONSTRAINT orders_pkey PRIMARY KEY (number);
@@ -0,0 +1,3 @@
+ALTER TABLE orders
+    DROP COLUMN IF EXISTS validation_scheme,
+    DROP COLUMN IF EXISTS merchant_id;
@@ -0,0 +1,3 @@
+ALTER TABLE orders
+    ADD COLUMN IF NOT EXISTS merchant_id       varchar(64),
+    ADD COLUMN IF NOT EXISTS validation_scheme varchar(32) NOT NULL DEFAULT 'luhn';
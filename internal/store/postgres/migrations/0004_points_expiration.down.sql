@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS point_expirations;
+DROP TABLE IF EXISTS accrual_lots;
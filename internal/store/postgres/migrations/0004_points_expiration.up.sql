@@ -0,0 +1,43 @@
+-- Every accrual becomes a lot. Withdrawals consume lots oldest first and the
+-- expiry job writes off whatever is left of lots older than the configured
+-- lifetime.
+CREATE TABLE IF NOT EXISTS accrual_lots
+(
+    id           bigserial   NOT NULL PRIMARY KEY,
+    user_id      uuid        NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    order_number varchar     NOT NULL UNIQUE,
+    amount       decimal     NOT NULL CHECK (amount > 0),
+    remaining    decimal     NOT NULL CHECK (remaining >= 0 AND remaining <= amount),
+    accrued_at   timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS accrual_lots_user_fifo_idx ON accrual_lots (user_id, accrued_at, id) WHERE remaining > 0;
+
+CREATE TABLE IF NOT EXISTS point_expirations
+(
+    id         bigserial   NOT NULL PRIMARY KEY,
+    lot_id     bigint      NOT NULL REFERENCES accrual_lots (id) ON DELETE CASCADE,
+    user_id    uuid        NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    sum        decimal     NOT NULL,
+    expired_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS point_expirations_user_idx ON point_expirations (user_id);
+
+-- Backfill lots from already processed orders. Past withdrawals are applied
+-- oldest lot first: what is left of a lot is the running total of accruals
+-- up to and including it minus everything withdrawn, clamped to the lot.
+INSERT INTO accrual_lots (user_id, order_number, amount, remaining, accrued_at)
+SELECT o.user_id,
+       o.number,
+       o.accrual,
+       GREATEST(0, LEAST(o.accrual, SUM(o.accrual) OVER w - COALESCE(wd.total, 0))),
+       o.uploaded_at AT TIME ZONE 'UTC'
+FROM orders o
+         LEFT JOIN (SELECT user_id, SUM(sum) AS total FROM withdrawals GROUP BY user_id) wd
+                   ON wd.user_id = o.user_id
+WHERE o.status = 'PROCESSED'
+  AND o.accrual > 0
+  AND o.user_id IS NOT NULL
+WINDOW w AS (PARTITION BY o.user_id ORDER BY o.uploaded_at, o.number)
+ON CONFLICT (order_number) DO NOTHING;
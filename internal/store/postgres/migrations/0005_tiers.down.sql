@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS tier_history;
+DROP TABLE IF EXISTS user_tiers;
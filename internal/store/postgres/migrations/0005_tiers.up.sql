@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS user_tiers
+(
+    user_id    uuid        NOT NULL PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    tier       varchar(64) NOT NULL,
+    multiplier decimal     NOT NULL CHECK (multiplier > 0),
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS tier_history
+(
+    id         bigserial   NOT NULL PRIMARY KEY,
+    user_id    uuid        NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    from_tier  varchar(64),
+    to_tier    varchar(64) NOT NULL,
+    total      decimal     NOT NULL,
+    changed_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS tier_history_user_idx ON tier_history (user_id, changed_at);
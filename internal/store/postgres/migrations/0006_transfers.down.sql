@@ -0,0 +1,6 @@
+DELETE FROM accrual_lots WHERE transfer_id IS NOT NULL;
+ALTER TABLE accrual_lots
+    DROP CONSTRAINT IF EXISTS accrual_lots_source_check,
+    DROP COLUMN IF EXISTS transfer_id,
+    ALTER COLUMN order_number SET NOT NULL;
+DROP TABLE IF EXISTS transfers;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS transfers
+(
+    id           bigserial   NOT NULL PRIMARY KEY,
+    sender_id    uuid        NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    recipient_id uuid        NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    sum          decimal     NOT NULL CHECK (sum > 0),
+    created_at   timestamptz NOT NULL DEFAULT now(),
+    CHECK (sender_id <> recipient_id)
+);
+
+CREATE INDEX IF NOT EXISTS transfers_sender_idx ON transfers (sender_id, created_at);
+CREATE INDEX IF NOT EXISTS transfers_recipient_idx ON transfers (recipient_id, created_at);
+
+-- Received points are spent and expire like accrued ones, so a transfer
+-- opens a lot for the recipient.
+ALTER TABLE accrual_lots
+    ALTER COLUMN order_number DROP NOT NULL,
+    ADD COLUMN IF NOT EXISTS transfer_id bigint UNIQUE REFERENCES transfers (id) ON DELETE CASCADE,
+    ADD CONSTRAINT accrual_lots_source_check CHECK ((order_number IS NULL) <> (transfer_id IS NULL));
@@ -0,0 +1,10 @@
+DELETE FROM accrual_lots WHERE withdrawal_id IS NOT NULL;
+ALTER TABLE accrual_lots
+    DROP CONSTRAINT IF EXISTS accrual_lots_source_check,
+    DROP COLUMN IF EXISTS withdrawal_id,
+    ADD CONSTRAINT accrual_lots_source_check CHECK ((order_number IS NULL) <> (transfer_id IS NULL));
+ALTER TABLE withdrawals
+    DROP COLUMN IF EXISTS reason,
+    DROP COLUMN IF EXISTS reversed_at,
+    DROP COLUMN IF EXISTS status,
+    DROP COLUMN IF EXISTS id;
@@ -0,0 +1,13 @@
+ALTER TABLE withdrawals
+    ADD COLUMN IF NOT EXISTS id          bigserial   NOT NULL PRIMARY KEY,
+    ADD COLUMN IF NOT EXISTS status      varchar(16) NOT NULL DEFAULT 'ACTIVE'
+        CHECK (status IN ('ACTIVE', 'REVERSED')),
+    ADD COLUMN IF NOT EXISTS reversed_at timestamptz,
+    ADD COLUMN IF NOT EXISTS reason      text;
+
+-- A reversal gives the points back as a fresh lot, so they can be spent
+-- and expire like any other points.
+ALTER TABLE accrual_lots
+    ADD COLUMN IF NOT EXISTS withdrawal_id bigint UNIQUE REFERENCES withdrawals (id) ON DELETE CASCADE,
+    DROP CONSTRAINT IF EXISTS accrual_lots_source_check,
+    ADD CONSTRAINT accrual_lots_source_check CHECK (num_nonnulls(order_number, transfer_id, withdrawal_id) = 1);
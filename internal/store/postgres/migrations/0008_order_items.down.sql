@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS order_items;
+ALTER TABLE orders DROP COLUMN IF EXISTS total;
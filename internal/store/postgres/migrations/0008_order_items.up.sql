@@ -0,0 +1,10 @@
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS total decimal CHECK (total >= 0);
+
+CREATE TABLE IF NOT EXISTS order_items
+(
+    order_number varchar NOT NULL REFERENCES orders (number) ON DELETE CASCADE,
+    position     int     NOT NULL,
+    description  text    NOT NULL,
+    price        decimal NOT NULL CHECK (price >= 0),
+    PRIMARY KEY (order_number, position)
+);
@@ -0,0 +1,14 @@
+ALTER TABLE orders
+    ADD COLUMN IF NOT EXISTS attempts        int NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS last_checked_at timestamptz;
+
+CREATE TABLE IF NOT EXISTS order_status_history
+(
+    id           bigserial      NOT NULL PRIMARY KEY,
+    order_number varchar        NOT NULL REFERENCES orders (number) ON DELETE CASCADE,
+    from_status  order_statuses NOT NULL,
+    to_status    order_statuses NOT NULL,
+    changed_at   timestamptz    NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS order_status_history_order_idx ON order_status_history (order_number, id);
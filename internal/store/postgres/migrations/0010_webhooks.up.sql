@@ -0,0 +1,36 @@
+ALTER TABLE withdrawals
+    ADD COLUMN IF NOT EXISTS merchant_id varchar;
+
+CREATE TABLE IF NOT EXISTS webhooks
+(
+    id          bigserial   NOT NULL PRIMARY KEY,
+    merchant_id varchar     NOT NULL,
+    url         text        NOT NULL,
+    secret      text        NOT NULL,
+    events      text[]      NOT NULL,
+    created_at  timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS webhooks_merchant_idx ON webhooks (merchant_id);
+
+-- The outbox: a delivery is written in the same transaction as the change it
+-- reports and sent later by the delivery worker.
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+    id              bigserial   NOT NULL PRIMARY KEY,
+    webhook_id      bigint      NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+    event           varchar     NOT NULL,
+    payload         jsonb       NOT NULL,
+    status          varchar(16) NOT NULL DEFAULT 'PENDING'
+        CHECK (status IN ('PENDING', 'DELIVERED', 'DEAD')),
+    attempts        int         NOT NULL DEFAULT 0,
+    last_error      text,
+    next_attempt_at timestamptz NOT NULL DEFAULT now(),
+    created_at      timestamptz NOT NULL DEFAULT now(),
+    delivered_at    timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at)
+    WHERE status = 'PENDING';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_dead_idx ON webhook_deliveries (id)
+    WHERE status = 'DEAD';
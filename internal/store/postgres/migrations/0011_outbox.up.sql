@@ -0,0 +1,14 @@
+-- Domain events for downstream systems, written in the same transaction as
+-- the change they describe and marked published once the sink accepted them.
+CREATE TABLE IF NOT EXISTS outbox
+(
+    id           bigserial   NOT NULL PRIMARY KEY,
+    user_id      UUID        NOT NULL,
+    event_type   varchar     NOT NULL,
+    payload      jsonb       NOT NULL,
+    created_at   timestamptz NOT NULL DEFAULT now(),
+    published_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS outbox_unpublished_idx ON outbox (id)
+    WHERE published_at IS NULL;
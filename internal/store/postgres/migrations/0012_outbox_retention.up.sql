@@ -0,0 +1,3 @@
+-- Published events are pruned by age.
+CREATE INDEX IF NOT EXISTS outbox_published_idx ON outbox (published_at)
+    WHERE published_at IS NOT NULL;
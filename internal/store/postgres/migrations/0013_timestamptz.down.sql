@@ -0,0 +1,6 @@
+ALTER TABLE withdrawals
+    ALTER COLUMN processed_at TYPE timestamp USING processed_at AT TIME ZONE 'UTC';
+ALTER TABLE orders
+    ALTER COLUMN uploaded_at TYPE timestamp USING uploaded_at AT TIME ZONE 'UTC';
+ALTER TABLE users
+    ALTER COLUMN created_at TYPE timestamp USING created_at AT TIME ZONE 'UTC';
@@ -0,0 +1,8 @@
+-- The baseline columns held UTC wall-clock times without a zone. Read next
+-- to timestamptz columns they were shifted by the session TimeZone.
+ALTER TABLE users
+    ALTER COLUMN created_at TYPE timestamptz USING created_at AT TIME ZONE 'UTC';
+ALTER TABLE orders
+    ALTER COLUMN uploaded_at TYPE timestamptz USING uploaded_at AT TIME ZONE 'UTC';
+ALTER TABLE withdrawals
+    ALTER COLUMN processed_at TYPE timestamptz USING processed_at AT TIME ZONE 'UTC';
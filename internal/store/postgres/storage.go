@@ -1,19 +1,17 @@
 package postgres
 
 import (
-	"database/sql"
+	"context"
 
-	"go.uber.org/zap"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
-type DBStore struct {
-	logger *zap.Logger
-	db     *sql.DB
-}
-
-func NewStore(logger *zap.Logger, db *sql.DB) *DBStore {
-	return &DBStore{
-		logger: logger,
-		db:     db,
-	}
+// Querier is implemented by both *pgxpool.Pool and pgx.Tx, so repository
+// helpers can run either standalone or inside a transaction.
+type Querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
 }
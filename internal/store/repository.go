@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"time"
 
 	"github.com/shevchukeugeni/gofermart/internal/types"
 )
@@ -12,15 +13,148 @@ type User interface {
 }
 
 type Order interface {
-	CreateOrder(ctx context.Context, orderNum, userId string) error
-	UpdateOrder(ctx context.Context, orderNum, status string, accrual float64) error
+	// CreateOrder stores the order with its total and goods; they are left
+	// alone when the number is registered already.
+	CreateOrder(ctx context.Context, order *types.Order) error
+	// CreateOrders registers all orders in one transaction and reports the
+	// outcome for each of them in the same order.
+	CreateOrders(ctx context.Context, orders []types.Order) ([]types.OrderUploadResult, error)
+	// UpdateOrder stores the status of an order and records the transition
+	// in its history. The accrual is multiplied by the user's tier
+	// multiplier; the stored value is returned. Reaching PROCESSED or
+	// INVALID queues a delivery for the webhooks of the order's merchant.
+	// PROCESSED and INVALID are final: updating such an order changes
+	// nothing and returns zero.
+	UpdateOrder(ctx context.Context, orderNum, status string, accrual float64) (float64, error)
+	// RecordCheck counts a poll of the accrual system for the order.
+	RecordCheck(ctx context.Context, orderNum string) error
+	// GetOrder returns an order of userID with its goods, polling stats and
+	// status history, oldest first. It fails with ErrNotFound when the user
+	// has no such order.
+	GetOrder(ctx context.Context, userID, number string) (*types.Order, error)
 	GetOrdersByUser(ctx context.Context, userId string) ([]types.Order, error)
 	GetProcessedOrdersByUser(ctx context.Context, userId string) ([]types.Order, error)
+	// GetPendingOrdersNumbers returns the number, status and user of every
+	// order waiting for a final accrual status.
 	GetPendingOrdersNumbers(ctx context.Context) ([]types.Order, error)
 }
 
 type Withdrawal interface {
-	CreateWithdrawal(ctx context.Context, orderNum, userId string, sum float64) error
+	// CreateWithdrawal spends sum points of userId on orderNum. A delivery is
+	// queued for the webhooks of merchantID unless it is empty.
+	CreateWithdrawal(ctx context.Context, orderNum, userId, merchantID string, sum float64) error
 	GetBalance(ctx context.Context, userID string) (*types.UserBalance, error)
+	// GetWithdrawalsByUser returns active and reversed withdrawals, newest
+	// first.
 	GetWithdrawalsByUser(ctx context.Context, userID string) ([]types.Withdrawal, error)
+	// ReverseWithdrawal refunds the points of an active withdrawal, marks it
+	// reversed with reason and returns it with its user. It fails with
+	// ErrNotFound for an unknown id and with ErrWithdrawalReversed when it
+	// was reversed before.
+	ReverseWithdrawal(ctx context.Context, id int64, reason string) (*types.Withdrawal, error)
+	// CreateTransfer moves sum points from senderID to the user with
+	// recipientLogin. It fails with ErrInsufficientBalance like
+	// CreateWithdrawal and with ErrTransferLimitExceeded when the sender's
+	// transfers since limit.Since would exceed limit.Max.
+	CreateTransfer(ctx context.Context, senderID, recipientLogin string, sum float64, limit types.TransferLimit) error
+	// GetTransfersByUser returns transfers sent and received, newest first.
+	GetTransfersByUser(ctx context.Context, userID string) ([]types.Transfer, error)
+	// GetTransactions returns the changes of the balance of userID selected
+	// by filter, oldest first. The balance after each of them accounts for
+	// the whole history, not only the selected page.
+	GetTransactions(ctx context.Context, userID string, filter types.TransactionFilter) ([]types.Transaction, error)
+	// WriteStatement passes w the balance of userID at from, the
+	// transactions made within [from, to), oldest first, and the balance at
+	// to. A zero from starts with the first transaction and a zero to ends
+	// with the last one.
+	WriteStatement(ctx context.Context, userID string, from, to time.Time, w types.StatementWriter) error
+	// GetExpiringPoints sums the unspent points of userID accrued before
+	// accruedBefore.
+	GetExpiringPoints(ctx context.Context, userID string, accruedBefore time.Time) (float64, error)
+	// ExpirePoints writes off the unspent points of all users accrued before
+	// accruedBefore and returns the amount written off per user.
+	ExpirePoints(ctx context.Context, accruedBefore time.Time) (map[string]float64, error)
 }
+
+type Tier interface {
+	// RecalculateTiers puts every user into the highest of tiers whose
+	// threshold the user's activity since since reaches, records the changes
+	// and returns how many users changed tier. tiers must be sorted by
+	// threshold, the first one starting at zero.
+	RecalculateTiers(ctx context.Context, tiers []types.Tier, basis string, since time.Time) (int, error)
+	// ResetTiers takes all users out of their tiers, so that accruals are no
+	// longer scaled, and returns how many users had one. The history is
+	// kept.
+	ResetTiers(ctx context.Context) (int, error)
+	// GetTier returns ErrNotFound for users not yet assigned a tier.
+	GetTier(ctx context.Context, userID string) (string, error)
+	GetTierHistory(ctx context.Context, userID string) ([]types.TierChange, error)
+}
+
+// Accrual stores the reward rules and orders of the in-process accrual
+// engine.
+type Accrual interface {
+	// CreateReward fails with ErrAlreadyExists when a reward with the same
+	// match is registered.
+	CreateReward(ctx context.Context, reward types.Reward) error
+	// SaveReward registers reward or replaces the values of the reward with
+	// the same match. It reports whether anything changed.
+	SaveReward(ctx context.Context, reward types.Reward) (bool, error)
+	// GetRewards returns the rewards in registration order.
+	GetRewards(ctx context.Context) ([]types.Reward, error)
+	// RegisterOrder stores a REGISTERED order; it fails with
+	// ErrAlreadyExists when the number is registered.
+	RegisterOrder(ctx context.Context, number string, goods []types.Good) error
+	// GetAccrualOrder fails with ErrNotFound for an unregistered number.
+	GetAccrualOrder(ctx context.Context, number string) (*types.AccrualOrder, error)
+	// SetAccrual records the final status of a REGISTERED order. It does
+	// nothing when the order was finalized before.
+	SetAccrual(ctx context.Context, number string, status types.Status, accrual float64) error
+}
+
+// Webhook stores merchants' webhooks and the outbox of their deliveries,
+// which Order.UpdateOrder and Withdrawal.CreateWithdrawal fill.
+type Webhook interface {
+	// CreateWebhook sets the ID and CreatedAt of webhook.
+	CreateWebhook(ctx context.Context, webhook *types.Webhook) error
+	// GetWebhooks returns all webhooks without their secrets, oldest first.
+	GetWebhooks(ctx context.Context) ([]types.Webhook, error)
+	// DeleteWebhook drops a webhook with its deliveries. It fails with
+	// ErrNotFound for an unknown id.
+	DeleteWebhook(ctx context.Context, id int64) error
+	// ClaimDeliveries returns up to limit pending deliveries that are due
+	// and postpones them by lease, so that concurrent workers skip them
+	// while they are being sent.
+	ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]types.WebhookDelivery, error)
+	CompleteDelivery(ctx context.Context, id int64) error
+	// FailDelivery counts a failed attempt. The delivery is retried after
+	// retryIn, or parked as DEAD when retryIn is zero.
+	FailDelivery(ctx context.Context, id int64, lastError string, retryIn time.Duration) error
+	// GetDeadDeliveries returns the parked deliveries, oldest first.
+	GetDeadDeliveries(ctx context.Context) ([]types.WebhookDelivery, error)
+	// ReplayDelivery queues a DEAD delivery again with its attempts reset.
+	// It fails with ErrNotFound unless the delivery is DEAD.
+	ReplayDelivery(ctx context.Context, id int64) error
+}
+
+// Outbox is the feed of domain events recorded by User.CreateUser,
+// Order.CreateOrder, Order.CreateOrders, Order.UpdateOrder and
+// Withdrawal.CreateWithdrawal in the same transaction as their changes.
+type Outbox interface {
+	// PublishEvents passes up to limit unpublished events, oldest first, to
+	// publish and marks the first n it reports as published; the rest are
+	// passed again next time. It returns n and the error of publish. Only
+	// one caller publishes at a time, the others get zero without calling
+	// publish.
+	PublishEvents(ctx context.Context, limit int, publish PublishFunc) (int, error)
+	// PruneEvents deletes the events published before publishedBefore and,
+	// when maxPending is positive, the oldest unpublished events beyond the
+	// newest maxPending. It returns how many events of each kind it deleted.
+	PruneEvents(ctx context.Context, publishedBefore time.Time, maxPending int) (published, pending int, err error)
+	// CountPending returns how many events wait to be published.
+	CountPending(ctx context.Context) (int, error)
+}
+
+// PublishFunc delivers events in order and reports how many of them were
+// delivered before it failed.
+type PublishFunc func(ctx context.Context, events []types.OutboxEvent) (int, error)
@@ -0,0 +1,1283 @@
+// Package storetest contains a conformance suite that every store backend
+// must pass.
+package storetest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+type Stores struct {
+	Users       store.User
+	Orders      store.Order
+	Withdrawals store.Withdrawal
+	Tiers       store.Tier
+	Accrual     store.Accrual
+	Webhooks    store.Webhook
+	Outbox      store.Outbox
+}
+
+// Run executes the suite. setup must return stores backed by an empty
+// database; it is called once per test.
+func Run(t *testing.T, setup func(t *testing.T) Stores) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s Stores)
+	}{
+		{"UserCreateAndGet", testUserCreateAndGet},
+		{"UserDuplicateLogin", testUserDuplicateLogin},
+		{"UserNotFound", testUserNotFound},
+		{"OrderOwnership", testOrderOwnership},
+		{"OrderConcurrentUpload", testOrderConcurrentUpload},
+		{"OrderBatch", testOrderBatch},
+		{"OrderBatchConcurrent", testOrderBatchConcurrent},
+		{"OrderDetail", testOrderDetail},
+		{"OrderChecks", testOrderChecks},
+		{"OrderProcessedFinal", testOrderProcessedFinal},
+		{"OrderMerchantScheme", testOrderMerchantScheme},
+		{"OrdersNewestFirst", testOrdersNewestFirst},
+		{"OrdersPendingAndProcessed", testOrdersPendingAndProcessed},
+		{"BalanceAndWithdrawals", testBalanceAndWithdrawals},
+		{"WithdrawalInsufficientBalance", testWithdrawalInsufficientBalance},
+		{"WithdrawalConcurrentSpend", testWithdrawalConcurrentSpend},
+		{"PointsSpentOldestFirst", testPointsSpentOldestFirst},
+		{"PointsExpire", testPointsExpire},
+		{"WithdrawalReversal", testWithdrawalReversal},
+		{"Transfers", testTransfers},
+		{"TransferLimit", testTransferLimit},
+		{"Transactions", testTransactions},
+		{"Statement", testStatement},
+		{"Webhooks", testWebhooks},
+		{"WebhookOutbox", testWebhookOutbox},
+		{"Outbox", testOutbox},
+		{"OutboxPrune", testOutboxPrune},
+		{"AccrualRewards", testAccrualRewards},
+		{"AccrualOrders", testAccrualOrders},
+		{"TiersEarned", testTiersEarned},
+		{"TiersSpent", testTiersSpent},
+		{"TiersReset", testTiersReset},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, setup(t))
+		})
+	}
+}
+
+func createUser(t *testing.T, s Stores, login string) *types.User {
+	t.Helper()
+
+	usr := (&types.UserLoginRequest{Login: login, Password: "password"}).User().ToDB()
+	require.NoError(t, s.Users.CreateUser(context.Background(), usr))
+	return usr
+}
+
+func createOrder(ctx context.Context, s Stores, number, userID string) error {
+	return s.Orders.CreateOrder(ctx, &types.Order{Number: number, UserID: userID})
+}
+
+func updateOrder(ctx context.Context, s Stores, number, status string, accrual float64) error {
+	_, err := s.Orders.UpdateOrder(ctx, number, status, accrual)
+	return err
+}
+
+// pause separates timestamps of consecutive writes.
+func pause() {
+	time.Sleep(5 * time.Millisecond)
+}
+
+func testUserCreateAndGet(t *testing.T, s Stores) {
+	ctx := context.Background()
+	usr := createUser(t, s, "alice")
+
+	got, err := s.Users.GetByLogin(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, usr.ID, got.ID)
+	assert.Equal(t, usr.Password, got.Password)
+	assert.False(t, got.CreatedAt.IsZero())
+
+	assert.Error(t, s.Users.CreateUser(ctx, nil))
+}
+
+func testUserDuplicateLogin(t *testing.T, s Stores) {
+	createUser(t, s, "alice")
+
+	dup := (&types.UserLoginRequest{Login: "alice", Password: "other"}).User().ToDB()
+	err := s.Users.CreateUser(context.Background(), dup)
+	assert.ErrorIs(t, err, types.ErrUserAlreadyExists)
+}
+
+func testUserNotFound(t *testing.T, s Stores) {
+	_, err := s.Users.GetByLogin(context.Background(), "nobody")
+	assert.ErrorIs(t, err, types.ErrNotFound)
+}
+
+func testOrderOwnership(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := createUser(t, s, "bob")
+
+	require.NoError(t, createOrder(ctx, s, "12345678903", alice.ID))
+	assert.ErrorIs(t, createOrder(ctx, s, "12345678903", alice.ID), types.ErrOrderAlreadyCreatedByUser)
+	assert.ErrorIs(t, createOrder(ctx, s, "12345678903", bob.ID), types.ErrOrderAlreadyCreatedByAnother)
+
+	orders, err := s.Orders.GetOrdersByUser(ctx, bob.ID)
+	require.NoError(t, err)
+	assert.Empty(t, orders)
+}
+
+func testOrderConcurrentUpload(t *testing.T, s Stores) {
+	ctx := context.Background()
+	users := []*types.User{createUser(t, s, "alice"), createUser(t, s, "bob"), createUser(t, s, "carol")}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		accepted int
+	)
+	for _, usr := range users {
+		wg.Add(1)
+		go func(userID string) {
+			defer wg.Done()
+			err := createOrder(ctx, s, "9278923470", userID)
+			if err == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+				return
+			}
+			assert.ErrorIs(t, err, types.ErrOrderAlreadyCreatedByAnother)
+		}(usr.ID)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, accepted)
+}
+
+// Batches overlapping in reverse order must not deadlock each other.
+func testOrderBatchConcurrent(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := createUser(t, s, "bob")
+
+	for i := 0; i < 20; i++ {
+		a, b := strconv.Itoa(1000+2*i), strconv.Itoa(1001+2*i)
+		var wg sync.WaitGroup
+		for _, upload := range []struct {
+			userID  string
+			numbers []string
+		}{
+			{alice.ID, []string{a, b}},
+			{bob.ID, []string{b, a}},
+		} {
+			wg.Add(1)
+			go func(userID string, numbers []string) {
+				defer wg.Done()
+				orders := make([]types.Order, 0, len(numbers))
+				for _, number := range numbers {
+					orders = append(orders, types.Order{Number: number, UserID: userID})
+				}
+				_, err := s.Orders.CreateOrders(ctx, orders)
+				assert.NoError(t, err)
+			}(upload.userID, upload.numbers)
+		}
+		wg.Wait()
+	}
+}
+
+func testOrderBatch(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := createUser(t, s, "bob")
+
+	require.NoError(t, createOrder(ctx, s, "346436439", bob.ID))
+	require.NoError(t, createOrder(ctx, s, "9278923470", alice.ID))
+
+	got, err := s.Orders.CreateOrders(ctx, []types.Order{
+		{Number: "12345678903", UserID: alice.ID},
+		{Number: "9278923470", UserID: alice.ID},
+		{Number: "346436439", UserID: alice.ID},
+		{Number: "12345678903", UserID: alice.ID},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []types.OrderUploadResult{
+		{Number: "12345678903", Result: types.UploadAccepted},
+		{Number: "9278923470", Result: types.UploadAlreadyYours},
+		{Number: "346436439", Result: types.UploadConflict},
+		{Number: "12345678903", Result: types.UploadAlreadyYours},
+	}, got)
+
+	orders, err := s.Orders.GetOrdersByUser(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Len(t, orders, 2)
+}
+
+func testOrderProcessedFinal(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+
+	require.NoError(t, createOrder(ctx, s, "12345678903", alice.ID))
+	applied, err := s.Orders.UpdateOrder(ctx, "12345678903", string(types.Processed), 100)
+	require.NoError(t, err)
+	assert.InDelta(t, 100, applied, 1e-9)
+
+	// Later updates would make the order disagree with its lot.
+	applied, err = s.Orders.UpdateOrder(ctx, "12345678903", string(types.Processed), 500)
+	require.NoError(t, err)
+	assert.Zero(t, applied)
+	applied, err = s.Orders.UpdateOrder(ctx, "12345678903", string(types.Invalid), 0)
+	require.NoError(t, err)
+	assert.Zero(t, applied)
+
+	order, err := s.Orders.GetOrder(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, types.Processed, order.Status)
+	assert.InDelta(t, 100, order.Accrual, 1e-9)
+	assert.Len(t, order.History, 1)
+
+	// An invalid order never gets points.
+	require.NoError(t, createOrder(ctx, s, "9278923470", alice.ID))
+	require.NoError(t, updateOrder(ctx, s, "9278923470", string(types.Invalid), 0))
+	applied, err = s.Orders.UpdateOrder(ctx, "9278923470", string(types.Processed), 50)
+	require.NoError(t, err)
+	assert.Zero(t, applied)
+	order, err = s.Orders.GetOrder(ctx, alice.ID, "9278923470")
+	require.NoError(t, err)
+	assert.Equal(t, types.Invalid, order.Status)
+	assert.Zero(t, order.Accrual)
+
+	balance, err := s.Withdrawals.GetBalance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.InDelta(t, 100, balance.Current, 1e-9)
+	transactions, err := s.Withdrawals.GetTransactions(ctx, alice.ID, types.TransactionFilter{})
+	require.NoError(t, err)
+	require.Len(t, transactions, 1)
+	assert.InDelta(t, 100, transactions[0].Amount, 1e-9)
+}
+
+func testOrderMerchantScheme(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+
+	require.NoError(t, s.Orders.CreateOrder(ctx, &types.Order{
+		Number:     "ACME-000123",
+		UserID:     alice.ID,
+		MerchantID: "acme",
+		Scheme:     types.SchemeRegex,
+	}))
+	pause()
+	require.NoError(t, createOrder(ctx, s, "12345678903", alice.ID))
+
+	orders, err := s.Orders.GetOrdersByUser(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, orders, 2)
+	assert.Equal(t, "", orders[0].MerchantID)
+	assert.Equal(t, types.SchemeLuhn, orders[0].Scheme)
+	assert.Equal(t, "acme", orders[1].MerchantID)
+	assert.Equal(t, types.SchemeRegex, orders[1].Scheme)
+}
+
+func testOrdersNewestFirst(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+
+	numbers := []string{"12345678903", "9278923470", "346436439"}
+	for _, number := range numbers {
+		require.NoError(t, createOrder(ctx, s, number, alice.ID))
+		pause()
+	}
+
+	orders, err := s.Orders.GetOrdersByUser(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, orders, 3)
+	for i, order := range orders {
+		assert.Equal(t, numbers[len(numbers)-1-i], order.Number)
+		assert.Equal(t, types.New, order.Status)
+		assert.False(t, order.UploadedAt.IsZero())
+	}
+}
+
+func testOrdersPendingAndProcessed(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+
+	for _, number := range []string{"12345678903", "9278923470", "346436439"} {
+		require.NoError(t, createOrder(ctx, s, number, alice.ID))
+	}
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processed), 500))
+	require.NoError(t, updateOrder(ctx, s, "9278923470", string(types.Invalid), 0))
+
+	pending, err := s.Orders.GetPendingOrdersNumbers(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, "346436439", pending[0].Number)
+	assert.Equal(t, types.New, pending[0].Status)
+	assert.Equal(t, alice.ID, pending[0].UserID)
+
+	processed, err := s.Orders.GetProcessedOrdersByUser(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, processed, 1)
+	assert.Equal(t, "12345678903", processed[0].Number)
+	assert.InDelta(t, 500, processed[0].Accrual, 1e-9)
+
+	orders, err := s.Orders.GetOrdersByUser(ctx, alice.ID)
+	require.NoError(t, err)
+	statuses := map[string]types.Status{}
+	for _, order := range orders {
+		statuses[order.Number] = order.Status
+	}
+	assert.Equal(t, map[string]types.Status{
+		"12345678903": types.Processed,
+		"9278923470":  types.Invalid,
+		"346436439":   types.New,
+	}, statuses)
+}
+
+func testBalanceAndWithdrawals(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+
+	balance, err := s.Withdrawals.GetBalance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, types.UserBalance{}, *balance)
+
+	require.NoError(t, createOrder(ctx, s, "12345678903", alice.ID))
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processed), 729.98))
+
+	require.NoError(t, s.Withdrawals.CreateWithdrawal(ctx, "2377225624", alice.ID, "", 100))
+	pause()
+	require.NoError(t, s.Withdrawals.CreateWithdrawal(ctx, "4561261212345467", alice.ID, "", 29.98))
+
+	balance, err = s.Withdrawals.GetBalance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.InDelta(t, 600, balance.Current, 1e-9)
+	assert.InDelta(t, 129.98, balance.Withdrawn, 1e-9)
+
+	withdrawals, err := s.Withdrawals.GetWithdrawalsByUser(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 2)
+	assert.Equal(t, "4561261212345467", withdrawals[0].Number)
+	assert.Equal(t, "2377225624", withdrawals[1].Number)
+	assert.False(t, withdrawals[0].ProcessedAt.IsZero())
+}
+
+func testWithdrawalInsufficientBalance(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+
+	require.NoError(t, createOrder(ctx, s, "12345678903", alice.ID))
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processed), 100))
+
+	err := s.Withdrawals.CreateWithdrawal(ctx, "2377225624", alice.ID, "", 100.5)
+	assert.ErrorIs(t, err, types.ErrInsufficientBalance)
+
+	withdrawals, err := s.Withdrawals.GetWithdrawalsByUser(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Empty(t, withdrawals)
+}
+
+func testWithdrawalConcurrentSpend(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+
+	require.NoError(t, createOrder(ctx, s, "12345678903", alice.ID))
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processed), 100))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.Withdrawals.CreateWithdrawal(ctx, "2377225624", alice.ID, "", 40)
+			if err != nil {
+				assert.ErrorIs(t, err, types.ErrInsufficientBalance)
+			}
+		}()
+	}
+	wg.Wait()
+
+	balance, err := s.Withdrawals.GetBalance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.InDelta(t, 20, balance.Current, 1e-9)
+	assert.InDelta(t, 80, balance.Withdrawn, 1e-9)
+}
+
+func testOrderDetail(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := createUser(t, s, "bob")
+	goods := []types.Good{{Description: "Чайник Bork", Price: 7000}, {Description: "Утюг", Price: 3000}}
+
+	require.NoError(t, s.Orders.CreateOrder(ctx, &types.Order{
+		Number: "12345678903",
+		UserID: alice.ID,
+		Total:  10000,
+		Goods:  goods,
+	}))
+	require.NoError(t, createOrder(ctx, s, "9278923470", alice.ID))
+
+	// A repeated upload keeps the original goods.
+	err := s.Orders.CreateOrder(ctx, &types.Order{Number: "12345678903", UserID: alice.ID, Total: 1, Goods: goods[:1]})
+	assert.ErrorIs(t, err, types.ErrOrderAlreadyCreatedByUser)
+
+	order, err := s.Orders.GetOrder(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, "12345678903", order.Number)
+	assert.Equal(t, types.New, order.Status)
+	assert.InDelta(t, 10000, order.Total, 1e-9)
+	assert.Equal(t, goods, order.Goods)
+
+	order, err = s.Orders.GetOrder(ctx, alice.ID, "9278923470")
+	require.NoError(t, err)
+	assert.Zero(t, order.Total)
+	assert.Empty(t, order.Goods)
+
+	orders, err := s.Orders.GetOrdersByUser(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, orders, 2)
+	assert.InDelta(t, 10000, orders[1].Total, 1e-9)
+	assert.Empty(t, orders[1].Goods)
+
+	_, err = s.Orders.GetOrder(ctx, bob.ID, "12345678903")
+	assert.ErrorIs(t, err, types.ErrNotFound)
+	_, err = s.Orders.GetOrder(ctx, alice.ID, "346436439")
+	assert.ErrorIs(t, err, types.ErrNotFound)
+}
+
+func testOrderChecks(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	require.NoError(t, createOrder(ctx, s, "12345678903", alice.ID))
+
+	order, err := s.Orders.GetOrder(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	assert.Zero(t, order.Attempts)
+	assert.Nil(t, order.LastCheckedAt)
+	assert.Empty(t, order.History)
+
+	require.NoError(t, s.Orders.RecordCheck(ctx, "12345678903"))
+	require.NoError(t, s.Orders.RecordCheck(ctx, "12345678903"))
+	require.NoError(t, s.Orders.RecordCheck(ctx, "346436439"))
+
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processing), 0))
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processing), 0))
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processed), 50))
+
+	order, err = s.Orders.GetOrder(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, 2, order.Attempts)
+	assert.NotNil(t, order.LastCheckedAt)
+	require.Len(t, order.History, 2)
+	assert.Equal(t, types.New, order.History[0].From)
+	assert.Equal(t, types.Processing, order.History[0].To)
+	assert.Equal(t, types.Processing, order.History[1].From)
+	assert.Equal(t, types.Processed, order.History[1].To)
+	assert.False(t, order.History[1].ChangedAt.Before(order.History[0].ChangedAt))
+
+	orders, err := s.Orders.GetOrdersByUser(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, orders, 1)
+	assert.Zero(t, orders[0].Attempts)
+	assert.Empty(t, orders[0].History)
+}
+
+func testWebhooks(t *testing.T, s Stores) {
+	ctx := context.Background()
+
+	acme := &types.Webhook{MerchantID: "acme", URL: "https://acme.example/hook", Secret: "s1", Events: types.WebhookEvents}
+	require.NoError(t, s.Webhooks.CreateWebhook(ctx, acme))
+	assert.NotZero(t, acme.ID)
+	assert.False(t, acme.CreatedAt.IsZero())
+	other := &types.Webhook{MerchantID: "other", URL: "https://other.example/hook", Secret: "s2", Events: []string{types.WebhookPointsSpent}}
+	require.NoError(t, s.Webhooks.CreateWebhook(ctx, other))
+
+	webhooks, err := s.Webhooks.GetWebhooks(ctx)
+	require.NoError(t, err)
+	require.Len(t, webhooks, 2)
+	assert.Equal(t, acme.ID, webhooks[0].ID)
+	assert.Equal(t, "https://acme.example/hook", webhooks[0].URL)
+	assert.Equal(t, types.WebhookEvents, webhooks[0].Events)
+	assert.Empty(t, webhooks[0].Secret)
+	assert.Equal(t, []string{types.WebhookPointsSpent}, webhooks[1].Events)
+
+	require.NoError(t, s.Webhooks.DeleteWebhook(ctx, acme.ID))
+	assert.ErrorIs(t, s.Webhooks.DeleteWebhook(ctx, acme.ID), types.ErrNotFound)
+
+	webhooks, err = s.Webhooks.GetWebhooks(ctx)
+	require.NoError(t, err)
+	require.Len(t, webhooks, 1)
+	assert.Equal(t, other.ID, webhooks[0].ID)
+}
+
+func testWebhookOutbox(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+
+	require.NoError(t, s.Webhooks.CreateWebhook(ctx, &types.Webhook{
+		MerchantID: "acme",
+		URL:        "https://acme.example/hook",
+		Secret:     "secret",
+		Events:     []string{types.WebhookOrderProcessed, types.WebhookPointsSpent},
+	}))
+
+	require.NoError(t, s.Orders.CreateOrder(ctx, &types.Order{Number: "12345678903", UserID: alice.ID, MerchantID: "acme"}))
+	require.NoError(t, s.Orders.CreateOrder(ctx, &types.Order{Number: "9278923470", UserID: alice.ID, MerchantID: "acme"}))
+	require.NoError(t, createOrder(ctx, s, "346436439", alice.ID))
+
+	// Only final statuses the webhook subscribed to are queued, and only once.
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processing), 0))
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processed), 100))
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processed), 100))
+	require.NoError(t, updateOrder(ctx, s, "9278923470", string(types.Invalid), 0))
+	require.NoError(t, updateOrder(ctx, s, "346436439", string(types.Processed), 50))
+	require.NoError(t, s.Withdrawals.CreateWithdrawal(ctx, "2377225624", alice.ID, "acme", 30))
+	require.NoError(t, s.Withdrawals.CreateWithdrawal(ctx, "4561261212345467", alice.ID, "", 10))
+
+	withdrawals, err := s.Withdrawals.GetWithdrawalsByUser(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 2)
+	assert.Equal(t, "acme", withdrawals[1].MerchantID)
+	assert.Empty(t, withdrawals[0].MerchantID)
+
+	deliveries, err := s.Webhooks.ClaimDeliveries(ctx, 10, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	processed, spent := deliveries[0], deliveries[1]
+	assert.Equal(t, types.WebhookOrderProcessed, processed.Event)
+	assert.Equal(t, "https://acme.example/hook", processed.URL)
+	assert.Equal(t, "secret", processed.Secret)
+	assert.Zero(t, processed.Attempts)
+
+	var payload types.WebhookPayload
+	require.NoError(t, json.Unmarshal(processed.Payload, &payload))
+	assert.Equal(t, types.WebhookOrderProcessed, payload.Event)
+	assert.Equal(t, "acme", payload.MerchantID)
+	assert.Equal(t, "12345678903", payload.Order)
+	assert.Equal(t, types.Processed, payload.Status)
+	assert.InDelta(t, 100, payload.Accrual, 1e-9)
+	assert.False(t, payload.OccurredAt.IsZero())
+
+	payload = types.WebhookPayload{}
+	require.NoError(t, json.Unmarshal(spent.Payload, &payload))
+	assert.Equal(t, types.WebhookPointsSpent, payload.Event)
+	assert.Equal(t, "2377225624", payload.Order)
+	assert.InDelta(t, 30, payload.Sum, 1e-9)
+
+	// Claimed deliveries are leased.
+	claimed, err := s.Webhooks.ClaimDeliveries(ctx, 10, time.Hour)
+	require.NoError(t, err)
+	assert.Empty(t, claimed)
+
+	require.NoError(t, s.Webhooks.CompleteDelivery(ctx, processed.ID))
+	require.NoError(t, s.Webhooks.FailDelivery(ctx, spent.ID, "unexpected status 500", 0))
+
+	dead, err := s.Webhooks.GetDeadDeliveries(ctx)
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, spent.ID, dead[0].ID)
+	assert.Equal(t, types.DeliveryDead, dead[0].Status)
+	assert.Equal(t, 1, dead[0].Attempts)
+	assert.Equal(t, "unexpected status 500", dead[0].LastError)
+	assert.Empty(t, dead[0].Secret)
+
+	assert.ErrorIs(t, s.Webhooks.ReplayDelivery(ctx, processed.ID), types.ErrNotFound)
+	require.NoError(t, s.Webhooks.ReplayDelivery(ctx, spent.ID))
+	assert.ErrorIs(t, s.Webhooks.ReplayDelivery(ctx, spent.ID), types.ErrNotFound)
+
+	claimed, err = s.Webhooks.ClaimDeliveries(ctx, 10, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+	assert.Equal(t, spent.ID, claimed[0].ID)
+	assert.Zero(t, claimed[0].Attempts)
+
+	dead, err = s.Webhooks.GetDeadDeliveries(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, dead)
+}
+
+func testOutbox(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := createUser(t, s, "bob")
+
+	require.NoError(t, s.Orders.CreateOrder(ctx, &types.Order{
+		Number: "12345678903", UserID: alice.ID, MerchantID: "acme", Total: 250,
+	}))
+	assert.ErrorIs(t, createOrder(ctx, s, "12345678903", alice.ID), types.ErrOrderAlreadyCreatedByUser)
+	_, err := s.Orders.CreateOrders(ctx, []types.Order{
+		{Number: "9278923470", UserID: bob.ID},
+		{Number: "12345678903", UserID: bob.ID},
+	})
+	require.NoError(t, err)
+
+	// Only reaching PROCESSED is an accrual, and only once.
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processing), 0))
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processed), 100))
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processed), 100))
+	require.NoError(t, updateOrder(ctx, s, "9278923470", string(types.Invalid), 0))
+	require.NoError(t, s.Withdrawals.CreateWithdrawal(ctx, "2377225624", alice.ID, "acme", 30))
+
+	// A partly failed batch keeps the rest for the next call, and nobody
+	// else publishes meanwhile.
+	errSink := errors.New("sink is down")
+	var first []types.OutboxEvent
+	n, err := s.Outbox.PublishEvents(ctx, 2, func(ctx context.Context, events []types.OutboxEvent) (int, error) {
+		first = events
+		nested, err := s.Outbox.PublishEvents(ctx, 10, func(context.Context, []types.OutboxEvent) (int, error) {
+			t.Error("concurrent publish")
+			return 0, nil
+		})
+		assert.NoError(t, err)
+		assert.Zero(t, nested)
+		return 1, errSink
+	})
+	assert.ErrorIs(t, err, errSink)
+	assert.Equal(t, 1, n)
+	require.Len(t, first, 2)
+
+	var events []types.OutboxEvent
+	n, err = s.Outbox.PublishEvents(ctx, 10, func(_ context.Context, batch []types.OutboxEvent) (int, error) {
+		events = batch
+		return len(batch), nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	require.Len(t, events, 5)
+	assert.Equal(t, first[1], events[0])
+
+	all := append([]types.OutboxEvent{first[0]}, events...)
+	for i, want := range []struct {
+		eventType string
+		userID    string
+	}{
+		{types.OutboxUserRegistered, alice.ID},
+		{types.OutboxUserRegistered, bob.ID},
+		{types.OutboxOrderUploaded, alice.ID},
+		{types.OutboxOrderUploaded, bob.ID},
+		{types.OutboxOrderAccrued, alice.ID},
+		{types.OutboxPointsWithdrawn, alice.ID},
+	} {
+		assert.Equal(t, want.eventType, all[i].Type, "event %d", i)
+		assert.Equal(t, want.userID, all[i].UserID, "event %d", i)
+		assert.False(t, all[i].CreatedAt.IsZero())
+		if i > 0 {
+			assert.Greater(t, all[i].ID, all[i-1].ID)
+		}
+	}
+
+	var registered types.UserRegisteredPayload
+	require.NoError(t, json.Unmarshal(all[0].Payload, &registered))
+	assert.Equal(t, "alice", registered.Login)
+
+	var uploaded types.OrderUploadedPayload
+	require.NoError(t, json.Unmarshal(all[2].Payload, &uploaded))
+	assert.Equal(t, types.OrderUploadedPayload{Number: "12345678903", MerchantID: "acme", Total: 250}, uploaded)
+
+	var accrued types.OrderAccruedPayload
+	require.NoError(t, json.Unmarshal(all[4].Payload, &accrued))
+	assert.Equal(t, "12345678903", accrued.Number)
+	assert.InDelta(t, 100, accrued.Accrual, 1e-9)
+
+	var withdrawn types.PointsWithdrawnPayload
+	require.NoError(t, json.Unmarshal(all[5].Payload, &withdrawn))
+	assert.Equal(t, "2377225624", withdrawn.Order)
+	assert.InDelta(t, 30, withdrawn.Sum, 1e-9)
+	assert.Equal(t, "acme", withdrawn.MerchantID)
+
+	n, err = s.Outbox.PublishEvents(ctx, 10, func(context.Context, []types.OutboxEvent) (int, error) {
+		t.Error("published events passed again")
+		return 0, nil
+	})
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func testOutboxPrune(t *testing.T, s Stores) {
+	ctx := context.Background()
+	createUser(t, s, "alice")
+	createUser(t, s, "bob")
+	carol := createUser(t, s, "carol")
+	cutoff := time.Now()
+	pause()
+
+	n, err := s.Outbox.PublishEvents(ctx, 1, func(_ context.Context, events []types.OutboxEvent) (int, error) {
+		return len(events), nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	// Events published since the cutoff are kept and nothing is capped.
+	published, pending, err := s.Outbox.PruneEvents(ctx, cutoff, 0)
+	require.NoError(t, err)
+	assert.Zero(t, published)
+	assert.Zero(t, pending)
+
+	pending, err = s.Outbox.CountPending(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, pending)
+
+	_, pending, err = s.Outbox.PruneEvents(ctx, time.Now().Add(time.Hour), 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, pending)
+	pending, err = s.Outbox.CountPending(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, pending)
+
+	// Only the newest unpublished event is left.
+	var events []types.OutboxEvent
+	_, err = s.Outbox.PublishEvents(ctx, 10, func(_ context.Context, batch []types.OutboxEvent) (int, error) {
+		events = batch
+		return len(batch), nil
+	})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, carol.ID, events[0].UserID)
+
+	_, _, err = s.Outbox.PruneEvents(ctx, time.Now(), -1)
+	assert.Error(t, err)
+}
+
+func testWithdrawalReversal(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+
+	require.NoError(t, createOrder(ctx, s, "12345678903", alice.ID))
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processed), 100))
+	require.NoError(t, s.Withdrawals.CreateWithdrawal(ctx, "2377225624", alice.ID, "", 80))
+
+	withdrawals, err := s.Withdrawals.GetWithdrawalsByUser(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 1)
+	assert.Equal(t, types.WithdrawalActive, withdrawals[0].Status)
+	assert.Nil(t, withdrawals[0].ReversedAt)
+	id := withdrawals[0].ID
+
+	_, err = s.Withdrawals.ReverseWithdrawal(ctx, id+1, "cancelled")
+	assert.ErrorIs(t, err, types.ErrNotFound)
+
+	reversed, err := s.Withdrawals.ReverseWithdrawal(ctx, id, "cancelled")
+	require.NoError(t, err)
+	assert.Equal(t, id, reversed.ID)
+	assert.Equal(t, alice.ID, reversed.UserID)
+	assert.Equal(t, types.WithdrawalReversed, reversed.Status)
+	assert.Equal(t, "cancelled", reversed.Reason)
+	assert.InDelta(t, 80, reversed.Sum, 1e-9)
+	require.NotNil(t, reversed.ReversedAt)
+
+	_, err = s.Withdrawals.ReverseWithdrawal(ctx, id, "again")
+	assert.ErrorIs(t, err, types.ErrWithdrawalReversed)
+
+	balance, err := s.Withdrawals.GetBalance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.InDelta(t, 100, balance.Current, 1e-9)
+	assert.InDelta(t, 0, balance.Withdrawn, 1e-9)
+
+	// Reversed withdrawals stay listed.
+	withdrawals, err = s.Withdrawals.GetWithdrawalsByUser(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 1)
+	assert.Equal(t, types.WithdrawalReversed, withdrawals[0].Status)
+	assert.Equal(t, "cancelled", withdrawals[0].Reason)
+
+	// The refund is spendable again.
+	require.NoError(t, s.Withdrawals.CreateWithdrawal(ctx, "2377225624", alice.ID, "", 100))
+	left, err := s.Withdrawals.GetExpiringPoints(ctx, alice.ID, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.InDelta(t, 0, left, 1e-9)
+}
+
+func testPointsSpentOldestFirst(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := createUser(t, s, "bob")
+
+	require.NoError(t, createOrder(ctx, s, "12345678903", alice.ID))
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processed), 100))
+	require.NoError(t, createOrder(ctx, s, "346436439", bob.ID))
+	require.NoError(t, updateOrder(ctx, s, "346436439", string(types.Processed), 70))
+	pause()
+	between := time.Now()
+	pause()
+	require.NoError(t, createOrder(ctx, s, "9278923470", alice.ID))
+	require.NoError(t, updateOrder(ctx, s, "9278923470", string(types.Processed), 50))
+	later := time.Now().Add(time.Hour)
+
+	old, err := s.Withdrawals.GetExpiringPoints(ctx, alice.ID, between)
+	require.NoError(t, err)
+	assert.InDelta(t, 100, old, 1e-9)
+
+	require.NoError(t, s.Withdrawals.CreateWithdrawal(ctx, "2377225624", alice.ID, "", 120))
+
+	old, err = s.Withdrawals.GetExpiringPoints(ctx, alice.ID, between)
+	require.NoError(t, err)
+	assert.InDelta(t, 0, old, 1e-9)
+
+	all, err := s.Withdrawals.GetExpiringPoints(ctx, alice.ID, later)
+	require.NoError(t, err)
+	assert.InDelta(t, 30, all, 1e-9)
+
+	others, err := s.Withdrawals.GetExpiringPoints(ctx, bob.ID, later)
+	require.NoError(t, err)
+	assert.InDelta(t, 70, others, 1e-9)
+}
+
+func testPointsExpire(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+
+	require.NoError(t, createOrder(ctx, s, "12345678903", alice.ID))
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processed), 100))
+	require.NoError(t, s.Withdrawals.CreateWithdrawal(ctx, "2377225624", alice.ID, "", 40))
+	pause()
+	cutoff := time.Now()
+	pause()
+	require.NoError(t, createOrder(ctx, s, "9278923470", alice.ID))
+	require.NoError(t, updateOrder(ctx, s, "9278923470", string(types.Processed), 50))
+
+	expired, err := s.Withdrawals.ExpirePoints(ctx, cutoff)
+	require.NoError(t, err)
+	require.Len(t, expired, 1)
+	assert.InDelta(t, 60, expired[alice.ID], 1e-9)
+
+	expired, err = s.Withdrawals.ExpirePoints(ctx, cutoff)
+	require.NoError(t, err)
+	assert.Empty(t, expired)
+
+	balance, err := s.Withdrawals.GetBalance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.InDelta(t, 50, balance.Current, 1e-9)
+	assert.InDelta(t, 40, balance.Withdrawn, 1e-9)
+
+	err = s.Withdrawals.CreateWithdrawal(ctx, "4561261212345467", alice.ID, "", 60)
+	assert.ErrorIs(t, err, types.ErrInsufficientBalance)
+	require.NoError(t, s.Withdrawals.CreateWithdrawal(ctx, "4561261212345467", alice.ID, "", 50))
+
+	left, err := s.Withdrawals.GetExpiringPoints(ctx, alice.ID, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.InDelta(t, 0, left, 1e-9)
+}
+
+var testTiers = []types.Tier{
+	{Name: "bronze", Threshold: 0, Multiplier: 1},
+	{Name: "silver", Threshold: 100, Multiplier: 2},
+}
+
+func testTiersEarned(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := createUser(t, s, "bob")
+	past := time.Now().Add(-time.Hour)
+
+	_, err := s.Tiers.GetTier(ctx, alice.ID)
+	assert.ErrorIs(t, err, types.ErrNotFound)
+
+	require.NoError(t, createOrder(ctx, s, "12345678903", alice.ID))
+	accrued, err := s.Orders.UpdateOrder(ctx, "12345678903", string(types.Processed), 150)
+	require.NoError(t, err)
+	assert.InDelta(t, 150, accrued, 1e-9)
+
+	changed, err := s.Tiers.RecalculateTiers(ctx, testTiers, types.TierBasisEarned, past)
+	require.NoError(t, err)
+	assert.Equal(t, 2, changed)
+
+	tier, err := s.Tiers.GetTier(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "silver", tier)
+	tier, err = s.Tiers.GetTier(ctx, bob.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "bronze", tier)
+
+	// Silver doubles further accruals.
+	require.NoError(t, createOrder(ctx, s, "9278923470", alice.ID))
+	accrued, err = s.Orders.UpdateOrder(ctx, "9278923470", string(types.Processed), 10)
+	require.NoError(t, err)
+	assert.InDelta(t, 20, accrued, 1e-9)
+
+	balance, err := s.Withdrawals.GetBalance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.InDelta(t, 170, balance.Current, 1e-9)
+
+	changed, err = s.Tiers.RecalculateTiers(ctx, testTiers, types.TierBasisEarned, past)
+	require.NoError(t, err)
+	assert.Equal(t, 0, changed)
+
+	// Once the accruals leave the window alice drops back.
+	pause()
+	changed, err = s.Tiers.RecalculateTiers(ctx, testTiers, types.TierBasisEarned, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 1, changed)
+
+	history, err := s.Tiers.GetTierHistory(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, "silver", history[0].From)
+	assert.Equal(t, "bronze", history[0].To)
+	assert.Equal(t, "", history[1].From)
+	assert.Equal(t, "silver", history[1].To)
+	assert.InDelta(t, 150, history[1].Total, 1e-9)
+	assert.False(t, history[0].ChangedAt.IsZero())
+}
+
+func testTiersReset(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	past := time.Now().Add(-time.Hour)
+
+	require.NoError(t, createOrder(ctx, s, "12345678903", alice.ID))
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processed), 150))
+	_, err := s.Tiers.RecalculateTiers(ctx, testTiers, types.TierBasisEarned, past)
+	require.NoError(t, err)
+
+	n, err := s.Tiers.ResetTiers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, err = s.Tiers.GetTier(ctx, alice.ID)
+	assert.ErrorIs(t, err, types.ErrNotFound)
+	history, err := s.Tiers.GetTierHistory(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+
+	// The silver multiplier no longer applies.
+	require.NoError(t, createOrder(ctx, s, "9278923470", alice.ID))
+	accrued, err := s.Orders.UpdateOrder(ctx, "9278923470", string(types.Processed), 10)
+	require.NoError(t, err)
+	assert.InDelta(t, 10, accrued, 1e-9)
+}
+
+func testTiersSpent(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	past := time.Now().Add(-time.Hour)
+
+	require.NoError(t, createOrder(ctx, s, "12345678903", alice.ID))
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processed), 150))
+
+	_, err := s.Tiers.RecalculateTiers(ctx, testTiers, types.TierBasisSpent, past)
+	require.NoError(t, err)
+	tier, err := s.Tiers.GetTier(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "bronze", tier)
+
+	require.NoError(t, s.Withdrawals.CreateWithdrawal(ctx, "2377225624", alice.ID, "", 100))
+
+	changed, err := s.Tiers.RecalculateTiers(ctx, testTiers, types.TierBasisSpent, past)
+	require.NoError(t, err)
+	assert.Equal(t, 1, changed)
+	tier, err = s.Tiers.GetTier(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "silver", tier)
+
+	// Reversed withdrawals are not spending.
+	withdrawals, err := s.Withdrawals.GetWithdrawalsByUser(ctx, alice.ID)
+	require.NoError(t, err)
+	_, err = s.Withdrawals.ReverseWithdrawal(ctx, withdrawals[0].ID, "cancelled")
+	require.NoError(t, err)
+	_, err = s.Tiers.RecalculateTiers(ctx, testTiers, types.TierBasisSpent, past)
+	require.NoError(t, err)
+	tier, err = s.Tiers.GetTier(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "bronze", tier)
+
+	_, err = s.Tiers.RecalculateTiers(ctx, testTiers, "visits", past)
+	assert.Error(t, err)
+}
+
+func testTransfers(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := createUser(t, s, "bob")
+	noLimit := types.TransferLimit{}
+
+	require.NoError(t, createOrder(ctx, s, "12345678903", alice.ID))
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processed), 100))
+
+	assert.ErrorIs(t, s.Withdrawals.CreateTransfer(ctx, alice.ID, "carol", 10, noLimit), types.ErrNotFound)
+	assert.ErrorIs(t, s.Withdrawals.CreateTransfer(ctx, alice.ID, "alice", 10, noLimit), types.ErrTransferToSelf)
+	assert.ErrorIs(t, s.Withdrawals.CreateTransfer(ctx, alice.ID, "bob", 100.5, noLimit), types.ErrInsufficientBalance)
+
+	require.NoError(t, s.Withdrawals.CreateTransfer(ctx, alice.ID, "bob", 70, noLimit))
+	pause()
+	require.NoError(t, s.Withdrawals.CreateTransfer(ctx, bob.ID, "alice", 20, noLimit))
+
+	balance, err := s.Withdrawals.GetBalance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.InDelta(t, 50, balance.Current, 1e-9)
+	assert.InDelta(t, 0, balance.Withdrawn, 1e-9)
+	balance, err = s.Withdrawals.GetBalance(ctx, bob.ID)
+	require.NoError(t, err)
+	assert.InDelta(t, 50, balance.Current, 1e-9)
+
+	// Received points are spendable and tracked as lots.
+	require.NoError(t, s.Withdrawals.CreateWithdrawal(ctx, "2377225624", bob.ID, "", 50))
+	left, err := s.Withdrawals.GetExpiringPoints(ctx, bob.ID, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.InDelta(t, 0, left, 1e-9)
+	left, err = s.Withdrawals.GetExpiringPoints(ctx, alice.ID, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.InDelta(t, 50, left, 1e-9)
+
+	transfers, err := s.Withdrawals.GetTransfersByUser(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, transfers, 2)
+	assert.Equal(t, types.TransferIn, transfers[0].Direction)
+	assert.Equal(t, "bob", transfers[0].Counterparty)
+	assert.InDelta(t, 20, transfers[0].Sum, 1e-9)
+	assert.Equal(t, types.TransferOut, transfers[1].Direction)
+	assert.Equal(t, "bob", transfers[1].Counterparty)
+	assert.InDelta(t, 70, transfers[1].Sum, 1e-9)
+	assert.False(t, transfers[1].CreatedAt.IsZero())
+}
+
+func testTransferLimit(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	createUser(t, s, "bob")
+
+	require.NoError(t, createOrder(ctx, s, "12345678903", alice.ID))
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processed), 100))
+
+	limit := types.TransferLimit{Max: 50, Since: time.Now().Add(-time.Hour)}
+	require.NoError(t, s.Withdrawals.CreateTransfer(ctx, alice.ID, "bob", 30, limit))
+	assert.ErrorIs(t, s.Withdrawals.CreateTransfer(ctx, alice.ID, "bob", 30, limit), types.ErrTransferLimitExceeded)
+	require.NoError(t, s.Withdrawals.CreateTransfer(ctx, alice.ID, "bob", 20, limit))
+
+	// Earlier transfers fall out of a window starting later.
+	pause()
+	limit.Since = time.Now()
+	require.NoError(t, s.Withdrawals.CreateTransfer(ctx, alice.ID, "bob", 30, limit))
+}
+
+func testTransactions(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := createUser(t, s, "bob")
+	all := types.TransactionFilter{}
+
+	none, err := s.Withdrawals.GetTransactions(ctx, alice.ID, all)
+	require.NoError(t, err)
+	assert.Empty(t, none)
+
+	require.NoError(t, createOrder(ctx, s, "12345678903", alice.ID))
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processed), 100))
+	pause()
+	require.NoError(t, s.Withdrawals.CreateWithdrawal(ctx, "2377225624", alice.ID, "", 30))
+	pause()
+	from := time.Now()
+	pause()
+	withdrawals, err := s.Withdrawals.GetWithdrawalsByUser(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 1)
+	_, err = s.Withdrawals.ReverseWithdrawal(ctx, withdrawals[0].ID, "cancelled")
+	require.NoError(t, err)
+	pause()
+	require.NoError(t, s.Withdrawals.CreateTransfer(ctx, alice.ID, "bob", 20, types.TransferLimit{}))
+	pause()
+	to := time.Now()
+	pause()
+	require.NoError(t, s.Withdrawals.CreateTransfer(ctx, bob.ID, "alice", 5, types.TransferLimit{}))
+	pause()
+	cutoff := time.Now()
+	pause()
+	_, err = s.Withdrawals.ExpirePoints(ctx, cutoff)
+	require.NoError(t, err)
+
+	want := []types.Transaction{
+		{Type: types.TransactionAccrual, Order: "12345678903", Amount: 100, Balance: 100},
+		{Type: types.TransactionWithdrawal, Order: "2377225624", Amount: -30, Balance: 70},
+		{Type: types.TransactionReversal, Order: "2377225624", Amount: 30, Balance: 100},
+		{Type: types.TransactionTransferOut, Counterparty: "bob", Amount: -20, Balance: 80},
+		{Type: types.TransactionTransferIn, Counterparty: "bob", Amount: 5, Balance: 85},
+		{Type: types.TransactionExpiration, Amount: -85, Balance: 0},
+	}
+	check := func(want, got []types.Transaction) {
+		t.Helper()
+		require.Len(t, got, len(want))
+		for i := range want {
+			assert.Equal(t, want[i].Type, got[i].Type, i)
+			assert.Equal(t, want[i].Order, got[i].Order, i)
+			assert.Equal(t, want[i].Counterparty, got[i].Counterparty, i)
+			assert.InDelta(t, want[i].Amount, got[i].Amount, 1e-9, i)
+			assert.InDelta(t, want[i].Balance, got[i].Balance, 1e-9, i)
+			assert.False(t, got[i].ProcessedAt.IsZero(), i)
+			if i > 0 {
+				assert.False(t, got[i].ProcessedAt.Before(got[i-1].ProcessedAt), i)
+			}
+		}
+	}
+
+	got, err := s.Withdrawals.GetTransactions(ctx, alice.ID, all)
+	require.NoError(t, err)
+	check(want, got)
+
+	// Balances stay those of the full history when filtering or paging.
+	got, err = s.Withdrawals.GetTransactions(ctx, alice.ID, types.TransactionFilter{From: from, To: to})
+	require.NoError(t, err)
+	check(want[2:4], got)
+	got, err = s.Withdrawals.GetTransactions(ctx, alice.ID, types.TransactionFilter{Limit: 2, Offset: 1})
+	require.NoError(t, err)
+	check(want[1:3], got)
+	got, err = s.Withdrawals.GetTransactions(ctx, alice.ID, types.TransactionFilter{From: from, Offset: 10})
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	got, err = s.Withdrawals.GetTransactions(ctx, bob.ID, all)
+	require.NoError(t, err)
+	check([]types.Transaction{
+		{Type: types.TransactionTransferIn, Counterparty: "alice", Amount: 20, Balance: 20},
+		{Type: types.TransactionTransferOut, Counterparty: "alice", Amount: -5, Balance: 15},
+		{Type: types.TransactionExpiration, Amount: -15, Balance: 0},
+	}, got)
+}
+
+// statementRecorder keeps what WriteStatement passes it.
+type statementRecorder struct {
+	opening, closing *types.UserBalance
+	transactions     []types.Transaction
+}
+
+func (r *statementRecorder) WriteOpening(balance types.UserBalance) error {
+	r.opening = &balance
+	return nil
+}
+
+func (r *statementRecorder) WriteTransaction(t *types.Transaction) error {
+	r.transactions = append(r.transactions, *t)
+	return nil
+}
+
+func (r *statementRecorder) WriteClosing(balance types.UserBalance) error {
+	r.closing = &balance
+	return nil
+}
+
+func testStatement(t *testing.T, s Stores) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	createUser(t, s, "bob")
+
+	require.NoError(t, createOrder(ctx, s, "12345678903", alice.ID))
+	require.NoError(t, updateOrder(ctx, s, "12345678903", string(types.Processed), 100))
+	require.NoError(t, s.Withdrawals.CreateWithdrawal(ctx, "2377225624", alice.ID, "", 30))
+	require.NoError(t, s.Withdrawals.CreateWithdrawal(ctx, "4561261212345467", alice.ID, "", 10))
+	withdrawals, err := s.Withdrawals.GetWithdrawalsByUser(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 2)
+	pause()
+	from := time.Now()
+	pause()
+	_, err = s.Withdrawals.ReverseWithdrawal(ctx, withdrawals[1].ID, "cancelled")
+	require.NoError(t, err)
+	pause()
+	require.NoError(t, s.Withdrawals.CreateTransfer(ctx, alice.ID, "bob", 20, types.TransferLimit{}))
+	pause()
+	to := time.Now()
+	pause()
+	require.NoError(t, createOrder(ctx, s, "9278923470", alice.ID))
+	require.NoError(t, updateOrder(ctx, s, "9278923470", string(types.Processed), 50))
+
+	var rec statementRecorder
+	require.NoError(t, s.Withdrawals.WriteStatement(ctx, alice.ID, from, to, &rec))
+	require.NotNil(t, rec.opening)
+	assert.InDelta(t, 60, rec.opening.Current, 1e-9)
+	assert.InDelta(t, 40, rec.opening.Withdrawn, 1e-9)
+	require.Len(t, rec.transactions, 2)
+	assert.Equal(t, types.TransactionReversal, rec.transactions[0].Type)
+	assert.Equal(t, "2377225624", rec.transactions[0].Order)
+	assert.InDelta(t, 90, rec.transactions[0].Balance, 1e-9)
+	assert.Equal(t, types.TransactionTransferOut, rec.transactions[1].Type)
+	assert.InDelta(t, 70, rec.transactions[1].Balance, 1e-9)
+	require.NotNil(t, rec.closing)
+	assert.InDelta(t, 70, rec.closing.Current, 1e-9)
+	assert.InDelta(t, 10, rec.closing.Withdrawn, 1e-9)
+
+	// Over the whole history the statement ends with the current balance.
+	rec = statementRecorder{}
+	require.NoError(t, s.Withdrawals.WriteStatement(ctx, alice.ID, time.Time{}, time.Time{}, &rec))
+	assert.Zero(t, *rec.opening)
+	assert.Len(t, rec.transactions, 6)
+	balance, err := s.Withdrawals.GetBalance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.InDelta(t, balance.Current, rec.closing.Current, 1e-9)
+	assert.InDelta(t, balance.Withdrawn, rec.closing.Withdrawn, 1e-9)
+}
+
+func testAccrualRewards(t *testing.T, s Stores) {
+	ctx := context.Background()
+
+	rewards, err := s.Accrual.GetRewards(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, rewards)
+
+	bork := types.Reward{Match: "Bork", Reward: 10, RewardType: types.RewardPercent}
+	lg := types.Reward{Match: "LG", Reward: 50, RewardType: types.RewardPoints}
+	require.NoError(t, s.Accrual.CreateReward(ctx, bork))
+	require.NoError(t, s.Accrual.CreateReward(ctx, lg))
+	assert.ErrorIs(t, s.Accrual.CreateReward(ctx, types.Reward{Match: "Bork", Reward: 1, RewardType: types.RewardPoints}), types.ErrAlreadyExists)
+
+	rewards, err = s.Accrual.GetRewards(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []types.Reward{bork, lg}, rewards)
+
+	// Saving replaces the values and keeps the order.
+	changed, err := s.Accrual.SaveReward(ctx, bork)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	bork.Reward = 15
+	changed, err = s.Accrual.SaveReward(ctx, bork)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	samsung := types.Reward{Match: "Samsung", Reward: 5, RewardType: types.RewardPercent}
+	changed, err = s.Accrual.SaveReward(ctx, samsung)
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	rewards, err = s.Accrual.GetRewards(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []types.Reward{bork, lg, samsung}, rewards)
+}
+
+func testAccrualOrders(t *testing.T, s Stores) {
+	ctx := context.Background()
+	goods := []types.Good{{Description: "Чайник Bork", Price: 7000}, {Description: "Fork", Price: 12.5}}
+
+	_, err := s.Accrual.GetAccrualOrder(ctx, "12345678903")
+	assert.ErrorIs(t, err, types.ErrNotFound)
+
+	require.NoError(t, s.Accrual.RegisterOrder(ctx, "12345678903", goods))
+	assert.ErrorIs(t, s.Accrual.RegisterOrder(ctx, "12345678903", nil), types.ErrAlreadyExists)
+	require.NoError(t, s.Accrual.RegisterOrder(ctx, "9278923470", nil))
+
+	order, err := s.Accrual.GetAccrualOrder(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, "12345678903", order.Number)
+	assert.Equal(t, goods, order.Goods)
+	assert.Equal(t, types.Registered, order.Status)
+	assert.WithinDuration(t, time.Now(), order.RegisteredAt, time.Minute)
+
+	order, err = s.Accrual.GetAccrualOrder(ctx, "9278923470")
+	require.NoError(t, err)
+	assert.Empty(t, order.Goods)
+
+	require.NoError(t, s.Accrual.SetAccrual(ctx, "12345678903", types.Processed, 700))
+	// Final statuses stick.
+	require.NoError(t, s.Accrual.SetAccrual(ctx, "12345678903", types.Invalid, 0))
+
+	order, err = s.Accrual.GetAccrualOrder(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, types.Processed, order.Status)
+	assert.InDelta(t, 700, order.Accrual, 1e-9)
+}
@@ -0,0 +1,139 @@
+package tier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/store/postgres"
+	"github.com/shevchukeugeni/gofermart/internal/tracing"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+type repo struct {
+	db *pgxpool.Pool
+}
+
+func NewRepository(db *pgxpool.Pool) store.Tier {
+	return &repo{db: db}
+}
+
+// activity selects user_id and total for every user with activity since $4.
+// Points received from other users or refunded do not count as earned, and
+// reversed withdrawals do not count as spent.
+var activity = map[string]string{
+	types.TierBasisEarned: "SELECT user_id, SUM(amount) AS total FROM accrual_lots WHERE order_number IS NOT NULL AND accrued_at >= $4::timestamptz GROUP BY user_id",
+	types.TierBasisSpent:  "SELECT user_id, SUM(sum) AS total FROM withdrawals WHERE status = 'ACTIVE' AND processed_at >= $4::timestamptz GROUP BY user_id",
+}
+
+func (repo *repo) RecalculateTiers(ctx context.Context, tiers []types.Tier, basis string, since time.Time) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "tier.RecalculateTiers")
+	defer func() { tracing.End(span, err) }()
+
+	query, ok := activity[basis]
+	if !ok {
+		return 0, fmt.Errorf("repository: unknown tier basis %q", basis)
+	}
+	if len(tiers) == 0 {
+		return 0, errors.New("repository: incorrect parameters")
+	}
+
+	names := make([]string, len(tiers))
+	thresholds := make([]float64, len(tiers))
+	multipliers := make([]float64, len(tiers))
+	for i, tier := range tiers {
+		names[i], thresholds[i], multipliers[i] = tier.Name, tier.Threshold, tier.Multiplier
+	}
+
+	// The first tier starts at zero, so every user matches at least one.
+	// Multiplier changes are applied silently; only tier changes make it to
+	// the history.
+	tag, err := repo.db.Exec(ctx, `
+		WITH def AS (
+			SELECT * FROM unnest($1::text[], $2::float8[], $3::float8[]) AS d(name, threshold, multiplier)
+		), activity AS (
+			SELECT u.id AS user_id, COALESCE(a.total, 0) AS total
+			FROM users u LEFT JOIN (`+query+`) a ON a.user_id = u.id
+		), target AS (
+			SELECT DISTINCT ON (a.user_id) a.user_id, d.name, d.multiplier, a.total
+			FROM activity a JOIN def d ON d.threshold <= a.total
+			ORDER BY a.user_id, d.threshold DESC
+		), changed AS (
+			SELECT t.user_id, t.name, t.multiplier, t.total, ut.tier AS old_tier
+			FROM target t LEFT JOIN user_tiers ut ON ut.user_id = t.user_id
+			WHERE ut.tier IS DISTINCT FROM t.name OR ut.multiplier IS DISTINCT FROM t.multiplier::decimal
+		), upsert AS (
+			INSERT INTO user_tiers(user_id, tier, multiplier, updated_at)
+			SELECT user_id, name, multiplier, now() FROM changed
+			ON CONFLICT (user_id) DO UPDATE
+				SET tier = EXCLUDED.tier, multiplier = EXCLUDED.multiplier, updated_at = EXCLUDED.updated_at
+		)
+		INSERT INTO tier_history(user_id, from_tier, to_tier, total)
+		SELECT user_id, old_tier, name, total FROM changed
+		WHERE old_tier IS DISTINCT FROM name`,
+		names, thresholds, multipliers, since)
+	if err != nil {
+		return 0, postgres.MapError(err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+func (repo *repo) ResetTiers(ctx context.Context) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "tier.ResetTiers")
+	defer func() { tracing.End(span, err) }()
+
+	tag, err := repo.db.Exec(ctx, "DELETE FROM user_tiers")
+	if err != nil {
+		return 0, postgres.MapError(err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+func (repo *repo) GetTier(ctx context.Context, userID string) (_ string, err error) {
+	ctx, span := tracing.Start(ctx, "tier.GetTier")
+	defer func() { tracing.End(span, err) }()
+
+	if userID == "" {
+		return "", errors.New("repository: incorrect parameters")
+	}
+
+	var tier string
+	err = repo.db.QueryRow(ctx, "SELECT tier FROM user_tiers WHERE user_id=$1", userID).Scan(&tier)
+	if err != nil {
+		return "", postgres.MapError(err)
+	}
+	return tier, nil
+}
+
+func (repo *repo) GetTierHistory(ctx context.Context, userID string) (_ []types.TierChange, err error) {
+	ctx, span := tracing.Start(ctx, "tier.GetTierHistory")
+	defer func() { tracing.End(span, err) }()
+
+	if userID == "" {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	ret := []types.TierChange{}
+	rows, err := repo.db.Query(ctx, `
+		SELECT COALESCE(from_tier, ''), to_tier, total, changed_at
+		FROM tier_history WHERE user_id=$1 ORDER BY changed_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, postgres.MapError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		change := types.TierChange{}
+		err := rows.Scan(&change.From, &change.To, &change.Total, &change.ChangedAt)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, change)
+	}
+
+	return ret, rows.Err()
+}
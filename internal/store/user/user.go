@@ -2,31 +2,45 @@ package user
 
 import (
 	"context"
-	"database/sql"
 	"errors"
-	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
 
 	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/store/postgres"
+	"github.com/shevchukeugeni/gofermart/internal/tracing"
 	"github.com/shevchukeugeni/gofermart/internal/types"
 )
 
 type repo struct {
-	db *sql.DB
+	db *pgxpool.Pool
 }
 
-func NewRepository(db *sql.DB) store.User {
+func NewRepository(db *pgxpool.Pool) store.User {
 	return &repo{db: db}
 }
 
-func (repo *repo) CreateUser(ctx context.Context, user *types.User) error {
+func (repo *repo) CreateUser(ctx context.Context, user *types.User) (err error) {
+	ctx, span := tracing.Start(ctx, "user.CreateUser")
+	defer func() { tracing.End(span, err) }()
+
 	if user == nil {
 		return errors.New("repository: incorrect parameters")
 	}
 
-	_, err := repo.db.ExecContext(ctx,
-		"INSERT INTO users(id, login, password) VALUES ($1, $2, $3)", user.ID, user.Login, user.Password)
+	// The registration event needs no user lock: no other event of the user
+	// can be written before the user is committed.
+	_, err = repo.db.Exec(ctx, `
+		WITH usr AS (
+			INSERT INTO users(id, login, password) VALUES ($1, $2, $3)
+			RETURNING id, login
+		)
+		INSERT INTO outbox(user_id, event_type, payload)
+		SELECT id, $4, jsonb_build_object('login', login) FROM usr`,
+		user.ID, user.Login, user.Password, types.OutboxUserRegistered)
 	if err != nil {
-		if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
+		err = postgres.MapError(err)
+		if errors.Is(err, types.ErrAlreadyExists) {
 			return types.ErrUserAlreadyExists
 		}
 		return err
@@ -34,17 +48,20 @@ func (repo *repo) CreateUser(ctx context.Context, user *types.User) error {
 	return nil
 }
 
-func (repo *repo) GetByLogin(ctx context.Context, login string) (*types.User, error) {
+func (repo *repo) GetByLogin(ctx context.Context, login string) (_ *types.User, err error) {
+	ctx, span := tracing.Start(ctx, "user.GetByLogin")
+	defer func() { tracing.End(span, err) }()
+
 	if login == "" {
 		return nil, errors.New("repository: incorrect parameters")
 	}
 
 	ret := types.User{Login: login}
 
-	err := repo.db.QueryRowContext(ctx, "SELECT id, password, created_at FROM users WHERE login=$1", login).Scan(
+	err = repo.db.QueryRow(ctx, "SELECT id, password, created_at FROM users WHERE login=$1", login).Scan(
 		&ret.ID, &ret.Password, &ret.CreatedAt)
 	if err != nil {
-		return nil, err
+		return nil, postgres.MapError(err)
 	}
 
 	return &ret, nil
@@ -0,0 +1,186 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/store/postgres"
+	"github.com/shevchukeugeni/gofermart/internal/tracing"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+type repo struct {
+	db *pgxpool.Pool
+}
+
+func NewRepository(db *pgxpool.Pool) store.Webhook {
+	return &repo{db: db}
+}
+
+func (repo *repo) CreateWebhook(ctx context.Context, webhook *types.Webhook) (err error) {
+	ctx, span := tracing.Start(ctx, "webhook.CreateWebhook")
+	defer func() { tracing.End(span, err) }()
+
+	if webhook == nil || webhook.MerchantID == "" || webhook.URL == "" || len(webhook.Events) == 0 {
+		return errors.New("repository: incorrect parameters")
+	}
+
+	err = repo.db.QueryRow(ctx, `
+		INSERT INTO webhooks(merchant_id, url, secret, events) VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`,
+		webhook.MerchantID, webhook.URL, webhook.Secret, webhook.Events).
+		Scan(&webhook.ID, &webhook.CreatedAt)
+	return postgres.MapError(err)
+}
+
+func (repo *repo) GetWebhooks(ctx context.Context) (_ []types.Webhook, err error) {
+	ctx, span := tracing.Start(ctx, "webhook.GetWebhooks")
+	defer func() { tracing.End(span, err) }()
+
+	ret := []types.Webhook{}
+	rows, err := repo.db.Query(ctx,
+		"SELECT id, merchant_id, url, events, created_at FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, postgres.MapError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		webhook := types.Webhook{}
+		err := rows.Scan(&webhook.ID, &webhook.MerchantID, &webhook.URL, &webhook.Events, &webhook.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, webhook)
+	}
+
+	return ret, rows.Err()
+}
+
+func (repo *repo) DeleteWebhook(ctx context.Context, id int64) (err error) {
+	ctx, span := tracing.Start(ctx, "webhook.DeleteWebhook")
+	defer func() { tracing.End(span, err) }()
+
+	tag, err := repo.db.Exec(ctx, "DELETE FROM webhooks WHERE id=$1", id)
+	if err != nil {
+		return postgres.MapError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return types.ErrNotFound
+	}
+	return nil
+}
+
+func (repo *repo) ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) (_ []types.WebhookDelivery, err error) {
+	ctx, span := tracing.Start(ctx, "webhook.ClaimDeliveries")
+	defer func() { tracing.End(span, err) }()
+
+	if limit <= 0 || lease <= 0 {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	// SKIP LOCKED lets concurrent workers claim disjoint batches instead of
+	// waiting for each other.
+	rows, err := repo.db.Query(ctx, `
+		WITH due AS (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'PENDING' AND next_attempt_at <= now()
+			ORDER BY next_attempt_at, id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		), claimed AS (
+			UPDATE webhook_deliveries d
+			SET next_attempt_at = now() + make_interval(secs => $2)
+			FROM due, webhooks w
+			WHERE d.id = due.id AND w.id = d.webhook_id
+			RETURNING d.id, d.webhook_id, d.event, d.payload, d.status, d.attempts,
+				COALESCE(d.last_error, '') AS last_error, d.created_at, w.url, w.secret
+		)
+		SELECT * FROM claimed ORDER BY id`,
+		limit, lease.Seconds())
+	if err != nil {
+		return nil, postgres.MapError(err)
+	}
+	return scanDeliveries(rows)
+}
+
+func (repo *repo) CompleteDelivery(ctx context.Context, id int64) (err error) {
+	ctx, span := tracing.Start(ctx, "webhook.CompleteDelivery")
+	defer func() { tracing.End(span, err) }()
+
+	_, err = repo.db.Exec(ctx, `
+		UPDATE webhook_deliveries
+		SET status = 'DELIVERED', attempts = attempts + 1, delivered_at = now()
+		WHERE id = $1 AND status = 'PENDING'`, id)
+	return postgres.MapError(err)
+}
+
+func (repo *repo) FailDelivery(ctx context.Context, id int64, lastError string, retryIn time.Duration) (err error) {
+	ctx, span := tracing.Start(ctx, "webhook.FailDelivery")
+	defer func() { tracing.End(span, err) }()
+
+	status := types.DeliveryPending
+	if retryIn <= 0 {
+		status = types.DeliveryDead
+	}
+	_, err = repo.db.Exec(ctx, `
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = attempts + 1, last_error = $3,
+		    next_attempt_at = now() + make_interval(secs => $4)
+		WHERE id = $1 AND status = 'PENDING'`,
+		id, status, lastError, retryIn.Seconds())
+	return postgres.MapError(err)
+}
+
+func (repo *repo) GetDeadDeliveries(ctx context.Context) (_ []types.WebhookDelivery, err error) {
+	ctx, span := tracing.Start(ctx, "webhook.GetDeadDeliveries")
+	defer func() { tracing.End(span, err) }()
+
+	// The URL and secret are only needed by the delivery worker.
+	rows, err := repo.db.Query(ctx, `
+		SELECT id, webhook_id, event, payload, status, attempts,
+			COALESCE(last_error, ''), created_at, '', ''
+		FROM webhook_deliveries WHERE status = 'DEAD' ORDER BY id`)
+	if err != nil {
+		return nil, postgres.MapError(err)
+	}
+	return scanDeliveries(rows)
+}
+
+func (repo *repo) ReplayDelivery(ctx context.Context, id int64) (err error) {
+	ctx, span := tracing.Start(ctx, "webhook.ReplayDelivery")
+	defer func() { tracing.End(span, err) }()
+
+	tag, err := repo.db.Exec(ctx, `
+		UPDATE webhook_deliveries
+		SET status = 'PENDING', attempts = 0, next_attempt_at = now()
+		WHERE id = $1 AND status = 'DEAD'`, id)
+	if err != nil {
+		return postgres.MapError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return types.ErrNotFound
+	}
+	return nil
+}
+
+func scanDeliveries(rows pgx.Rows) ([]types.WebhookDelivery, error) {
+	defer rows.Close()
+
+	ret := []types.WebhookDelivery{}
+	for rows.Next() {
+		d := types.WebhookDelivery{}
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+			&d.LastError, &d.CreatedAt, &d.URL, &d.Secret)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, d)
+	}
+	return ret, postgres.MapError(rows.Err())
+}
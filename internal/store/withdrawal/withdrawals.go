@@ -2,28 +2,44 @@ package withdrawal
 
 import (
 	"context"
-	"database/sql"
 	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 
 	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/store/postgres"
+	"github.com/shevchukeugeni/gofermart/internal/tracing"
 	"github.com/shevchukeugeni/gofermart/internal/types"
 )
 
 type repo struct {
-	db     *sql.DB
-	orders store.Order
+	db *pgxpool.Pool
 }
 
-func NewRepository(db *sql.DB, orders store.Order) store.Withdrawal {
-	return &repo{db: db, orders: orders}
+func NewRepository(db *pgxpool.Pool) store.Withdrawal {
+	return &repo{db: db}
 }
 
-func (repo *repo) CreateWithdrawal(ctx context.Context, orderNum, userId string, sum float64) error {
+func (repo *repo) CreateWithdrawal(ctx context.Context, orderNum, userId, merchantID string, sum float64) (err error) {
+	ctx, span := tracing.Start(ctx, "withdrawal.CreateWithdrawal")
+	defer func() { tracing.End(span, err) }()
+
 	if userId == "" {
 		return errors.New("repository: incorrect parameters")
 	}
 
-	balance, err := repo.GetBalance(ctx, userId)
+	tx, err := repo.db.Begin(ctx)
+	if err != nil {
+		return postgres.MapError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	// The user row lock serializes concurrent withdrawals of the same user,
+	// so the balance cannot be spent twice, and orders the withdrawal event
+	// like postgres.LockUsers does.
+	balance, err := getBalance(ctx, tx, userId, true)
 	if err != nil {
 		return err
 	}
@@ -32,55 +48,520 @@ func (repo *repo) CreateWithdrawal(ctx context.Context, orderNum, userId string,
 		return types.ErrInsufficientBalance
 	}
 
-	_, err = repo.db.ExecContext(ctx,
-		"INSERT INTO withdrawals(user_id, number, sum) VALUES ($1, $2, $3)", userId, orderNum, sum)
+	_, err = tx.Exec(ctx,
+		"INSERT INTO withdrawals(user_id, number, sum, merchant_id) VALUES ($1, $2, $3, NULLIF($4, ''))",
+		userId, orderNum, sum, merchantID)
+	if err != nil {
+		return postgres.MapError(err)
+	}
 
-	return err
-}
+	if err = consumeLots(ctx, tx, userId, sum); err != nil {
+		return err
+	}
 
-func (repo *repo) GetBalance(ctx context.Context, userID string) (*types.UserBalance, error) {
-	orders, err := repo.orders.GetProcessedOrdersByUser(ctx, userID)
+	_, err = tx.Exec(ctx, `
+		INSERT INTO outbox(user_id, event_type, payload)
+		VALUES ($1, $2, jsonb_strip_nulls(jsonb_build_object(
+			'order', $3::text, 'sum', $4::decimal, 'merchant_id', NULLIF($5, ''))))`,
+		userId, types.OutboxPointsWithdrawn, orderNum, sum, merchantID)
 	if err != nil {
-		return nil, err
+		return postgres.MapError(err)
 	}
 
-	balance := new(types.UserBalance)
-	for _, order := range orders {
-		balance.Current += order.Accrual
+	if merchantID != "" {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO webhook_deliveries(webhook_id, event, payload)
+			SELECT id, $2, jsonb_build_object(
+				'event', $2::text, 'merchant_id', merchant_id, 'order', $3::text,
+				'sum', $4::decimal, 'occurred_at', now())
+			FROM webhooks WHERE merchant_id = $1 AND $2::text = ANY(events)`,
+			merchantID, types.WebhookPointsSpent, orderNum, sum)
+		if err != nil {
+			return postgres.MapError(err)
+		}
 	}
 
-	wtdrwls, err := repo.GetWithdrawalsByUser(ctx, userID)
+	return postgres.MapError(tx.Commit(ctx))
+}
+
+// consumeLots spends sum from the lots of userID, oldest first. "spent" is
+// what earlier lots already cover; a lot is touched only while that is short
+// of the sum. The caller must hold the user row lock.
+func consumeLots(ctx context.Context, q postgres.Querier, userID string, sum float64) error {
+	_, err := q.Exec(ctx, `
+		WITH fifo AS (
+			SELECT id, remaining, SUM(remaining) OVER (ORDER BY accrued_at, id) - remaining AS spent
+			FROM accrual_lots WHERE user_id = $1 AND remaining > 0
+		)
+		UPDATE accrual_lots l
+		SET remaining = l.remaining - LEAST(fifo.remaining, $2::decimal - fifo.spent)
+		FROM fifo
+		WHERE l.id = fifo.id AND fifo.spent < $2::decimal`, userID, sum)
+	return postgres.MapError(err)
+}
+
+func (repo *repo) GetBalance(ctx context.Context, userID string) (_ *types.UserBalance, err error) {
+	ctx, span := tracing.Start(ctx, "withdrawal.GetBalance")
+	defer func() { tracing.End(span, err) }()
+
+	return getBalance(ctx, repo.db, userID, false)
+}
+
+// getBalance sums accruals, withdrawals, expirations and transfers in a
+// single round trip. With lock set the user row is locked first, which
+// requires q to be a transaction.
+func getBalance(ctx context.Context, q postgres.Querier, userID string, lock bool) (*types.UserBalance, error) {
+	if userID == "" {
+		return nil, errors.New("repository: incorrect parameters")
+	}
 
-	for _, wtdrw := range wtdrwls {
-		balance.Withdrawn += wtdrw.Sum
+	batch := &pgx.Batch{}
+	if lock {
+		batch.Queue("SELECT id FROM users WHERE id=$1 FOR UPDATE", userID)
 	}
+	batch.Queue("SELECT COALESCE(SUM(accrual), 0) FROM orders WHERE user_id=$1 and status=$2", userID, types.Processed)
+	batch.Queue("SELECT COALESCE(SUM(sum), 0) FROM withdrawals WHERE user_id=$1 AND status=$2", userID, types.WithdrawalActive)
+	batch.Queue("SELECT COALESCE(SUM(sum), 0) FROM point_expirations WHERE user_id=$1", userID)
+	batch.Queue(`SELECT COALESCE(SUM(CASE WHEN recipient_id = $1 THEN sum ELSE -sum END), 0)
+		FROM transfers WHERE sender_id = $1 OR recipient_id = $1`, userID)
 
-	balance.Current = balance.Current - balance.Withdrawn
+	br := q.SendBatch(ctx, batch)
+	defer br.Close()
+
+	if lock {
+		var id string
+		if err := br.QueryRow().Scan(&id); err != nil {
+			return nil, postgres.MapError(err)
+		}
+	}
+
+	balance := new(types.UserBalance)
+	var accrued float64
+	if err := br.QueryRow().Scan(&accrued); err != nil {
+		return nil, postgres.MapError(err)
+	}
+	if err := br.QueryRow().Scan(&balance.Withdrawn); err != nil {
+		return nil, postgres.MapError(err)
+	}
+	var expired, transferred float64
+	if err := br.QueryRow().Scan(&expired); err != nil {
+		return nil, postgres.MapError(err)
+	}
+	if err := br.QueryRow().Scan(&transferred); err != nil {
+		return nil, postgres.MapError(err)
+	}
+
+	balance.Current = accrued - balance.Withdrawn - expired + transferred
 
 	return balance, nil
 }
 
-func (repo *repo) GetWithdrawalsByUser(ctx context.Context, userID string) ([]types.Withdrawal, error) {
+func (repo *repo) GetWithdrawalsByUser(ctx context.Context, userID string) (_ []types.Withdrawal, err error) {
+	ctx, span := tracing.Start(ctx, "withdrawal.GetWithdrawalsByUser")
+	defer func() { tracing.End(span, err) }()
+
 	if userID == "" {
 		return nil, errors.New("repository: incorrect parameters")
 	}
 
 	ret := []types.Withdrawal{}
-	rows, err := repo.db.QueryContext(ctx,
-		"SELECT number, sum, processed_at FROM withdrawals WHERE user_id=$1", userID)
+	rows, err := repo.db.Query(ctx,
+		`SELECT id, number, sum, COALESCE(merchant_id, ''), processed_at, status, reversed_at, COALESCE(reason, '')
+		FROM withdrawals WHERE user_id=$1 ORDER BY processed_at DESC, id DESC`, userID)
 	if err != nil {
-		return nil, err
+		return nil, postgres.MapError(err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		wtdrw := types.Withdrawal{}
-		err := rows.Scan(&wtdrw.Number, &wtdrw.Sum, &wtdrw.ProcessedAt)
+		err := rows.Scan(&wtdrw.ID, &wtdrw.Number, &wtdrw.Sum, &wtdrw.MerchantID, &wtdrw.ProcessedAt,
+			&wtdrw.Status, &wtdrw.ReversedAt, &wtdrw.Reason)
 		if err != nil {
 			return nil, err
 		}
 		ret = append(ret, wtdrw)
 	}
 
-	return ret, nil
+	return ret, rows.Err()
+}
+
+func (repo *repo) ReverseWithdrawal(ctx context.Context, id int64, reason string) (_ *types.Withdrawal, err error) {
+	ctx, span := tracing.Start(ctx, "withdrawal.ReverseWithdrawal")
+	defer func() { tracing.End(span, err) }()
+
+	if id <= 0 || reason == "" {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	tx, err := repo.db.Begin(ctx)
+	if err != nil {
+		return nil, postgres.MapError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userID string
+	err = tx.QueryRow(ctx, "SELECT user_id FROM withdrawals WHERE id=$1", id).Scan(&userID)
+	if err != nil {
+		return nil, postgres.MapError(err)
+	}
+
+	// The refund opens a lot, so it takes the user row lock like every
+	// other change of lots.
+	_, err = tx.Exec(ctx, "SELECT id FROM users WHERE id=$1 FOR UPDATE", userID)
+	if err != nil {
+		return nil, postgres.MapError(err)
+	}
+
+	wtdrw := &types.Withdrawal{ID: id, UserID: userID}
+	err = tx.QueryRow(ctx, `
+		UPDATE withdrawals SET status=$2, reversed_at=now(), reason=$3
+		WHERE id=$1 AND status=$4
+		RETURNING number, sum, COALESCE(merchant_id, ''), processed_at, status, reversed_at, reason`,
+		id, types.WithdrawalReversed, reason, types.WithdrawalActive).
+		Scan(&wtdrw.Number, &wtdrw.Sum, &wtdrw.MerchantID, &wtdrw.ProcessedAt, &wtdrw.Status, &wtdrw.ReversedAt, &wtdrw.Reason)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, types.ErrWithdrawalReversed
+	}
+	if err != nil {
+		return nil, postgres.MapError(err)
+	}
+
+	_, err = tx.Exec(ctx,
+		"INSERT INTO accrual_lots(user_id, withdrawal_id, amount, remaining) VALUES ($1, $2, $3, $3)",
+		userID, id, wtdrw.Sum)
+	if err != nil {
+		return nil, postgres.MapError(err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, postgres.MapError(err)
+	}
+	return wtdrw, nil
+}
+
+func (repo *repo) CreateTransfer(ctx context.Context, senderID, recipientLogin string, sum float64, limit types.TransferLimit) (err error) {
+	ctx, span := tracing.Start(ctx, "withdrawal.CreateTransfer")
+	defer func() { tracing.End(span, err) }()
+
+	if senderID == "" || recipientLogin == "" || sum <= 0 {
+		return errors.New("repository: incorrect parameters")
+	}
+
+	tx, err := repo.db.Begin(ctx)
+	if err != nil {
+		return postgres.MapError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	var recipientID string
+	err = tx.QueryRow(ctx, "SELECT id FROM users WHERE login=$1", recipientLogin).Scan(&recipientID)
+	if err != nil {
+		return postgres.MapError(err)
+	}
+	if recipientID == senderID {
+		return types.ErrTransferToSelf
+	}
+
+	// Lock both users in id order, so that opposite transfers between the
+	// same pair cannot deadlock.
+	_, err = tx.Exec(ctx, "SELECT id FROM users WHERE id IN ($1, $2) ORDER BY id FOR UPDATE", senderID, recipientID)
+	if err != nil {
+		return postgres.MapError(err)
+	}
+
+	balance, err := getBalance(ctx, tx, senderID, false)
+	if err != nil {
+		return err
+	}
+	if balance.Current < sum {
+		return types.ErrInsufficientBalance
+	}
+
+	if limit.Max > 0 {
+		var sent float64
+		err = tx.QueryRow(ctx,
+			"SELECT COALESCE(SUM(sum), 0) FROM transfers WHERE sender_id=$1 AND created_at >= $2",
+			senderID, limit.Since).Scan(&sent)
+		if err != nil {
+			return postgres.MapError(err)
+		}
+		if sent+sum > limit.Max {
+			return types.ErrTransferLimitExceeded
+		}
+	}
+
+	var transferID int64
+	err = tx.QueryRow(ctx,
+		"INSERT INTO transfers(sender_id, recipient_id, sum) VALUES ($1, $2, $3) RETURNING id",
+		senderID, recipientID, sum).Scan(&transferID)
+	if err != nil {
+		return postgres.MapError(err)
+	}
+
+	if err = consumeLots(ctx, tx, senderID, sum); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx,
+		"INSERT INTO accrual_lots(user_id, transfer_id, amount, remaining) VALUES ($1, $2, $3, $3)",
+		recipientID, transferID, sum)
+	if err != nil {
+		return postgres.MapError(err)
+	}
+
+	return postgres.MapError(tx.Commit(ctx))
+}
+
+func (repo *repo) GetTransfersByUser(ctx context.Context, userID string) (_ []types.Transfer, err error) {
+	ctx, span := tracing.Start(ctx, "withdrawal.GetTransfersByUser")
+	defer func() { tracing.End(span, err) }()
+
+	if userID == "" {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	ret := []types.Transfer{}
+	rows, err := repo.db.Query(ctx, `
+		SELECT CASE WHEN t.sender_id = $1 THEN 'out' ELSE 'in' END, u.login, t.sum, t.created_at
+		FROM transfers t
+		JOIN users u ON u.id = CASE WHEN t.sender_id = $1 THEN t.recipient_id ELSE t.sender_id END
+		WHERE t.sender_id = $1 OR t.recipient_id = $1
+		ORDER BY t.created_at DESC, t.id DESC`, userID)
+	if err != nil {
+		return nil, postgres.MapError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		transfer := types.Transfer{}
+		err := rows.Scan(&transfer.Direction, &transfer.Counterparty, &transfer.Sum, &transfer.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, transfer)
+	}
+
+	return ret, rows.Err()
+}
+
+func (repo *repo) GetTransactions(ctx context.Context, userID string, filter types.TransactionFilter) (_ []types.Transaction, err error) {
+	ctx, span := tracing.Start(ctx, "withdrawal.GetTransactions")
+	defer func() { tracing.End(span, err) }()
+
+	if userID == "" || filter.Limit < 0 || filter.Offset < 0 {
+		return nil, errors.New("repository: incorrect parameters")
+	}
+
+	ret := []types.Transaction{}
+	rows, err := repo.db.Query(ctx, transactionsQuery, userID,
+		timeArg(filter.From), timeArg(filter.To), filter.Limit, filter.Offset)
+	if err != nil {
+		return nil, postgres.MapError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t := types.Transaction{}
+		err := rows.Scan(&t.Type, &t.Order, &t.Counterparty, &t.Amount, &t.Balance, &t.ProcessedAt)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, t)
+	}
+
+	return ret, postgres.MapError(rows.Err())
+}
+
+// ledgerQuery puts together everything that moves the balance of the user
+// $1, see getBalance. Lots of orders stand for accruals, since lots of
+// transfers and reversals repeat rows of their own tables. Points written
+// off by one expiry run make a single transaction. Ties in time are broken
+// by rank, as in types.TransactionType.Rank, and the row id, which keeps
+// pages stable.
+const ledgerQuery = `
+	WITH ledger AS (
+		SELECT 'ACCRUAL' AS type, 0 AS rank, id, order_number AS number, NULL::uuid AS counterparty,
+			amount, accrued_at AS at
+		FROM accrual_lots WHERE user_id = $1 AND order_number IS NOT NULL
+		UNION ALL
+		SELECT 'WITHDRAWAL', 2, id, number, NULL, -sum, processed_at
+		FROM withdrawals WHERE user_id = $1
+		UNION ALL
+		SELECT 'REVERSAL', 3, id, number, NULL, sum, reversed_at
+		FROM withdrawals WHERE user_id = $1 AND status = 'REVERSED'
+		UNION ALL
+		SELECT 'EXPIRATION', 5, MIN(id), NULL, NULL, -SUM(sum), expired_at
+		FROM point_expirations WHERE user_id = $1 GROUP BY expired_at
+		UNION ALL
+		SELECT 'TRANSFER_OUT', 4, id, NULL, recipient_id, -sum, created_at
+		FROM transfers WHERE sender_id = $1
+		UNION ALL
+		SELECT 'TRANSFER_IN', 1, id, NULL, sender_id, sum, created_at
+		FROM transfers WHERE recipient_id = $1
+	)`
+
+// transactionsQuery sums the running balance before the range [$2, $3) and
+// the page are cut out.
+const transactionsQuery = ledgerQuery + `, running AS (
+		SELECT *, SUM(amount) OVER (ORDER BY at, rank, id ROWS UNBOUNDED PRECEDING) AS balance
+		FROM ledger
+	)
+	SELECT r.type, COALESCE(r.number, ''), COALESCE(u.login, ''), r.amount, r.balance, r.at
+	FROM running r
+	LEFT JOIN users u ON u.id = r.counterparty
+	WHERE ($2::timestamptz IS NULL OR r.at >= $2) AND ($3::timestamptz IS NULL OR r.at < $3)
+	ORDER BY r.at, r.rank, r.id
+	LIMIT NULLIF($4, 0) OFFSET $5`
+
+// openingQuery sums the balance before $2 the way getBalance does, with
+// withdrawals counted as withdrawn until they are reversed.
+const openingQuery = ledgerQuery + `
+	SELECT COALESCE(SUM(amount), 0),
+		COALESCE(SUM(-amount) FILTER (WHERE type IN ('WITHDRAWAL', 'REVERSAL')), 0)
+	FROM ledger WHERE at < $2`
+
+// statementQuery selects the transactions within [$2, $3).
+const statementQuery = ledgerQuery + `
+	SELECT l.type, COALESCE(l.number, ''), COALESCE(u.login, ''), l.amount, l.at
+	FROM ledger l
+	LEFT JOIN users u ON u.id = l.counterparty
+	WHERE ($2::timestamptz IS NULL OR l.at >= $2) AND ($3::timestamptz IS NULL OR l.at < $3)
+	ORDER BY l.at, l.rank, l.id`
+
+func (repo *repo) WriteStatement(ctx context.Context, userID string, from, to time.Time, w types.StatementWriter) (err error) {
+	ctx, span := tracing.Start(ctx, "withdrawal.WriteStatement")
+	defer func() { tracing.End(span, err) }()
+
+	if userID == "" || w == nil {
+		return errors.New("repository: incorrect parameters")
+	}
+
+	// Both queries see the same snapshot, so the transactions add up to the
+	// closing balance.
+	tx, err := repo.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return postgres.MapError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	var balance types.UserBalance
+	if !from.IsZero() {
+		err = tx.QueryRow(ctx, openingQuery, userID, from).Scan(&balance.Current, &balance.Withdrawn)
+		if err != nil {
+			return postgres.MapError(err)
+		}
+	}
+
+	rows, err := tx.Query(ctx, statementQuery, userID, timeArg(from), timeArg(to))
+	if err != nil {
+		return postgres.MapError(err)
+	}
+	defer rows.Close()
+
+	if err = w.WriteOpening(balance); err != nil {
+		return err
+	}
+	for rows.Next() {
+		t := types.Transaction{}
+		err = rows.Scan(&t.Type, &t.Order, &t.Counterparty, &t.Amount, &t.ProcessedAt)
+		if err != nil {
+			return err
+		}
+		balance.Apply(&t)
+		if err = w.WriteTransaction(&t); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return postgres.MapError(err)
+	}
+	return w.WriteClosing(balance)
+}
+
+// timeArg passes a zero t as NULL.
+func timeArg(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (repo *repo) GetExpiringPoints(ctx context.Context, userID string, accruedBefore time.Time) (_ float64, err error) {
+	ctx, span := tracing.Start(ctx, "withdrawal.GetExpiringPoints")
+	defer func() { tracing.End(span, err) }()
+
+	if userID == "" {
+		return 0, errors.New("repository: incorrect parameters")
+	}
+
+	var sum float64
+	err = repo.db.QueryRow(ctx,
+		"SELECT COALESCE(SUM(remaining), 0) FROM accrual_lots WHERE user_id=$1 AND remaining > 0 AND accrued_at < $2",
+		userID, accruedBefore).Scan(&sum)
+	if err != nil {
+		return 0, postgres.MapError(err)
+	}
+	return sum, nil
+}
+
+func (repo *repo) ExpirePoints(ctx context.Context, accruedBefore time.Time) (_ map[string]float64, err error) {
+	ctx, span := tracing.Start(ctx, "withdrawal.ExpirePoints")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := repo.db.Begin(ctx)
+	if err != nil {
+		return nil, postgres.MapError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Lots are only changed under the user row lock, like in
+	// CreateWithdrawal. Locking in id order keeps concurrent runs from
+	// deadlocking each other.
+	_, err = tx.Exec(ctx, `
+		SELECT id FROM users
+		WHERE id IN (SELECT user_id FROM accrual_lots WHERE remaining > 0 AND accrued_at < $1)
+		ORDER BY id FOR UPDATE`, accruedBefore)
+	if err != nil {
+		return nil, postgres.MapError(err)
+	}
+
+	rows, err := tx.Query(ctx, `
+		WITH due AS (
+			SELECT id, user_id, remaining FROM accrual_lots
+			WHERE remaining > 0 AND accrued_at < $1
+		), upd AS (
+			UPDATE accrual_lots l SET remaining = 0 FROM due WHERE l.id = due.id
+		), ins AS (
+			INSERT INTO point_expirations(lot_id, user_id, sum)
+			SELECT id, user_id, remaining FROM due
+			RETURNING user_id, sum
+		)
+		SELECT user_id, SUM(sum) FROM ins GROUP BY user_id`, accruedBefore)
+	if err != nil {
+		return nil, postgres.MapError(err)
+	}
+	defer rows.Close()
+
+	expired := make(map[string]float64)
+	for rows.Next() {
+		var (
+			userID string
+			sum    float64
+		)
+		if err = rows.Scan(&userID, &sum); err != nil {
+			return nil, postgres.MapError(err)
+		}
+		expired[userID] = sum
+	}
+	// The connection is busy until the rows are closed.
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, postgres.MapError(err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, postgres.MapError(err)
+	}
+	return expired, nil
 }
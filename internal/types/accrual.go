@@ -0,0 +1,57 @@
+package types
+
+import (
+	"fmt"
+	"time"
+)
+
+// Reward types of accrual rules.
+const (
+	// RewardPercent rewards a share of the price, in percent.
+	RewardPercent = "%"
+	// RewardPoints rewards a fixed number of points.
+	RewardPoints = "pt"
+)
+
+// Reward is an accrual rule: goods whose description contains Match earn
+// Reward.
+type Reward struct {
+	Match      string  `json:"match"`
+	Reward     float64 `json:"reward"`
+	RewardType string  `json:"reward_type"`
+}
+
+// Validate checks the rule, the returned error wraps ErrInvalidReward.
+func (r *Reward) Validate() error {
+	switch {
+	case r.Match == "":
+		return fmt.Errorf("%w: match must be set", ErrInvalidReward)
+	case r.Reward <= 0:
+		return fmt.Errorf("%w: reward must be positive", ErrInvalidReward)
+	case r.RewardType != RewardPercent && r.RewardType != RewardPoints:
+		return fmt.Errorf("%w: unknown reward type %q", ErrInvalidReward, r.RewardType)
+	case r.RewardType == RewardPercent && r.Reward > 100:
+		return fmt.Errorf("%w: percent reward must not exceed 100", ErrInvalidReward)
+	}
+	return nil
+}
+
+type Good struct {
+	Description string  `json:"description"`
+	Price       float64 `json:"price"`
+}
+
+// AccrualOrderRequest registers an order with the accrual service.
+type AccrualOrderRequest struct {
+	Order string `json:"order"`
+	Goods []Good `json:"goods"`
+}
+
+// AccrualOrder is an order registered with the accrual engine.
+type AccrualOrder struct {
+	Number       string
+	Goods        []Good
+	Status       Status
+	Accrual      float64
+	RegisteredAt time.Time
+}
@@ -4,5 +4,17 @@ import "errors"
 
 var ErrUserAlreadyExists = errors.New("user already exists")
 var ErrInsufficientBalance = errors.New("insufficient balance")
+var ErrTransferLimitExceeded = errors.New("transfer limit exceeded")
+var ErrWithdrawalReversed = errors.New("withdrawal already reversed")
+var ErrTransferToSelf = errors.New("cannot transfer points to yourself")
 var ErrOrderAlreadyCreatedByUser = errors.New("order already registered by user")
 var ErrOrderAlreadyCreatedByAnother = errors.New("order already registered by another user")
+var ErrInvalidOrder = errors.New("incorrect order number")
+var ErrInvalidReward = errors.New("incorrect reward")
+var ErrInvalidWebhook = errors.New("incorrect webhook")
+
+var ErrNotFound = errors.New("not found")
+var ErrAlreadyExists = errors.New("already exists")
+var ErrReferenceNotFound = errors.New("referenced entity not found")
+var ErrConstraintViolation = errors.New("constraint violation")
+var ErrConflict = errors.New("concurrent modification")
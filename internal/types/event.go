@@ -0,0 +1,26 @@
+package types
+
+type EventType string
+
+const (
+	EventOrder   EventType = "order"
+	EventBalance EventType = "balance"
+)
+
+// Event is a change of a user's data pushed to the user's event stream.
+// Order events carry the new status of the order; balance events only say
+// that the balance changed.
+type Event struct {
+	Type    EventType `json:"type"`
+	UserID  string    `json:"user_id"`
+	Order   string    `json:"order,omitempty"`
+	Status  Status    `json:"status,omitempty"`
+	Accrual float64   `json:"accrual,omitempty"`
+}
+
+// OrderEvent is the payload of an order event sent to the client.
+type OrderEvent struct {
+	Number  string  `json:"number"`
+	Status  Status  `json:"status"`
+	Accrual float64 `json:"accrual,omitempty"`
+}
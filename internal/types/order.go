@@ -2,8 +2,8 @@ package types
 
 import (
 	"encoding/json"
-	"errors"
-	"strconv"
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -23,72 +23,171 @@ type Order struct {
 	Status     Status    `db:"status"      json:"status"`
 	UploadedAt time.Time `db:"uploaded_at" json:"uploaded_at"`
 	Accrual    float64   `db:"accrual"     json:"accrual,omitempty"`
+	MerchantID string    `db:"merchant_id" json:"merchant_id,omitempty"`
+	// Scheme names the Validator that accepted the number.
+	Scheme string `db:"validation_scheme" json:"-"`
+	// Total is the purchase amount, zero when it was not uploaded.
+	Total float64 `db:"total" json:"total,omitempty"`
+	// Goods, the accrual system polling stats and History are only loaded
+	// for the order detail.
+	Goods         []Good              `db:"-"               json:"goods,omitempty"`
+	Attempts      int                 `db:"attempts"        json:"attempts,omitempty"`
+	LastCheckedAt *time.Time          `db:"last_checked_at" json:"last_checked_at,omitempty"`
+	History       []OrderStatusChange `db:"-"               json:"history,omitempty"`
+}
+
+// OrderUploadRequest is the JSON form of an order upload.
+type OrderUploadRequest struct {
+	Number string  `json:"number"`
+	Total  float64 `json:"total"`
+	Goods  []Good  `json:"goods"`
 }
 
 func (o *Order) MarshalJSON() ([]byte, error) {
 	type Alias Order
+	var lastCheckedAt string
+	if o.LastCheckedAt != nil {
+		lastCheckedAt = o.LastCheckedAt.Format(time.RFC3339)
+	}
 	return json.Marshal(&struct {
 		*Alias
-		UploadedAt string `json:"uploaded_at"`
+		UploadedAt    string `json:"uploaded_at"`
+		LastCheckedAt string `json:"last_checked_at,omitempty"`
 	}{
-		Alias:      (*Alias)(o),
-		UploadedAt: o.UploadedAt.Format(time.RFC3339),
+		Alias:         (*Alias)(o),
+		UploadedAt:    o.UploadedAt.Format(time.RFC3339),
+		LastCheckedAt: lastCheckedAt,
 	})
 }
 
-func ValidateOrder(order string) error {
-	num, err := strconv.ParseInt(order, 10, 64)
-	if err != nil {
-		return err
-	}
+// OrderStatusChange is an entry of an order's status history.
+type OrderStatusChange struct {
+	From      Status    `db:"from_status" json:"from"`
+	To        Status    `db:"to_status"   json:"to"`
+	ChangedAt time.Time `db:"changed_at"  json:"changed_at"`
+}
 
-	if !validLuhn(num) {
-		return errors.New("incorrect order number")
-	}
-	return nil
+func (c *OrderStatusChange) MarshalJSON() ([]byte, error) {
+	type Alias OrderStatusChange
+	return json.Marshal(&struct {
+		*Alias
+		ChangedAt string `json:"changed_at"`
+	}{
+		Alias:     (*Alias)(c),
+		ChangedAt: c.ChangedAt.Format(time.RFC3339),
+	})
 }
 
-func validLuhn(number int64) bool {
-	return (number%10+checksum(number/10))%10 == 0
+type UploadResult string
+
+const (
+	UploadAccepted     UploadResult = "accepted"
+	UploadAlreadyYours UploadResult = "already_yours"
+	UploadConflict     UploadResult = "conflict"
+	UploadInvalid      UploadResult = "invalid"
+)
+
+type OrderUploadResult struct {
+	Number string       `json:"number"`
+	Result UploadResult `json:"result"`
 }
 
-func checksum(number int64) int64 {
-	var luhn int64
+// orderLength holds the length limits applied by ValidateOrder. A zero max
+// means the length is not limited.
+var orderLength = struct{ min, max int }{min: 1}
 
-	for i := 0; number > 0; i++ {
-		cur := number % 10
+// SetOrderLength configures the accepted length of order numbers. It is meant
+// to be called once at startup, before requests are served.
+func SetOrderLength(min, max int) {
+	orderLength.min, orderLength.max = min, max
+}
 
-		if i%2 == 0 { // even
-			cur = cur * 2
-			if cur > 9 {
-				cur = cur%10 + cur/10
-			}
+// NormalizeOrder strips all whitespace, including newlines, from an order
+// number as typed or pasted by a client.
+func NormalizeOrder(order string) string {
+	return strings.Join(strings.Fields(order), "")
+}
+
+// ValidateOrder checks that order is a string of decimal digits of the
+// configured length that passes the Luhn check. The number is never parsed
+// into an integer, so its length is only limited by the configuration.
+func ValidateOrder(order string) error {
+	if len(order) < orderLength.min {
+		return fmt.Errorf("%w: shorter than %d digits", ErrInvalidOrder, orderLength.min)
+	}
+	if orderLength.max > 0 && len(order) > orderLength.max {
+		return fmt.Errorf("%w: longer than %d digits", ErrInvalidOrder, orderLength.max)
+	}
+	for i := 0; i < len(order); i++ {
+		if order[i] < '0' || order[i] > '9' {
+			return fmt.Errorf("%w: unexpected character %q", ErrInvalidOrder, order[i])
 		}
+	}
+
+	if !validLuhn(order) {
+		return ErrInvalidOrder
+	}
+	return nil
+}
 
-		luhn += cur
-		number = number / 10
+// validLuhn expects a non-empty string of digits.
+func validLuhn(number string) bool {
+	sum := 0
+	for i := len(number) - 1; i >= 0; i-- {
+		digit := int(number[i] - '0')
+		if (len(number)-i)%2 == 0 { // every second digit from the right
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
 	}
-	return luhn % 10
+	return sum%10 == 0
 }
 
+type WithdrawalStatus string
+
+const (
+	WithdrawalActive WithdrawalStatus = "ACTIVE"
+	// WithdrawalReversed withdrawals were refunded and do not count in the
+	// balance.
+	WithdrawalReversed WithdrawalStatus = "REVERSED"
+)
+
 type Withdrawal struct {
-	UserID      string    `db:"user_id" json:"user_id,omitempty"`
-	Number      string    `db:"number" json:"number"`
-	ProcessedAt time.Time `db:"processed_at" json:"processed_at"`
-	Sum         float64   `db:"sum" json:"sum"`
+	ID          int64            `db:"id" json:"id"`
+	UserID      string           `db:"user_id" json:"user_id,omitempty"`
+	Number      string           `db:"number" json:"order"`
+	ProcessedAt time.Time        `db:"processed_at" json:"processed_at"`
+	Sum         float64          `db:"sum" json:"sum"`
+	MerchantID  string           `db:"merchant_id" json:"merchant_id,omitempty"`
+	Status      WithdrawalStatus `db:"status" json:"status"`
+	ReversedAt  *time.Time       `db:"reversed_at" json:"reversed_at,omitempty"`
+	Reason      string           `db:"reason" json:"reason,omitempty"`
 }
 
 func (w *Withdrawal) MarshalJSON() ([]byte, error) {
 	type Alias Withdrawal
+	var reversedAt string
+	if w.ReversedAt != nil {
+		reversedAt = w.ReversedAt.Format(time.RFC3339)
+	}
 	return json.Marshal(&struct {
 		*Alias
 		ProcessedAt string `json:"processed_at"`
+		ReversedAt  string `json:"reversed_at,omitempty"`
 	}{
 		Alias:       (*Alias)(w),
 		ProcessedAt: w.ProcessedAt.Format(time.RFC3339),
+		ReversedAt:  reversedAt,
 	})
 }
 
+type ReversalRequest struct {
+	Reason string `json:"reason"`
+}
+
 type WithdrawalRequest struct {
 	Order string  `json:"order"`
 	Sum   float64 `json:"sum"`
@@ -97,5 +196,5 @@ type WithdrawalRequest struct {
 type AccrualResponse struct {
 	Order   string  `json:"order"`
 	Status  string  `json:"status"`
-	Accrual float64 `json:"accrual"`
+	Accrual float64 `json:"accrual,omitempty"`
 }
@@ -0,0 +1,94 @@
+package types
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		order string
+		valid bool
+	}{
+		{"valid", "12345678903", true},
+		{"valid single zero", "0", true},
+		{"valid leading zeros", "0079927398713", true},
+		{"longer than int64", "79927398713123456789012345671", true},
+		{"wrong check digit", "12345678904", false},
+		{"wrong check digit long", "79927398713123456789012345672", false},
+		{"empty", "", false},
+		{"plus sign", "+12345678903", false},
+		{"minus sign", "-12345678903", false},
+		{"surrounding whitespace", " 12345678903\n", false},
+		{"letters", "1234567890a", false},
+		{"non-ascii digits", "١٢٣", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateOrder(tt.order)
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidOrder)
+			}
+		})
+	}
+}
+
+func TestValidateOrderLength(t *testing.T) {
+	defer SetOrderLength(orderLength.min, orderLength.max)
+	SetOrderLength(5, 11)
+
+	assert.ErrorIs(t, ValidateOrder("0"), ErrInvalidOrder)
+	assert.NoError(t, ValidateOrder("12345678903"))
+	assert.ErrorIs(t, ValidateOrder("012345678903"), ErrInvalidOrder)
+}
+
+func TestNormalizeOrder(t *testing.T) {
+	assert.Equal(t, "12345678903", NormalizeOrder(" 1234 5678\t903\r\n"))
+	assert.Equal(t, "", NormalizeOrder("\n \n"))
+}
+
+// referenceLuhn is the textbook formulation: double every second digit
+// counting from the right and sum the digits of the products.
+func referenceLuhn(number string) bool {
+	if number == "" {
+		return false
+	}
+
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			return false
+		}
+		digit := int(c - '0')
+		if double {
+			product := strconv.Itoa(digit * 2)
+			for j := range product {
+				sum += int(product[j] - '0')
+			}
+		} else {
+			sum += digit
+		}
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+func FuzzValidateOrder(f *testing.F) {
+	for _, seed := range []string{"", "0", "12345678903", "12345678904", "79927398713123456789012345671", "+1", " 1", "١"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, order string) {
+		want := referenceLuhn(order)
+		if got := ValidateOrder(order) == nil; got != want {
+			t.Fatalf("ValidateOrder(%q) valid = %v, reference = %v", order, got, want)
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Domain events recorded in the outbox for downstream systems.
+const (
+	OutboxUserRegistered  = "user.registered"
+	OutboxOrderUploaded   = "order.uploaded"
+	OutboxOrderAccrued    = "order.accrued"
+	OutboxPointsWithdrawn = "points.withdrawn"
+)
+
+// OutboxEvent is a domain event written in the same transaction as the
+// change it describes. IDs grow in commit order within a user, so consumers
+// can use them to drop the duplicates at-least-once delivery may produce.
+type OutboxEvent struct {
+	ID        int64           `db:"id" json:"id"`
+	Type      string          `db:"event_type" json:"type"`
+	UserID    string          `db:"user_id" json:"user_id"`
+	Payload   json.RawMessage `db:"payload" json:"payload"`
+	CreatedAt time.Time       `db:"created_at" json:"created_at"`
+}
+
+func (e *OutboxEvent) MarshalJSON() ([]byte, error) {
+	type Alias OutboxEvent
+	return json.Marshal(&struct {
+		*Alias
+		CreatedAt string `json:"created_at"`
+	}{
+		Alias:     (*Alias)(e),
+		CreatedAt: e.CreatedAt.Format(time.RFC3339Nano),
+	})
+}
+
+// UserRegisteredPayload is the payload of OutboxUserRegistered.
+type UserRegisteredPayload struct {
+	Login string `json:"login"`
+}
+
+// OrderUploadedPayload is the payload of OutboxOrderUploaded.
+type OrderUploadedPayload struct {
+	Number     string  `json:"number"`
+	MerchantID string  `json:"merchant_id,omitempty"`
+	Total      float64 `json:"total,omitempty"`
+}
+
+// OrderAccruedPayload is the payload of OutboxOrderAccrued, recorded when an
+// order reaches PROCESSED. Accrual includes the tier multiplier.
+type OrderAccruedPayload struct {
+	Number  string  `json:"number"`
+	Accrual float64 `json:"accrual"`
+}
+
+// PointsWithdrawnPayload is the payload of OutboxPointsWithdrawn.
+type PointsWithdrawnPayload struct {
+	Order      string  `json:"order"`
+	Sum        float64 `json:"sum"`
+	MerchantID string  `json:"merchant_id,omitempty"`
+}
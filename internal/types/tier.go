@@ -0,0 +1,41 @@
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// What a tier is decided by: points earned or points spent within the
+// rolling window.
+const (
+	TierBasisEarned = "earned"
+	TierBasisSpent  = "spent"
+)
+
+// Tier is a loyalty level. A user belongs to the highest tier whose Threshold
+// their activity reaches; accruals are multiplied by its Multiplier.
+type Tier struct {
+	Name       string
+	Threshold  float64
+	Multiplier float64
+}
+
+// TierChange is an entry of a user's tier history. Total is the activity the
+// decision was based on.
+type TierChange struct {
+	From      string    `db:"from_tier"  json:"from,omitempty"`
+	To        string    `db:"to_tier"    json:"to"`
+	Total     float64   `db:"total"      json:"total"`
+	ChangedAt time.Time `db:"changed_at" json:"changed_at"`
+}
+
+func (c *TierChange) MarshalJSON() ([]byte, error) {
+	type Alias TierChange
+	return json.Marshal(&struct {
+		*Alias
+		ChangedAt string `json:"changed_at"`
+	}{
+		Alias:     (*Alias)(c),
+		ChangedAt: c.ChangedAt.Format(time.RFC3339),
+	})
+}
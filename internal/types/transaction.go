@@ -0,0 +1,96 @@
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type TransactionType string
+
+const (
+	TransactionAccrual     TransactionType = "ACCRUAL"
+	TransactionWithdrawal  TransactionType = "WITHDRAWAL"
+	TransactionReversal    TransactionType = "REVERSAL" // a refunded withdrawal
+	TransactionExpiration  TransactionType = "EXPIRATION"
+	TransactionTransferIn  TransactionType = "TRANSFER_IN"
+	TransactionTransferOut TransactionType = "TRANSFER_OUT"
+)
+
+// Rank orders transactions made at the same time in the order they can
+// happen: points come in before they are spent, and a withdrawal comes
+// before its reversal.
+func (t TransactionType) Rank() int {
+	switch t {
+	case TransactionAccrual:
+		return 0
+	case TransactionTransferIn:
+		return 1
+	case TransactionWithdrawal:
+		return 2
+	case TransactionReversal:
+		return 3
+	case TransactionTransferOut:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// Transaction is a single change of a user's balance. Amount is positive
+// for points received and negative for points spent; Balance is what the
+// balance was right after the change.
+type Transaction struct {
+	Type         TransactionType `json:"type"`
+	Order        string          `json:"order,omitempty"`
+	Counterparty string          `json:"counterparty,omitempty"` // login of the other user of a transfer
+	Amount       float64         `json:"amount"`
+	Balance      float64         `json:"balance"`
+	ProcessedAt  time.Time       `json:"processed_at"`
+}
+
+func (t *Transaction) MarshalJSON() ([]byte, error) {
+	type Alias Transaction
+	return json.Marshal(&struct {
+		*Alias
+		ProcessedAt string `json:"processed_at"`
+	}{
+		Alias:       (*Alias)(t),
+		ProcessedAt: t.ProcessedAt.Format(time.RFC3339),
+	})
+}
+
+// TransactionFilter selects a page of a user's transactions made within
+// [From, To); a zero bound leaves that side open and a zero Limit returns
+// all of them.
+type TransactionFilter struct {
+	From   time.Time
+	To     time.Time
+	Limit  int
+	Offset int
+}
+
+// Includes reports whether a transaction made at t is within the range of
+// the filter.
+func (f TransactionFilter) Includes(t time.Time) bool {
+	return (f.From.IsZero() || !t.Before(f.From)) && (f.To.IsZero() || t.Before(f.To))
+}
+
+// Apply adds t to the balance following the rules of the balance endpoint:
+// withdrawals count as withdrawn until they are reversed. The result is
+// recorded as t.Balance.
+func (b *UserBalance) Apply(t *Transaction) {
+	b.Current += t.Amount
+	switch t.Type {
+	case TransactionWithdrawal, TransactionReversal:
+		b.Withdrawn -= t.Amount
+	}
+	t.Balance = b.Current
+}
+
+// StatementWriter receives a statement while the store reads it, so that
+// it can be passed on without holding all of it in memory.
+type StatementWriter interface {
+	WriteOpening(balance UserBalance) error
+	WriteTransaction(t *Transaction) error
+	WriteClosing(balance UserBalance) error
+}
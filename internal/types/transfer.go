@@ -0,0 +1,42 @@
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	TransferIn  = "in"
+	TransferOut = "out"
+)
+
+// Transfer is a move of points between two users as seen by one of them.
+type Transfer struct {
+	Direction    string    `json:"direction"`
+	Counterparty string    `json:"counterparty"` // login of the other user
+	Sum          float64   `json:"sum"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (t *Transfer) MarshalJSON() ([]byte, error) {
+	type Alias Transfer
+	return json.Marshal(&struct {
+		*Alias
+		CreatedAt string `json:"created_at"`
+	}{
+		Alias:     (*Alias)(t),
+		CreatedAt: t.CreatedAt.Format(time.RFC3339),
+	})
+}
+
+type TransferRequest struct {
+	Recipient string  `json:"recipient"`
+	Sum       float64 `json:"sum"`
+}
+
+// TransferLimit caps the sum a user may send since Since; a zero Max means
+// no limit.
+type TransferLimit struct {
+	Max   float64
+	Since time.Time
+}
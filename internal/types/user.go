@@ -46,6 +46,28 @@ func (u *User) ToDB() *User {
 type UserBalance struct {
 	Current   float64 `json:"current"`
 	Withdrawn float64 `json:"withdrawn"`
+	// Tier is only reported when loyalty tiers are configured.
+	Tier string `json:"tier,omitempty"`
+	// Expiring is only reported when points expire and some are about to.
+	Expiring *ExpiringPoints `json:"expiring,omitempty"`
+}
+
+// ExpiringPoints is the part of the balance that expires before Before
+// unless spent.
+type ExpiringPoints struct {
+	Sum    float64   `json:"sum"`
+	Before time.Time `json:"before"`
+}
+
+func (e *ExpiringPoints) MarshalJSON() ([]byte, error) {
+	type Alias ExpiringPoints
+	return json.Marshal(&struct {
+		*Alias
+		Before string `json:"before"`
+	}{
+		Alias:  (*Alias)(e),
+		Before: e.Before.Format(time.RFC3339),
+	})
 }
 
 func (u *User) MarshalJSON() ([]byte, error) {
@@ -0,0 +1,152 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"unicode"
+)
+
+// Names of the order-number validation schemes. The name is stored with
+// every order so that it is known later how the number was checked.
+const (
+	SchemeLuhn    = "luhn"
+	SchemeRegex   = "regex"
+	SchemeNoCheck = "none"
+)
+
+// Checksums that can be combined with the regex scheme.
+const (
+	ChecksumNone = ""
+	ChecksumLuhn = "luhn"
+)
+
+// maxReceiptLength bounds numbers accepted by the schemes that do not limit
+// the length themselves.
+const maxReceiptLength = 128
+
+var ErrUnknownMerchant = errors.New("unknown merchant")
+
+// Validator checks order numbers of one scheme.
+type Validator interface {
+	Scheme() string
+	Validate(number string) error
+}
+
+// NewValidator builds a validator by scheme name. pattern and checksum are
+// only used by the regex scheme.
+func NewValidator(scheme, pattern, checksum string) (Validator, error) {
+	switch scheme {
+	case SchemeLuhn:
+		return LuhnValidator{}, nil
+	case SchemeNoCheck:
+		return NoCheckValidator{}, nil
+	case SchemeRegex:
+		return NewRegexValidator(pattern, checksum)
+	default:
+		return nil, fmt.Errorf("unknown validation scheme %q", scheme)
+	}
+}
+
+// LuhnValidator accepts digit strings passing the Luhn check, see
+// ValidateOrder.
+type LuhnValidator struct{}
+
+func (LuhnValidator) Scheme() string { return SchemeLuhn }
+
+func (LuhnValidator) Validate(number string) error { return ValidateOrder(number) }
+
+// RegexValidator accepts numbers matching a pattern, for example alphanumeric
+// receipt IDs or a merchant prefix followed by digits. With the luhn checksum
+// the digits of the number, taken in order and ignoring everything else, must
+// pass the Luhn check, which covers the "prefix plus check digit" format.
+type RegexValidator struct {
+	re       *regexp.Regexp
+	checksum string
+}
+
+// NewRegexValidator compiles pattern; it is anchored to match the whole
+// number.
+func NewRegexValidator(pattern, checksum string) (*RegexValidator, error) {
+	if pattern == "" {
+		return nil, errors.New("regex scheme requires a pattern")
+	}
+	re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+	switch checksum {
+	case ChecksumNone, ChecksumLuhn:
+	default:
+		return nil, fmt.Errorf("unknown checksum %q", checksum)
+	}
+	return &RegexValidator{re: re, checksum: checksum}, nil
+}
+
+func (v *RegexValidator) Scheme() string { return SchemeRegex }
+
+func (v *RegexValidator) Validate(number string) error {
+	if len(number) > maxReceiptLength {
+		return fmt.Errorf("%w: longer than %d characters", ErrInvalidOrder, maxReceiptLength)
+	}
+	if !v.re.MatchString(number) {
+		return fmt.Errorf("%w: does not match the merchant format", ErrInvalidOrder)
+	}
+
+	if v.checksum == ChecksumLuhn {
+		digits := make([]byte, 0, len(number))
+		for i := 0; i < len(number); i++ {
+			if number[i] >= '0' && number[i] <= '9' {
+				digits = append(digits, number[i])
+			}
+		}
+		if len(digits) == 0 || !validLuhn(string(digits)) {
+			return fmt.Errorf("%w: check digit mismatch", ErrInvalidOrder)
+		}
+	}
+	return nil
+}
+
+// NoCheckValidator accepts any printable number without whitespace. It is
+// meant for merchants whose receipt IDs carry no check digit at all.
+type NoCheckValidator struct{}
+
+func (NoCheckValidator) Scheme() string { return SchemeNoCheck }
+
+func (NoCheckValidator) Validate(number string) error {
+	if number == "" || len(number) > maxReceiptLength {
+		return fmt.Errorf("%w: length must be between 1 and %d", ErrInvalidOrder, maxReceiptLength)
+	}
+	for _, r := range number {
+		if !unicode.IsPrint(r) || unicode.IsSpace(r) {
+			return fmt.Errorf("%w: unexpected character %q", ErrInvalidOrder, r)
+		}
+	}
+	return nil
+}
+
+// Validators picks the validator for a merchant. Orders uploaded without a
+// merchant identifier are checked by the default validator.
+type Validators struct {
+	def       Validator
+	merchants map[string]Validator
+}
+
+// NewValidators uses Luhn as the default when def is nil.
+func NewValidators(def Validator, merchants map[string]Validator) *Validators {
+	if def == nil {
+		def = LuhnValidator{}
+	}
+	return &Validators{def: def, merchants: merchants}
+}
+
+// For returns the validator of merchant, or ErrUnknownMerchant.
+func (v *Validators) For(merchant string) (Validator, error) {
+	if merchant == "" {
+		return v.def, nil
+	}
+	if val, ok := v.merchants[merchant]; ok {
+		return val, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownMerchant, merchant)
+}
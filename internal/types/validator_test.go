@@ -0,0 +1,85 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewValidator(t *testing.T) {
+	tests := []struct {
+		name     string
+		scheme   string
+		pattern  string
+		checksum string
+		wantErr  bool
+	}{
+		{"luhn", SchemeLuhn, "", "", false},
+		{"none", SchemeNoCheck, "", "", false},
+		{"regex", SchemeRegex, `[A-Z]{3}\d+`, ChecksumLuhn, false},
+		{"regex without pattern", SchemeRegex, "", "", true},
+		{"regex with broken pattern", SchemeRegex, `[A-Z`, "", true},
+		{"regex with unknown checksum", SchemeRegex, `\d+`, "mod97", true},
+		{"unknown scheme", "crc", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := NewValidator(tt.scheme, tt.pattern, tt.checksum)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.scheme, v.Scheme())
+		})
+	}
+}
+
+func TestValidators(t *testing.T) {
+	receipt, err := NewRegexValidator(`[A-Z0-9]{8}`, ChecksumNone)
+	require.NoError(t, err)
+	prefixed, err := NewRegexValidator(`POS-\d+`, ChecksumLuhn)
+	require.NoError(t, err)
+
+	validators := NewValidators(nil, map[string]Validator{
+		"receipt":  receipt,
+		"prefixed": prefixed,
+		"free":     NoCheckValidator{},
+	})
+
+	tests := []struct {
+		merchant string
+		number   string
+		valid    bool
+	}{
+		{"", "12345678903", true},
+		{"", "12345678904", false},
+		{"", "AB12CD34", false},
+		{"receipt", "AB12CD34", true},
+		{"receipt", "ab12cd34", false},
+		{"receipt", "AB12CD345", false},
+		{"prefixed", "POS-12345678903", true},
+		{"prefixed", "POS-12345678904", false},
+		{"prefixed", "12345678903", false},
+		{"free", "any-receipt/42", true},
+		{"free", "", false},
+		{"free", "two words", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.merchant+"/"+tt.number, func(t *testing.T) {
+			v, err := validators.For(tt.merchant)
+			require.NoError(t, err)
+
+			err = v.Validate(tt.number)
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidOrder)
+			}
+		})
+	}
+
+	_, err = validators.For("unknown")
+	assert.ErrorIs(t, err, ErrUnknownMerchant)
+}
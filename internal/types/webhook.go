@@ -0,0 +1,115 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Webhook events sent to merchants.
+const (
+	WebhookOrderProcessed = "order.processed"
+	WebhookOrderInvalid   = "order.invalid"
+	WebhookPointsSpent    = "points.spent"
+)
+
+// WebhookEvents lists every event a webhook can subscribe to.
+var WebhookEvents = []string{WebhookOrderProcessed, WebhookOrderInvalid, WebhookPointsSpent}
+
+// Webhook is a merchant's subscription to events of its orders. Secret signs
+// the payloads; it is returned only when the webhook is created.
+type Webhook struct {
+	ID         int64     `db:"id" json:"id"`
+	MerchantID string    `db:"merchant_id" json:"merchant_id"`
+	URL        string    `db:"url" json:"url"`
+	Secret     string    `db:"secret" json:"secret,omitempty"`
+	Events     []string  `db:"events" json:"events"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+}
+
+func (w *Webhook) MarshalJSON() ([]byte, error) {
+	type Alias Webhook
+	return json.Marshal(&struct {
+		*Alias
+		CreatedAt string `json:"created_at"`
+	}{
+		Alias:     (*Alias)(w),
+		CreatedAt: w.CreatedAt.Format(time.RFC3339),
+	})
+}
+
+// WebhookRequest registers a webhook; no events means all of them.
+type WebhookRequest struct {
+	MerchantID string   `json:"merchant_id"`
+	URL        string   `json:"url"`
+	Events     []string `json:"events"`
+}
+
+func (r *WebhookRequest) Validate() error {
+	if r.MerchantID == "" {
+		return fmt.Errorf("%w: missing merchant_id", ErrInvalidWebhook)
+	}
+	u, err := url.Parse(r.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http(s) URL", ErrInvalidWebhook)
+	}
+	for _, event := range r.Events {
+		known := false
+		for _, e := range WebhookEvents {
+			known = known || e == event
+		}
+		if !known {
+			return fmt.Errorf("%w: unknown event %q", ErrInvalidWebhook, event)
+		}
+	}
+	return nil
+}
+
+// WebhookPayload is the body of a webhook request. Order events carry the
+// final status and accrual of the order, points.spent the withdrawn sum.
+type WebhookPayload struct {
+	Event      string    `json:"event"`
+	MerchantID string    `json:"merchant_id"`
+	Order      string    `json:"order"`
+	Status     Status    `json:"status,omitempty"`
+	Accrual    float64   `json:"accrual,omitempty"`
+	Sum        float64   `json:"sum,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "PENDING"
+	DeliveryDelivered DeliveryStatus = "DELIVERED"
+	DeliveryDead      DeliveryStatus = "DEAD"
+)
+
+// WebhookDelivery is a payload waiting in the outbox to be sent to a webhook.
+// URL and Secret are those of the webhook and are only filled in for the
+// delivery worker.
+type WebhookDelivery struct {
+	ID        int64           `db:"id" json:"id"`
+	WebhookID int64           `db:"webhook_id" json:"webhook_id"`
+	Event     string          `db:"event" json:"event"`
+	Payload   json.RawMessage `db:"payload" json:"payload"`
+	Status    DeliveryStatus  `db:"status" json:"status"`
+	Attempts  int             `db:"attempts" json:"attempts"`
+	LastError string          `db:"last_error" json:"last_error,omitempty"`
+	CreatedAt time.Time       `db:"created_at" json:"created_at"`
+
+	URL    string `db:"url" json:"-"`
+	Secret string `db:"secret" json:"-"`
+}
+
+func (d *WebhookDelivery) MarshalJSON() ([]byte, error) {
+	type Alias WebhookDelivery
+	return json.Marshal(&struct {
+		*Alias
+		CreatedAt string `json:"created_at"`
+	}{
+		Alias:     (*Alias)(d),
+		CreatedAt: d.CreatedAt.Format(time.RFC3339),
+	})
+}
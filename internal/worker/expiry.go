@@ -0,0 +1,72 @@
+package worker
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/gofermart/internal/events"
+	"github.com/shevchukeugeni/gofermart/internal/metrics"
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/tracing"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+type ExpiryConfig struct {
+	// TTL is the lifetime of accrued points.
+	TTL      time.Duration
+	Interval time.Duration
+	// Events receives the balance changes of the users whose points
+	// expired; it may be nil.
+	Events events.Publisher
+}
+
+// Expirer periodically writes off points accrued more than TTL ago.
+type Expirer struct {
+	logger *zap.Logger
+	cfg    ExpiryConfig
+	points store.Withdrawal
+	now    func() time.Time
+}
+
+func NewExpirer(logger *zap.Logger, cfg ExpiryConfig, points store.Withdrawal) *Expirer {
+	return &Expirer{
+		logger: logger.Named("Expirer"),
+		cfg:    cfg,
+		points: points,
+		now:    time.Now,
+	}
+}
+
+// Run expires points once right away and then every Interval until ctx is
+// done.
+func (e *Expirer) Run(ctx context.Context) {
+	runEvery(ctx, e.cfg.Interval, e.expire)
+}
+
+func (e *Expirer) expire(ctx context.Context) {
+	ctx, span := tracing.Start(ctx, "worker.expire")
+	defer span.End()
+
+	expired, err := e.points.ExpirePoints(ctx, e.now().Add(-e.cfg.TTL))
+	if err != nil {
+		e.logger.Error("Unable to expire points", zap.Error(err))
+		return
+	}
+	var sum float64
+	for userID, points := range expired {
+		sum += points
+		if e.cfg.Events == nil {
+			continue
+		}
+		err = e.cfg.Events.Publish(ctx, types.Event{Type: types.EventBalance, UserID: userID})
+		if err != nil {
+			e.logger.Error("unable to publish event", zap.Error(err))
+		}
+	}
+	if sum > 0 {
+		metrics.PointsExpired.Add(sum)
+		e.logger.Info("points expired", zap.Float64("sum", sum), zap.Int("users", len(expired)))
+	}
+}
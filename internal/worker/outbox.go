@@ -0,0 +1,131 @@
+package worker
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/gofermart/internal/metrics"
+	"github.com/shevchukeugeni/gofermart/internal/sink"
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/tracing"
+)
+
+type OutboxConfig struct {
+	Interval time.Duration
+	// BatchSize is how many events are passed to the sink at once.
+	BatchSize int
+}
+
+// OutboxPublisher delivers the domain events of the outbox to a sink. Events
+// are published oldest first and a failed one holds back all later ones, so
+// the sink sees the events of every user in order.
+type OutboxPublisher struct {
+	logger *zap.Logger
+	cfg    OutboxConfig
+	outbox store.Outbox
+	sink   sink.Sink
+}
+
+func NewOutboxPublisher(logger *zap.Logger, cfg OutboxConfig, outbox store.Outbox, dst sink.Sink) *OutboxPublisher {
+	return &OutboxPublisher{
+		logger: logger.Named("OutboxPublisher"),
+		cfg:    cfg,
+		outbox: outbox,
+		sink:   dst,
+	}
+}
+
+// Run publishes pending events once right away and then every Interval
+// until ctx is done.
+func (p *OutboxPublisher) Run(ctx context.Context) {
+	runEvery(ctx, p.cfg.Interval, p.publish)
+}
+
+// publish drains the outbox batch by batch until it is empty or the sink
+// fails.
+func (p *OutboxPublisher) publish(ctx context.Context) {
+	ctx, span := tracing.Start(ctx, "worker.publishOutbox")
+	defer span.End()
+
+	for ctx.Err() == nil {
+		n, err := p.outbox.PublishEvents(ctx, p.cfg.BatchSize, p.sink.Publish)
+		metrics.OutboxPublished.Add(float64(n))
+		if err != nil {
+			metrics.OutboxFailures.Inc()
+			p.logger.Error("Unable to publish events", zap.Int("published", n), zap.Error(err))
+			return
+		}
+		if n < p.cfg.BatchSize {
+			return
+		}
+	}
+}
+
+type OutboxPruneConfig struct {
+	Interval time.Duration
+	// Retention is how long published events are kept.
+	Retention time.Duration
+	// MaxPending caps the unpublished events; zero means no cap. With
+	// DropPending the oldest ones beyond it are deleted, otherwise exceeding
+	// it is only reported, since a sink still owes them downstream.
+	MaxPending  int
+	DropPending bool
+}
+
+// OutboxPruner keeps the outbox bounded, also when no sink publishes from
+// it.
+type OutboxPruner struct {
+	logger *zap.Logger
+	cfg    OutboxPruneConfig
+	outbox store.Outbox
+	now    func() time.Time
+}
+
+func NewOutboxPruner(logger *zap.Logger, cfg OutboxPruneConfig, outbox store.Outbox) *OutboxPruner {
+	return &OutboxPruner{
+		logger: logger.Named("OutboxPruner"),
+		cfg:    cfg,
+		outbox: outbox,
+		now:    time.Now,
+	}
+}
+
+// Run prunes the outbox once right away and then every Interval until ctx
+// is done.
+func (p *OutboxPruner) Run(ctx context.Context) {
+	runEvery(ctx, p.cfg.Interval, p.prune)
+}
+
+func (p *OutboxPruner) prune(ctx context.Context) {
+	ctx, span := tracing.Start(ctx, "worker.pruneOutbox")
+	defer span.End()
+
+	maxPending := 0
+	if p.cfg.DropPending {
+		maxPending = p.cfg.MaxPending
+	}
+	published, dropped, err := p.outbox.PruneEvents(ctx, p.now().Add(-p.cfg.Retention), maxPending)
+	if err != nil {
+		p.logger.Error("Unable to prune outbox", zap.Error(err))
+		return
+	}
+	if published > 0 {
+		p.logger.Debug("published events pruned", zap.Int("events", published))
+	}
+	if dropped > 0 {
+		metrics.OutboxDropped.Add(float64(dropped))
+		p.logger.Warn("unpublished events dropped", zap.Int("events", dropped), zap.Int("max_pending", p.cfg.MaxPending))
+	}
+
+	pending, err := p.outbox.CountPending(ctx)
+	if err != nil {
+		p.logger.Error("Unable to count pending events", zap.Error(err))
+		return
+	}
+	metrics.OutboxPending.Set(float64(pending))
+	if p.cfg.MaxPending > 0 && pending > p.cfg.MaxPending {
+		p.logger.Warn("unpublished events exceed max_pending", zap.Int("events", pending), zap.Int("max_pending", p.cfg.MaxPending))
+	}
+}
@@ -0,0 +1,84 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/gofermart/internal/sink"
+	"github.com/shevchukeugeni/gofermart/internal/store/memory"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+func TestOutboxPublisher(t *testing.T) {
+	ctx := context.Background()
+
+	db := memory.New()
+	users := memory.NewUserRepository(db)
+	outbox := memory.NewOutboxRepository(db)
+	for _, login := range []string{"alice", "bob", "carol"} {
+		user := (&types.UserLoginRequest{Login: login, Password: "password"}).User().ToDB()
+		require.NoError(t, users.CreateUser(ctx, user))
+	}
+
+	// A failing sink leaves the events in the outbox.
+	failed := NewOutboxPublisher(zap.NewNop(), OutboxConfig{Interval: time.Second, BatchSize: 2}, outbox,
+		sink.NewWriter(failingWriter{}))
+	failed.publish(ctx)
+
+	// A run drains the outbox in as many batches as it takes.
+	var buf bytes.Buffer
+	p := NewOutboxPublisher(zap.NewNop(), OutboxConfig{Interval: time.Second, BatchSize: 2}, outbox, sink.NewWriter(&buf))
+	p.publish(ctx)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Contains(t, lines[0], `"login":"alice"`)
+	assert.Contains(t, lines[2], `"login":"carol"`)
+
+	p.publish(ctx)
+	assert.Len(t, strings.Split(strings.TrimSpace(buf.String()), "\n"), 3)
+}
+
+func TestOutboxPruner(t *testing.T) {
+	ctx := context.Background()
+
+	db := memory.New()
+	users := memory.NewUserRepository(db)
+	outbox := memory.NewOutboxRepository(db)
+	for _, login := range []string{"alice", "bob", "carol"} {
+		user := (&types.UserLoginRequest{Login: login, Password: "password"}).User().ToDB()
+		require.NoError(t, users.CreateUser(ctx, user))
+	}
+
+	// Events a sink still owes downstream are kept beyond MaxPending.
+	cfg := OutboxPruneConfig{Interval: time.Hour, Retention: time.Hour, MaxPending: 2}
+	NewOutboxPruner(zap.NewNop(), cfg, outbox).prune(ctx)
+	pending, err := outbox.CountPending(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, pending)
+
+	// Without a sink only the newest MaxPending events are kept.
+	cfg.DropPending = true
+	NewOutboxPruner(zap.NewNop(), cfg, outbox).prune(ctx)
+
+	var buf bytes.Buffer
+	NewOutboxPublisher(zap.NewNop(), OutboxConfig{Interval: time.Second, BatchSize: 10}, outbox, sink.NewWriter(&buf)).publish(ctx)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"login":"bob"`)
+	assert.Contains(t, lines[1], `"login":"carol"`)
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, bytes.ErrTooLarge
+}
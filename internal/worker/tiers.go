@@ -0,0 +1,58 @@
+package worker
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/tracing"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+type TierConfig struct {
+	Tiers []types.Tier
+	// Basis is types.TierBasisEarned or types.TierBasisSpent, counted over
+	// the last Window.
+	Basis    string
+	Window   time.Duration
+	Interval time.Duration
+}
+
+// TierRecalculator periodically moves users between loyalty tiers.
+type TierRecalculator struct {
+	logger *zap.Logger
+	cfg    TierConfig
+	tiers  store.Tier
+	now    func() time.Time
+}
+
+func NewTierRecalculator(logger *zap.Logger, cfg TierConfig, tiers store.Tier) *TierRecalculator {
+	return &TierRecalculator{
+		logger: logger.Named("TierRecalculator"),
+		cfg:    cfg,
+		tiers:  tiers,
+		now:    time.Now,
+	}
+}
+
+// Run recalculates tiers once right away and then every Interval until ctx
+// is done.
+func (t *TierRecalculator) Run(ctx context.Context) {
+	runEvery(ctx, t.cfg.Interval, t.recalculate)
+}
+
+func (t *TierRecalculator) recalculate(ctx context.Context) {
+	ctx, span := tracing.Start(ctx, "worker.recalculateTiers")
+	defer span.End()
+
+	changed, err := t.tiers.RecalculateTiers(ctx, t.cfg.Tiers, t.cfg.Basis, t.now().Add(-t.cfg.Window))
+	if err != nil {
+		t.logger.Error("Unable to recalculate tiers", zap.Error(err))
+		return
+	}
+	if changed > 0 {
+		t.logger.Info("tiers recalculated", zap.Int("changed", changed))
+	}
+}
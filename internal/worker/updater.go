@@ -2,127 +2,177 @@ package worker
 
 import (
 	"context"
-	"database/sql"
-	"encoding/json"
-	"fmt"
-	"github.com/avast/retry-go"
-	"github.com/go-resty/resty/v2"
-	"github.com/shevchukeugeni/gofermart/internal/store"
-	"github.com/shevchukeugeni/gofermart/internal/types"
-	"log"
-	"net/http"
-	"strconv"
+	"errors"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/gofermart/internal/accrual"
+	"github.com/shevchukeugeni/gofermart/internal/events"
+	"github.com/shevchukeugeni/gofermart/internal/metrics"
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/store/postgres"
+	"github.com/shevchukeugeni/gofermart/internal/tracing"
+	"github.com/shevchukeugeni/gofermart/internal/types"
 )
 
+type Config struct {
+	PollInterval time.Duration
+	// Events receives the order status and balance changes the worker
+	// applies; nothing is published when it is nil.
+	Events events.Publisher
+}
+
 type Worker struct {
-	logger            *zap.Logger
-	db                *sql.DB
-	accrualSystemAddr string
-	order             store.Order
+	logger *zap.Logger
+	db     *pgxpool.Pool
+	cfg    Config
+	order  store.Order
 
-	client *resty.Client
+	client accrual.Client
 }
 
-func NewWorker(logger *zap.Logger, db *sql.DB, accrualSystemAddr string, order store.Order, client *resty.Client) *Worker {
+func NewWorker(logger *zap.Logger, db *pgxpool.Pool, cfg Config, order store.Order, client accrual.Client) *Worker {
 	return &Worker{
-		logger:            logger.Named("Worker"),
-		db:                db,
-		accrualSystemAddr: accrualSystemAddr,
-		order:             order,
-		client:            client,
+		logger: logger.Named("Worker"),
+		db:     db,
+		cfg:    cfg,
+		order:  order,
+		client: client,
 	}
 }
 
+// Run polls pending orders every PollInterval until ctx is done. With a
+// database it also listens for uploads and polls right away; the ticker stays
+// as a safety net for missed notifications.
 func (w *Worker) Run(ctx context.Context) {
-	ticker := time.NewTicker(time.Second * 10)
+	ticker := time.NewTicker(w.cfg.PollInterval)
+	defer ticker.Stop()
+
+	// A single slot coalesces the uploads notified during a poll into one
+	// more poll.
+	wake := make(chan struct{}, 1)
+	if w.db != nil {
+		go postgres.Listen(ctx, w.logger, w.db, postgres.OrdersChannel, func(string) {
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		})
+	}
+
+	var backoffUntil time.Time
 	for {
 		select {
 		case <-ctx.Done():
+			return
 		case <-ticker.C:
-			w.logger.Info("worker started")
-			orders, err := w.order.GetPendingOrdersNumbers(ctx)
-			if err != nil {
-				w.logger.Error("Unable to get pending orders", zap.Error(err))
-			}
-
-		Loop:
-			for _, order := range orders {
-				res, err := w.requestAccrual(order.Number)
-				if err != nil {
-					w.logger.Error("Failed accrual system request", zap.Error(err))
-					continue
-				}
-
-				switch res.StatusCode() {
-				case http.StatusNoContent:
-					//наверное спросить позже
-				case http.StatusTooManyRequests:
-					retryAfterStr := res.Header().Get("Retry-After")
-					retryAfter, err := strconv.ParseInt(retryAfterStr, 10, 64)
-					if err != nil {
-						w.logger.Error("unable to get retry time", zap.Error(err))
-						break Loop
-					}
-					ticker = time.NewTicker(time.Duration(retryAfter) * time.Second)
-					break Loop
-				case http.StatusOK:
-					var resp types.AccrualResponse
-
-					err = json.Unmarshal(res.Body(), &resp)
-					if err != nil {
-						w.logger.Error("unable decode accrual response", zap.Error(err))
-						continue
-					}
-
-					switch types.Status(resp.Status) {
-					case types.Registered, types.Processing:
-						continue
-					case types.Invalid, types.Processed:
-						err = w.order.UpdateOrder(ctx, resp.Order, resp.Status, resp.Accrual)
-						if err != nil {
-							w.logger.Error("unable to update order", zap.Error(err))
-							continue
-						}
-					}
-				}
+		case <-wake:
+			// The ticker polls once the accrual system lets us.
+			if time.Now().Before(backoffUntil) {
+				continue
 			}
+			metrics.WorkerWakeups.Inc()
+		}
 
-			w.logger.Info("worker finished")
+		retryAfter := w.poll(ctx)
+		if retryAfter > 0 {
+			backoffUntil = time.Now().Add(retryAfter)
+			ticker.Reset(retryAfter)
+		} else {
+			ticker.Reset(w.cfg.PollInterval)
 		}
 	}
 }
 
-func (w *Worker) requestAccrual(number string) (*resty.Response, error) {
-	req := w.client.R().
-		SetHeader("Content-Type", "application/json").
-		SetHeader("Content-Encoding", "gzip")
-
-	res := new(resty.Response)
-	var innerErr error
-	err := withRetry(func() error {
-		res, innerErr = req.Get(fmt.Sprintf("http://%s/api/orders/%s", w.accrualSystemAddr, number))
-		if innerErr != nil {
-			return innerErr
-		}
-		return nil
-	}, "failed to send metric")
+// poll checks every pending order once. It returns a non-zero duration when
+// the accrual system asked to back off.
+func (w *Worker) poll(ctx context.Context) time.Duration {
+	w.logger.Info("worker started")
+	ctx, span := tracing.Start(ctx, "worker.poll")
+	start := time.Now()
+	defer func() {
+		metrics.WorkerCycleDuration.Observe(time.Since(start).Seconds())
+		span.End()
+		w.logger.Info("worker finished")
+	}()
+
+	orders, err := w.order.GetPendingOrdersNumbers(ctx)
 	if err != nil {
-		return nil, err
+		w.logger.Error("Unable to get pending orders", zap.Error(err))
+		return 0
 	}
+	metrics.WorkerPendingOrders.Set(float64(len(orders)))
+
+	for _, order := range orders {
+		resp, err := w.client.GetOrder(ctx, order.Number)
+		if err := w.order.RecordCheck(ctx, order.Number); err != nil {
+			w.logger.Error("unable to record order check", zap.Error(err))
+		}
+		var rateErr *accrual.RateLimitError
+		switch {
+		case errors.As(err, &rateErr):
+			metrics.WorkerOrdersChecked.Inc()
+			metrics.WorkerRateLimited.Inc()
+			if rateErr.RetryAfter <= 0 {
+				w.logger.Error("unable to get retry time")
+				return 0
+			}
+			return rateErr.RetryAfter
+		case errors.Is(err, accrual.ErrNotRegistered):
+			//наверное спросить позже
+			metrics.WorkerOrdersChecked.Inc()
+			continue
+		case err != nil:
+			w.logger.Error("Failed accrual system request", zap.Error(err))
+			continue
+		}
+		metrics.WorkerOrdersChecked.Inc()
 
-	return res, nil
+		switch types.Status(resp.Status) {
+		case types.Registered, types.Processing:
+			if order.Status != types.New {
+				continue
+			}
+			if _, err := w.order.UpdateOrder(ctx, order.Number, string(types.Processing), 0); err != nil {
+				w.logger.Error("unable to update order", zap.Error(err))
+				continue
+			}
+			metrics.WorkerStatusTransitions.WithLabelValues(string(order.Status), string(types.Processing)).Inc()
+			w.publish(ctx, types.Event{Type: types.EventOrder, UserID: order.UserID, Order: order.Number, Status: types.Processing})
+		case types.Invalid, types.Processed:
+			accrued, err := w.order.UpdateOrder(ctx, resp.Order, resp.Status, resp.Accrual)
+			if err != nil {
+				w.logger.Error("unable to update order", zap.Error(err))
+				continue
+			}
+			metrics.WorkerStatusTransitions.WithLabelValues(string(order.Status), resp.Status).Inc()
+			w.publish(ctx, types.Event{
+				Type:    types.EventOrder,
+				UserID:  order.UserID,
+				Order:   order.Number,
+				Status:  types.Status(resp.Status),
+				Accrual: accrued,
+			})
+			// Counters panic on negative values.
+			if types.Status(resp.Status) == types.Processed && accrued > 0 {
+				metrics.PointsAccrued.Add(accrued)
+				w.publish(ctx, types.Event{Type: types.EventBalance, UserID: order.UserID})
+			}
+		}
+	}
+
+	return 0
 }
 
-func withRetry(fn func() error, warn string) error {
-	interval := time.Second
-	return retry.Do(fn,
-		retry.Attempts(3),
-		retry.Delay(interval),
-		retry.OnRetry(func(n uint, err error) {
-			log.Println(warn, zap.Uint("attempt", n), zap.Error(err))
-			interval += 2 * time.Second
-		}))
+// publish announces a change to the user's event streams. A lost event only
+// leaves the client to find the change on its next request.
+func (w *Worker) publish(ctx context.Context, event types.Event) {
+	if w.cfg.Events == nil {
+		return
+	}
+	if err := w.cfg.Events.Publish(ctx, event); err != nil {
+		w.logger.Error("unable to publish event", zap.Error(err))
+	}
 }
@@ -0,0 +1,71 @@
+package worker
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/gofermart/internal/accrual"
+	"github.com/shevchukeugeni/gofermart/internal/store/order"
+	"github.com/shevchukeugeni/gofermart/internal/store/postgres"
+	"github.com/shevchukeugeni/gofermart/internal/store/user"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+// checkedOrders is an accrual client that reports the numbers it is asked
+// about.
+type checkedOrders chan string
+
+func (c checkedOrders) GetOrder(_ context.Context, number string) (*types.AccrualResponse, error) {
+	select {
+	case c <- number:
+	default:
+	}
+	return nil, accrual.ErrNotRegistered
+}
+
+func TestWorkerWakesOnUpload(t *testing.T) {
+	uri := os.Getenv("TEST_DATABASE_URI")
+	if uri == "" {
+		t.Skip("TEST_DATABASE_URI is not set")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db, err := postgres.NewPostgresDB(ctx, postgres.Config{URL: uri})
+	require.NoError(t, err)
+	t.Cleanup(db.Close)
+
+	usr := (&types.UserLoginRequest{Login: "worker-wakeup", Password: "password"}).User().ToDB()
+	usr.Login += "-" + usr.ID
+	require.NoError(t, user.NewRepository(db).CreateUser(ctx, usr))
+
+	// The ticker alone would not poll within the test.
+	checked := make(checkedOrders, 100)
+	orders := order.NewRepository(db)
+	w := NewWorker(zap.NewNop(), db, Config{PollInterval: time.Hour}, orders, checked)
+	go w.Run(ctx)
+
+	// LISTEN is issued asynchronously; upload until an upload is noticed.
+	uploaded := map[string]bool{}
+	require.Eventually(t, func() bool {
+		number := strconv.FormatInt(time.Now().UnixNano(), 10)
+		require.NoError(t, orders.CreateOrder(ctx, &types.Order{Number: number, UserID: usr.ID}))
+		uploaded[number] = true
+		for {
+			select {
+			case number := <-checked:
+				if uploaded[number] {
+					return true
+				}
+			case <-time.After(100 * time.Millisecond):
+				return false
+			}
+		}
+	}, 10*time.Second, 10*time.Millisecond)
+}
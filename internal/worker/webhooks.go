@@ -0,0 +1,165 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/gofermart/internal/metrics"
+	"github.com/shevchukeugeni/gofermart/internal/store"
+	"github.com/shevchukeugeni/gofermart/internal/tracing"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+// Headers of a webhook request. The signature is "sha256=" followed by the
+// hex HMAC-SHA256 of the timestamp, a dot and the body, keyed by the
+// webhook's secret; see SignWebhook.
+const (
+	WebhookEventHeader     = "X-Gophermart-Event"
+	WebhookDeliveryHeader  = "X-Gophermart-Delivery"
+	WebhookTimestampHeader = "X-Gophermart-Timestamp"
+	WebhookSignatureHeader = "X-Gophermart-Signature"
+)
+
+const (
+	// webhookBatchSize is how many deliveries a dispatch claims at most.
+	webhookBatchSize = 50
+	// maxWebhookBackoff caps the growth of the retry delay.
+	maxWebhookBackoff = 6 * time.Hour
+)
+
+type WebhookConfig struct {
+	Interval time.Duration
+	// MaxAttempts is how many times a delivery is tried before it is parked
+	// as dead.
+	MaxAttempts int
+	// Backoff is the delay after the first failed attempt; it doubles after
+	// every next one.
+	Backoff time.Duration
+	// Timeout limits a single request.
+	Timeout time.Duration
+}
+
+// WebhookDispatcher sends the deliveries queued in the webhook outbox.
+type WebhookDispatcher struct {
+	logger   *zap.Logger
+	cfg      WebhookConfig
+	webhooks store.Webhook
+	client   *http.Client
+	now      func() time.Time
+}
+
+func NewWebhookDispatcher(logger *zap.Logger, cfg WebhookConfig, webhooks store.Webhook) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		logger:   logger.Named("WebhookDispatcher"),
+		cfg:      cfg,
+		webhooks: webhooks,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		now:      time.Now,
+	}
+}
+
+// Run dispatches due deliveries once right away and then every Interval
+// until ctx is done.
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	runEvery(ctx, d.cfg.Interval, d.dispatch)
+}
+
+func (d *WebhookDispatcher) dispatch(ctx context.Context) {
+	ctx, span := tracing.Start(ctx, "worker.dispatchWebhooks")
+	defer span.End()
+
+	// The batch is sent one by one, so it is leased for as long as sending
+	// all of it may take.
+	lease := webhookBatchSize * d.cfg.Timeout
+	deliveries, err := d.webhooks.ClaimDeliveries(ctx, webhookBatchSize, lease)
+	if err != nil {
+		d.logger.Error("Unable to claim webhook deliveries", zap.Error(err))
+		return
+	}
+
+	for _, delivery := range deliveries {
+		err := d.send(ctx, delivery)
+		if err == nil {
+			metrics.WebhookDeliveries.WithLabelValues("delivered").Inc()
+			if err := d.webhooks.CompleteDelivery(ctx, delivery.ID); err != nil {
+				d.logger.Error("Unable to complete webhook delivery", zap.Int64("delivery", delivery.ID), zap.Error(err))
+			}
+			continue
+		}
+
+		result, retryIn := "dead", time.Duration(0)
+		if attempts := delivery.Attempts + 1; attempts < d.cfg.MaxAttempts {
+			result, retryIn = "failed", d.backoff(attempts)
+		}
+		metrics.WebhookDeliveries.WithLabelValues(result).Inc()
+		d.logger.Warn("webhook delivery failed",
+			zap.Int64("delivery", delivery.ID),
+			zap.Int64("webhook", delivery.WebhookID),
+			zap.Int("attempt", delivery.Attempts+1),
+			zap.Duration("retry_in", retryIn),
+			zap.Error(err))
+		if err := d.webhooks.FailDelivery(ctx, delivery.ID, err.Error(), retryIn); err != nil {
+			d.logger.Error("Unable to record webhook failure", zap.Int64("delivery", delivery.ID), zap.Error(err))
+		}
+	}
+}
+
+// backoff returns the delay after the given number of failed attempts.
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	delay := d.cfg.Backoff
+	for i := 1; i < attempts && delay < maxWebhookBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxWebhookBackoff {
+		delay = maxWebhookBackoff
+	}
+	return delay
+}
+
+func (d *WebhookDispatcher) send(ctx context.Context, delivery types.WebhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(d.now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, delivery.Event)
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(delivery.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain a little so that the connection can be reused.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SignWebhook returns the signature header value of a webhook request. The
+// timestamp is signed along with the body so that receivers can reject
+// replayed requests.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
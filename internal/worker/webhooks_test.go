@@ -0,0 +1,114 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/gofermart/internal/store/memory"
+	"github.com/shevchukeugeni/gofermart/internal/types"
+)
+
+func TestWebhookDispatcher(t *testing.T) {
+	ctx := context.Background()
+
+	var (
+		mu       sync.Mutex
+		status   = http.StatusInternalServerError
+		requests []*http.Request
+		bodies   [][]byte
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r)
+		bodies = append(bodies, body)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	db := memory.New()
+	webhooks := memory.NewWebhookRepository(db)
+	orders := memory.NewOrderRepository(db)
+	users := memory.NewUserRepository(db)
+
+	user := (&types.UserLoginRequest{Login: "alice", Password: "password"}).User().ToDB()
+	require.NoError(t, users.CreateUser(ctx, user))
+	webhook := &types.Webhook{MerchantID: "acme", URL: srv.URL, Secret: "secret", Events: types.WebhookEvents}
+	require.NoError(t, webhooks.CreateWebhook(ctx, webhook))
+	require.NoError(t, orders.CreateOrder(ctx, &types.Order{Number: "12345678903", UserID: user.ID, MerchantID: "acme"}))
+	_, err := orders.UpdateOrder(ctx, "12345678903", string(types.Processed), 100)
+	require.NoError(t, err)
+
+	d := NewWebhookDispatcher(zap.NewNop(), WebhookConfig{
+		Interval:    time.Second,
+		MaxAttempts: 2,
+		Backoff:     time.Nanosecond,
+		Timeout:     time.Second,
+	}, webhooks)
+
+	// Both attempts fail, so the delivery is parked.
+	d.dispatch(ctx)
+	d.dispatch(ctx)
+	dead, err := webhooks.GetDeadDeliveries(ctx)
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, 2, dead[0].Attempts)
+	assert.Equal(t, "unexpected status 500", dead[0].LastError)
+
+	d.dispatch(ctx)
+	mu.Lock()
+	require.Len(t, requests, 2)
+	mu.Unlock()
+
+	mu.Lock()
+	status = http.StatusNoContent
+	mu.Unlock()
+	require.NoError(t, webhooks.ReplayDelivery(ctx, dead[0].ID))
+	d.dispatch(ctx)
+	d.dispatch(ctx)
+
+	dead, err = webhooks.GetDeadDeliveries(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, dead)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, requests, 3)
+	r, body := requests[2], bodies[2]
+	assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+	assert.Equal(t, types.WebhookOrderProcessed, r.Header.Get(WebhookEventHeader))
+	assert.NotEmpty(t, r.Header.Get(WebhookDeliveryHeader))
+	assert.Equal(t, SignWebhook("secret", r.Header.Get(WebhookTimestampHeader), body), r.Header.Get(WebhookSignatureHeader))
+
+	var payload types.WebhookPayload
+	require.NoError(t, json.Unmarshal(body, &payload))
+	assert.Equal(t, "12345678903", payload.Order)
+	assert.Equal(t, types.Processed, payload.Status)
+	assert.InDelta(t, 100, payload.Accrual, 1e-9)
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	d := NewWebhookDispatcher(zap.NewNop(), WebhookConfig{Backoff: time.Second}, nil)
+
+	assert.Equal(t, time.Second, d.backoff(1))
+	assert.Equal(t, 2*time.Second, d.backoff(2))
+	assert.Equal(t, 4*time.Second, d.backoff(3))
+	assert.Equal(t, maxWebhookBackoff, d.backoff(100))
+}
+
+func TestSignWebhook(t *testing.T) {
+	// echo -n '1700000000.{}' | openssl dgst -sha256 -hmac secret
+	assert.Equal(t, "sha256=b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163",
+		SignWebhook("secret", "1700000000", []byte("{}")))
+}